@@ -30,12 +30,34 @@ type commandLine struct {
 	key        *string
 	dial       *string
 	read       *string
+	tidle      *string
+	tlife      *string
+	tmax       *string
+	uidle      *string
+	ulife      *string
+	umax       *string
 	rate       *string
 	slot       *string
 	proxy      *string
 	block      *string
 	notcp      *string
 	noudp      *string
+	dgram      *string
+	umux       *string
+	insecure   *string
+	clients    *string
+	tenants    *string
+	policy     *string
+	keys       *string
+	decoy      *string
+	connect    *string
+	failover   *string
+	upstream   *string
+	ca         *string
+	name       *string
+	pin        *string
+	state      *string
+	retrust    *string
 }
 
 func newCommandLine(args []string) *commandLine {
@@ -89,18 +111,36 @@ func (c *commandLine) addServerFlags(fs *flag.FlagSet) {
 	c.tls = fs.String("tls", "", "TLS mode")
 	c.crt = fs.String("crt", "", "Certificate file path")
 	c.key = fs.String("key", "", "Key file path")
+	c.ca = fs.String("ca", "", "Client CA bundle path")
+	c.pin = fs.String("pin", "", "Pinned client certificate fingerprint")
+	c.state = fs.String("state", "", "State directory for the TLS identity")
 	c.lbs = fs.String("lbs", "", "Load balancing strategy")
 	c.max = fs.String("max", "", "Maximum pool size")
 	c.mode = fs.String("mode", "", "Run mode")
 	c.pool = fs.String("type", "", "Pool type")
 	c.dial = fs.String("dial", "", "Outbound source IP")
 	c.read = fs.String("read", "", "Read timeout")
+	c.tidle = fs.String("tidle", "", "TCP session idle timeout")
+	c.tlife = fs.String("tlife", "", "TCP session maximum lifetime")
+	c.tmax = fs.String("tmax", "", "TCP session maximum bytes")
+	c.uidle = fs.String("uidle", "", "UDP session idle timeout")
+	c.ulife = fs.String("ulife", "", "UDP session maximum lifetime")
+	c.umax = fs.String("umax", "", "UDP session limit")
 	c.rate = fs.String("rate", "", "Bandwidth limit in Mbps")
 	c.slot = fs.String("slot", "", "Connection slot limit")
 	c.proxy = fs.String("proxy", "", "PROXY protocol v1")
 	c.block = fs.String("block", "", "Block protocols")
 	c.notcp = fs.String("notcp", "", "Disable TCP")
 	c.noudp = fs.String("noudp", "", "Disable UDP")
+	c.dgram = fs.String("dgram", "", "QUIC datagram port")
+	c.umux = fs.String("umux", "", "Shared UDP channels")
+	c.insecure = fs.String("insecure", "", "Allow the default tunnel key")
+	c.clients = fs.String("clients", "", "Maximum concurrent clients")
+	c.tenants = fs.String("tenants", "", "Tenant table file")
+	c.policy = fs.String("policy", "", "Client policy file")
+	c.keys = fs.String("keys", "", "Tunnel key rotation file")
+	c.decoy = fs.String("decoy", "", "Decoy backend for unauthenticated handshake traffic")
+	c.connect = fs.String("connect", "", "CONNECT proxy destination allowlist")
 }
 
 func (c *commandLine) addClientFlags(fs *flag.FlagSet) {
@@ -116,17 +156,30 @@ func (c *commandLine) addClientFlags(fs *flag.FlagSet) {
 	c.tls = fs.String("tls", "", "TLS mode")
 	c.crt = fs.String("crt", "", "Certificate file path")
 	c.key = fs.String("key", "", "Key file path")
+	c.ca = fs.String("ca", "", "Server CA bundle path")
+	c.name = fs.String("name", "", "Expected server name")
+	c.pin = fs.String("pin", "", "Pinned server certificate fingerprint")
+	c.state = fs.String("state", "", "State directory for trusted servers")
+	c.retrust = fs.String("retrust", "", "Trust a changed server certificate")
 	c.lbs = fs.String("lbs", "", "Load balancing strategy")
 	c.min = fs.String("min", "", "Minimum pool size")
 	c.mode = fs.String("mode", "", "Connection mode")
 	c.dial = fs.String("dial", "", "Outbound source IP")
 	c.read = fs.String("read", "", "Read timeout")
+	c.tidle = fs.String("tidle", "", "TCP session idle timeout")
+	c.tlife = fs.String("tlife", "", "TCP session maximum lifetime")
+	c.tmax = fs.String("tmax", "", "TCP session maximum bytes")
+	c.uidle = fs.String("uidle", "", "UDP session idle timeout")
+	c.ulife = fs.String("ulife", "", "UDP session maximum lifetime")
+	c.umax = fs.String("umax", "", "UDP session limit")
 	c.rate = fs.String("rate", "", "Bandwidth limit in Mbps")
 	c.slot = fs.String("slot", "", "Connection slot limit")
 	c.proxy = fs.String("proxy", "", "PROXY protocol v1")
 	c.block = fs.String("block", "", "Block protocols")
 	c.notcp = fs.String("notcp", "", "Disable TCP")
 	c.noudp = fs.String("noudp", "", "Disable UDP")
+	c.failover = fs.String("failover", "", "Server failover order")
+	c.upstream = fs.String("upstream", "", "Upstream HTTP or SOCKS5 proxy")
 }
 
 func (c *commandLine) addMasterFlags(fs *flag.FlagSet) {
@@ -168,7 +221,7 @@ func (c *commandLine) buildQuery() url.Values {
 	if c.tls != nil && *c.tls != "" {
 		query.Set("tls", *c.tls)
 	}
-	if c.crt != nil && c.key != nil && c.tls != nil && *c.tls == "2" {
+	if c.crt != nil && c.key != nil {
 		if *c.crt != "" {
 			query.Set("crt", *c.crt)
 		}
@@ -176,12 +229,45 @@ func (c *commandLine) buildQuery() url.Values {
 			query.Set("key", *c.key)
 		}
 	}
+	if c.ca != nil && *c.ca != "" {
+		query.Set("ca", *c.ca)
+	}
+	if c.name != nil && *c.name != "" {
+		query.Set("name", *c.name)
+	}
+	if c.pin != nil && *c.pin != "" {
+		query.Set("pin", *c.pin)
+	}
+	if c.state != nil && *c.state != "" {
+		query.Set("state", *c.state)
+	}
+	if c.retrust != nil && *c.retrust != "" {
+		query.Set("retrust", *c.retrust)
+	}
 	if c.dial != nil && *c.dial != "" {
 		query.Set("dial", *c.dial)
 	}
 	if c.read != nil && *c.read != "" {
 		query.Set("read", *c.read)
 	}
+	if c.tidle != nil && *c.tidle != "" {
+		query.Set("tidle", *c.tidle)
+	}
+	if c.tlife != nil && *c.tlife != "" {
+		query.Set("tlife", *c.tlife)
+	}
+	if c.tmax != nil && *c.tmax != "" {
+		query.Set("tmax", *c.tmax)
+	}
+	if c.uidle != nil && *c.uidle != "" {
+		query.Set("uidle", *c.uidle)
+	}
+	if c.ulife != nil && *c.ulife != "" {
+		query.Set("ulife", *c.ulife)
+	}
+	if c.umax != nil && *c.umax != "" {
+		query.Set("umax", *c.umax)
+	}
 	if c.rate != nil && *c.rate != "" {
 		query.Set("rate", *c.rate)
 	}
@@ -200,6 +286,39 @@ func (c *commandLine) buildQuery() url.Values {
 	if c.noudp != nil && *c.noudp != "" {
 		query.Set("noudp", *c.noudp)
 	}
+	if c.dgram != nil && *c.dgram != "" {
+		query.Set("dgram", *c.dgram)
+	}
+	if c.umux != nil && *c.umux != "" {
+		query.Set("umux", *c.umux)
+	}
+	if c.insecure != nil && *c.insecure != "" {
+		query.Set("insecure", *c.insecure)
+	}
+	if c.clients != nil && *c.clients != "" {
+		query.Set("clients", *c.clients)
+	}
+	if c.tenants != nil && *c.tenants != "" {
+		query.Set("tenants", *c.tenants)
+	}
+	if c.policy != nil && *c.policy != "" {
+		query.Set("policy", *c.policy)
+	}
+	if c.keys != nil && *c.keys != "" {
+		query.Set("keys", *c.keys)
+	}
+	if c.decoy != nil && *c.decoy != "" {
+		query.Set("decoy", *c.decoy)
+	}
+	if c.connect != nil && *c.connect != "" {
+		query.Set("connect", *c.connect)
+	}
+	if c.failover != nil && *c.failover != "" {
+		query.Set("failover", *c.failover)
+	}
+	if c.upstream != nil && *c.upstream != "" {
+		query.Set("upstream", *c.upstream)
+	}
 
 	return query
 }
@@ -10,7 +10,16 @@ import (
 )
 
 func getTLSProtocol(parsedURL *url.URL, logger *logs.Logger) (string, *tls.Config) {
-	tlsConfig, err := common.NewTLSConfig()
+	var tlsConfig *tls.Config
+	var err error
+	stateDir := parsedURL.Query().Get("state")
+	if stateDir != "" && parsedURL.Scheme == "server" {
+		if tlsConfig, err = common.LoadTLSConfig(stateDir); err == nil {
+			logger.Info("TLS identity loaded from state: %v", stateDir)
+		}
+	} else {
+		tlsConfig, err = common.NewTLSConfig()
+	}
 	if err != nil {
 		logger.Error("Generate TLS config failed: %v", err)
 		logger.Warn("TLS code-0: nil cert")
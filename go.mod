@@ -9,13 +9,13 @@ require (
 	github.com/NodePassProject/npws v1.1.1
 	github.com/NodePassProject/pool v1.1.1
 	github.com/NodePassProject/quic v1.1.1
+	github.com/quic-go/quic-go v0.59.0
+	golang.org/x/net v0.50.0
 )
 
 require (
 	github.com/coder/websocket v1.8.14 // indirect
-	github.com/quic-go/quic-go v0.59.0 // indirect
 	golang.org/x/crypto v0.48.0 // indirect
-	golang.org/x/net v0.50.0 // indirect
 	golang.org/x/sys v0.41.0 // indirect
 	golang.org/x/text v0.34.0 // indirect
 )
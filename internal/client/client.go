@@ -3,13 +3,11 @@ package client
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
-	"os"
-	"os/signal"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/NodePassProject/logs"
@@ -50,24 +48,52 @@ func NewClient(parsedURL *url.URL, tlsConfig *tls.Config, logger *logs.Logger) (
 
 func (c *Client) Run() {
 	logInfo := func(prefix string) {
-		c.Logger.Info("%v: client://%v@%v/%v?dns=%v&sni=%v&lbs=%v&min=%v&mode=%v&dial=%v&read=%v&rate=%v&slot=%v&proxy=%v&block=%v&notcp=%v&noudp=%v",
-			prefix, c.TunnelKey, c.TunnelTCPAddr, c.GetTargetAddrsString(), c.DNSCacheTTL, c.ServerName, c.LBStrategy, c.MinPoolCapacity,
-			c.RunMode, c.DialerIP, c.ReadTimeout, c.RateLimit/125000, c.SlotLimit,
-			c.ProxyProtocol, c.BlockProtocol, c.DisableTCP, c.DisableUDP)
+		c.Logger.Info("%v: client://%v@%v/%v?dns=%v&sni=%v&lbs=%v&min=%v&mode=%v&dial=%v&read=%v&tidle=%v&tlife=%v&tmax=%v&uidle=%v&ulife=%v&umax=%v&rate=%v&slot=%v&proxy=%v&block=%v&notcp=%v&noudp=%v&failover=%v&upstream=%v",
+			prefix, c.TunnelKeyString(), c.TunnelTCPAddr, c.GetTargetAddrsString(), c.DNSCacheTTL, c.ServerName, c.LBStrategy, c.MinPoolCapacity,
+			c.RunMode, c.DialerIP, c.ReadTimeout, c.TCPIdleTimeout, c.TCPLifeTimeout, c.TCPMaxBytes, c.UDPIdleTimeout, c.UDPLifeTimeout, c.UDPLimit, c.RateLimit/125000, c.SlotLimit,
+			c.ProxyProtocol, c.BlockProtocol, c.DisableTCP, c.DisableUDP, c.FailoverMode, c.UpstreamString())
 	}
 	logInfo("Client started")
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx, stop := c.ShutdownContext()
+	go c.DrainLoop(ctx, stop, c.StartDrain, c.ActiveSessions)
 
 	go func() {
 		for ctx.Err() == nil {
+			c.MarkAttempt()
 			if err := c.Start(); err != nil && err != io.EOF {
-				c.Logger.Error("Client error: %v", err)
-				c.Stop()
-				select {
-				case <-ctx.Done():
+				if ctx.Err() != nil {
 					return
-				case <-time.After(common.ServiceCooldown):
+				}
+				cooldown, planned := c.RestartCooldown(err)
+				if errors.Is(err, common.ErrPeerBye) {
+					c.Logger.Warn("Server closed tunnel: reason=%v", c.PeerBye)
+				} else {
+					if !c.PreferredSwitch.Load() {
+						c.Logger.Error("Client error: %v", err)
+					}
+					c.SendBye(common.ByeRestart)
+				}
+				c.Stop()
+				var tunnelErr *common.TunnelError
+				failover := !planned && (errors.As(err, &tunnelErr) || errors.Is(err, common.ErrPeerBye))
+				backoff := !failover
+				if failover {
+					if backoff, err = c.NextTunnelAddr(); err != nil {
+						c.Logger.Error("Client error: %v", err)
+					}
+				}
+				if backoff {
+					if planned {
+						c.ResetBackoff()
+					}
+					delay, attempt := c.NextBackoff(cooldown)
+					c.Logger.Info("Restart backoff: %v (attempt %v)", delay.Round(time.Millisecond), attempt)
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(delay):
+					}
 				}
 				logInfo("Client restart")
 			}
@@ -79,7 +105,11 @@ func (c *Client) Run() {
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), common.ShutdownTimeout)
 	defer cancel()
-	if err := c.CommonShutdown(shutdownCtx, c.Stop); err != nil {
+	if err := c.CommonShutdown(shutdownCtx, func() {
+		c.SendBye(c.ByeReason)
+		c.Stop()
+		c.ReleaseListeners()
+	}); err != nil {
 		c.Logger.Error("Client shutdown error: %v", err)
 	} else {
 		c.Logger.Info("Client shutdown complete")
@@ -126,17 +156,21 @@ func (c *Client) CommonStart() error {
 	c.Logger.Info("Pending tunnel handshake...")
 	c.HandshakeStart = time.Now()
 	if err := c.TunnelHandshake(); err != nil {
-		return fmt.Errorf("CommonStart: tunnelHandshake failed: %w", err)
+		return &common.TunnelError{Err: fmt.Errorf("CommonStart: tunnelHandshake failed: %w", err)}
 	}
 
 	if err := c.InitTunnelPool(); err != nil {
-		return fmt.Errorf("CommonStart: initTunnelPool failed: %w", err)
+		return &common.TunnelError{Err: fmt.Errorf("CommonStart: initTunnelPool failed: %w", err)}
 	}
 
+	go c.DatagramDialLoop()
+
 	c.Logger.Info("Getting tunnel pool ready...")
 	if err := c.SetControlConn(); err != nil {
-		return fmt.Errorf("CommonStart: setControlConn failed: %w", err)
+		return &common.TunnelError{Err: fmt.Errorf("CommonStart: setControlConn failed: %w", err)}
 	}
+	c.FailoverTries = 0
+	go c.PreferredLoop(c.ProbeTunnel)
 
 	if c.DataFlow == "+" {
 		if err := c.InitTargetListener(); err != nil {
@@ -146,7 +180,7 @@ func (c *Client) CommonStart() error {
 	}
 
 	if err := c.CommonControl(); err != nil {
-		return fmt.Errorf("CommonStart: commonControl failed: %w", err)
+		return &common.TunnelError{Err: fmt.Errorf("CommonStart: commonControl failed: %w", err)}
 	}
 
 	return nil
@@ -1,51 +1,199 @@
 package client
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NodePassProject/nodepass/internal/common"
 )
 
-func (c *Client) TunnelHandshake() error {
-	req, _ := http.NewRequest(http.MethodGet, "https://"+c.TunnelAddr+"/", nil)
-	req.Host = c.ServerName
-	req.Header.Set("Authorization", "Bearer "+c.GenerateAuthToken())
-
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		},
+func (c *Client) TrustOnFirstUse(state *tls.ConnectionState, tlsCode string) error {
+	if !c.TrustPending {
+		return nil
+	}
+	if tlsCode == "0" || state == nil || len(state.PeerCertificates) == 0 {
+		c.Logger.Warn("TrustOnFirstUse: server offers no stable certificate, nothing pinned")
+		return nil
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return fmt.Errorf("TunnelHandshake: %w", err)
+	pin := c.FormatCertFingerprint(state.PeerCertificates[0].Raw)
+	if err := common.SaveTrustedPin(c.StateDir, c.TunnelAddr, pin); err != nil {
+		return fmt.Errorf("TrustOnFirstUse: %w", err)
 	}
-	defer resp.Body.Close()
+	c.PeerPin, c.TrustPending = pin, false
+	c.Logger.Info("Server certificate trusted on first use: %v", pin)
+	return nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("TunnelHandshake: status %d", resp.StatusCode)
+type tunnelConfig struct {
+	Version int            `json:"version"`
+	Caps    []string       `json:"caps"`
+	Flow    string         `json:"flow"`
+	Max     int            `json:"max"`
+	TLS     string         `json:"tls"`
+	Type    string         `json:"type"`
+	Dgram   int            `json:"dgram"`
+	Umux    int            `json:"umux"`
+	Route   string         `json:"route"`
+	Policy  *common.Policy `json:"policy"`
+	Probe   bool           `json:"probe"`
+	Proof   string         `json:"proof"`
+
+	clientNonce string
+	serverNonce string
+	state       *tls.ConnectionState
+}
+
+func (c *Client) newProbe(idx int) (*Client, error) {
+	probe := &Client{}
+	probe.ParsedURL = c.ParsedURL
+	probe.Logger = c.Logger
+	probe.CoreType = c.CoreType
+	probe.DNSCacheTTL = c.DNSCacheTTL
+	probe.TunnelAddrs = c.TunnelAddrs
+	probe.Upstream = c.Upstream
+	probe.ClientCert = c.ClientCert
+	probe.Ctx = c.Ctx
+	if err := probe.SelectTunnelAddr(idx); err != nil {
+		return nil, fmt.Errorf("newProbe: %w", err)
 	}
+	return probe, nil
+}
+
+func (c *Client) ProbeTunnel(idx int) (bool, error) {
+	probe, err := c.newProbe(idx)
+	if err != nil {
+		return false, fmt.Errorf("ProbeTunnel: %w", err)
+	}
+	config, err := probe.requestConfig(true)
+	if err != nil {
+		return false, fmt.Errorf("ProbeTunnel: %w", err)
+	}
+	return config.Probe, nil
+}
 
-	var config struct {
-		Flow string `json:"flow"`
-		Max  int    `json:"max"`
-		TLS  string `json:"tls"`
-		Type string `json:"type"`
+func (c *Client) TunnelHandshake() error {
+	config, err := c.requestConfig(false)
+	if err != nil {
+		return fmt.Errorf("TunnelHandshake: %w", err)
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+	if err := c.InitControlCipher(config.clientNonce, config.serverNonce, config.state); err != nil {
+		return fmt.Errorf("TunnelHandshake: %w", err)
+	}
+	if config.state != nil {
+		c.ReportPeerCert(config.state.PeerCertificates)
+	}
+	if err := c.TrustOnFirstUse(config.state, config.TLS); err != nil {
 		return fmt.Errorf("TunnelHandshake: %w", err)
 	}
 
+	c.Capabilities = common.NegotiateCapabilities(strings.Join(config.Caps, ","))
 	c.DataFlow = config.Flow
 	c.MaxPoolCapacity = config.Max
 	c.TLSCode = config.TLS
 	c.PoolType = config.Type
+	c.DatagramPort = strconv.Itoa(config.Dgram)
+	c.UDPMux = config.Umux
+	c.RouteID = config.Route
 
-	c.Logger.Info("Loading tunnel config: FLOW=%v|MAX=%v|TLS=%v|TYPE=%v",
-		c.DataFlow, c.MaxPoolCapacity, c.TLSCode, c.PoolType)
+	c.Logger.Info("Loading tunnel config: VER=%v|CAPS=%v|FLOW=%v|MAX=%v|TLS=%v|TYPE=%v|DGRAM=%v|UMUX=%v",
+		config.Version, strings.Join(c.Capabilities, ","), c.DataFlow, c.MaxPoolCapacity, c.TLSCode, c.PoolType, c.DatagramPort, c.UDPMux)
+	c.ApplyPolicy(config.Policy)
 	return nil
 }
+
+func (c *Client) requestConfig(probe bool) (*tunnelConfig, error) {
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         c.PeerName,
+			NextProtos:         []string{common.HandshakeALPN},
+			Certificates:       c.ClientCertificates(),
+			VerifyConnection: func(state tls.ConnectionState) error {
+				return c.VerifyPeerCertificates(state.PeerCertificates)
+			},
+		},
+	}
+	if c.Upstream != nil {
+		transport.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return c.DialTunnel(ctx, addr)
+		}
+	}
+	client := &http.Client{Transport: transport}
+	if probe {
+		client.Timeout = common.HandshakeTimeout
+	}
+
+	clientNonce := common.NewControlNonce()
+	newRequest := func() *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, "https://"+c.TunnelAddr+"/", nil)
+		req.Host = c.ServerName
+		req.Header.Set("Nonce", clientNonce)
+		req.Header.Set("Version", strconv.Itoa(common.ProtocolVersion))
+		req.Header.Set("Capabilities", strings.Join(common.Capabilities, ","))
+		if probe {
+			req.Header.Set("Probe", "1")
+		}
+		return req
+	}
+
+	resp, err := client.Do(newRequest())
+	if err != nil {
+		return nil, fmt.Errorf("requestConfig: %w", err)
+	}
+	if resp.StatusCode == http.StatusUpgradeRequired {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("requestConfig: server rejected protocol version %v: %v", common.ProtocolVersion, strings.TrimSpace(string(body)))
+	}
+	resp.Body.Close()
+
+	serverNonce := resp.Header.Get("Challenge")
+	if resp.StatusCode != http.StatusUnauthorized || serverNonce == "" {
+		return nil, fmt.Errorf("requestConfig: no challenge: status %d", resp.StatusCode)
+	}
+
+	c.StoreSessionKey(c.LoadTunnelKey())
+	timestamp := time.Now().Unix()
+	req := newRequest()
+	req.Header.Set("Challenge", serverNonce)
+	req.Header.Set("Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("Authorization", "Bearer "+c.GenerateAuthToken("client", clientNonce, serverNonce, timestamp))
+
+	resp, err = client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("requestConfig: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUpgradeRequired {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("requestConfig: server rejected client: %v", strings.TrimSpace(string(body)))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("requestConfig: status %d", resp.StatusCode)
+	}
+
+	config := &tunnelConfig{clientNonce: clientNonce, serverNonce: serverNonce, state: resp.TLS}
+	if err := json.NewDecoder(resp.Body).Decode(config); err != nil {
+		return nil, fmt.Errorf("requestConfig: %w", err)
+	}
+	if config.Version < common.MinProtocolVersion {
+		return nil, fmt.Errorf("requestConfig: server protocol version %v unsupported, need >= %v", config.Version, common.MinProtocolVersion)
+	}
+	if !c.VerifyAuthToken(config.Proof, "server", clientNonce, serverNonce, timestamp) {
+		return nil, fmt.Errorf("requestConfig: server proof verification failed")
+	}
+	if !config.Probe && config.TLS == "0" && c.PeerVerifyEnabled() {
+		return nil, fmt.Errorf("requestConfig: server offered unencrypted pool while certificate verification is required")
+	}
+	return config, nil
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/url"
+	"testing"
+
+	"github.com/NodePassProject/logs"
+	"github.com/NodePassProject/nodepass/internal/common"
+)
+
+func TestTrustOnFirstUse(t *testing.T) {
+	newCert := func() *x509.Certificate {
+		config, err := common.NewTLSConfig()
+		if err != nil {
+			t.Fatalf("NewTLSConfig: %v", err)
+		}
+		cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatalf("ParseCertificate: %v", err)
+		}
+		return cert
+	}
+	first, changed := newCert(), newCert()
+	stateDir := t.TempDir()
+
+	newClient := func(query string) *Client {
+		parsedURL, _ := url.Parse("client://key@127.0.0.1:10101/127.0.0.1:8080?state=" + url.QueryEscape(stateDir) + query)
+		c := &Client{Common: common.Common{
+			ParsedURL:  parsedURL,
+			Logger:     logs.NewLogger(logs.None, false),
+			CoreType:   "client",
+			TunnelAddr: "127.0.0.1:10101",
+		}}
+		if err := c.GetStateDir(); err != nil {
+			t.Fatalf("GetStateDir: %v", err)
+		}
+		return c
+	}
+	state := func(cert *x509.Certificate) *tls.ConnectionState {
+		return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	}
+
+	c := newClient("")
+	if !c.TrustPending {
+		t.Fatal("no pending trust without a known_servers entry")
+	}
+	if err := c.TrustOnFirstUse(state(first), "0"); err != nil || !c.TrustPending {
+		t.Fatalf("TrustOnFirstUse with tls=0 = %v, pending %v, want nothing pinned", err, c.TrustPending)
+	}
+	if err := c.TrustOnFirstUse(state(first), "1"); err != nil {
+		t.Fatalf("TrustOnFirstUse: %v", err)
+	}
+	pin := c.FormatCertFingerprint(first.Raw)
+	if c.PeerPin != pin || c.TrustPending {
+		t.Fatalf("PeerPin = %q, pending %v, want %q pinned", c.PeerPin, c.TrustPending, pin)
+	}
+
+	c = newClient("")
+	if c.PeerPin != pin || c.TrustPending {
+		t.Fatalf("restarted client PeerPin = %q, pending %v, want %q", c.PeerPin, c.TrustPending, pin)
+	}
+	if err := c.VerifyPeerCertificates([]*x509.Certificate{first}); err != nil {
+		t.Fatalf("pinned certificate rejected: %v", err)
+	}
+	if err := c.VerifyPeerCertificates([]*x509.Certificate{changed}); err == nil {
+		t.Fatal("changed certificate accepted")
+	}
+	if err := c.TrustOnFirstUse(state(changed), "1"); err != nil {
+		t.Fatalf("TrustOnFirstUse: %v", err)
+	}
+	if saved, _ := common.LoadTrustedPin(stateDir, c.TunnelAddr); saved != pin {
+		t.Fatalf("known_servers entry = %q, want %q kept", saved, pin)
+	}
+
+	c = newClient("&retrust=1")
+	if err := c.TrustOnFirstUse(state(changed), "1"); err != nil {
+		t.Fatalf("TrustOnFirstUse: %v", err)
+	}
+	if saved, _ := common.LoadTrustedPin(stateDir, c.TunnelAddr); saved != c.FormatCertFingerprint(changed.Raw) {
+		t.Fatalf("known_servers entry = %q after retrust, want the new certificate", saved)
+	}
+}
@@ -1,8 +1,12 @@
 package client
 
 import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/NodePassProject/nodepass/internal/common"
 	"github.com/NodePassProject/nph2"
@@ -11,7 +15,92 @@ import (
 	"github.com/NodePassProject/quic"
 )
 
+type verifiedPool struct {
+	common.TransportPool
+	client     *Client
+	serverName string
+}
+
+func (p *verifiedPool) verify(poolConn net.Conn) error {
+	if p.serverName == "" {
+		return p.client.VerifyPeerConn(poolConn)
+	}
+
+	stateConn, ok := poolConn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return fmt.Errorf("verify: no TLS state on %v", poolConn.RemoteAddr())
+	}
+	certs := stateConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("verify: no peer certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{DNSName: p.serverName, Intermediates: intermediates}); err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	return nil
+}
+
+func (p *verifiedPool) IncomingGet(timeout time.Duration) (string, net.Conn, error) {
+	id, poolConn, err := p.TransportPool.IncomingGet(timeout)
+	if err != nil {
+		return id, poolConn, err
+	}
+	if err := p.verify(poolConn); err != nil {
+		poolConn.Close()
+		p.client.Logger.Error("IncomingGet: pool connection %v rejected: %v", id, err)
+		return id, nil, err
+	}
+	return id, poolConn, nil
+}
+
+func (p *verifiedPool) OutgoingGet(id string, timeout time.Duration) (net.Conn, error) {
+	poolConn, err := p.TransportPool.OutgoingGet(id, timeout)
+	if err != nil {
+		return poolConn, err
+	}
+	if err := p.verify(poolConn); err != nil {
+		poolConn.Close()
+		p.client.Logger.Error("OutgoingGet: pool connection %v rejected: %v", id, err)
+		return nil, err
+	}
+	return poolConn, nil
+}
+
+func (c *Client) poolTLSCode() string {
+	if c.TLSCode != "2" {
+		return c.TLSCode
+	}
+	if c.PeerCAs == nil && c.PeerPin == "" && (c.PeerName == "" || c.PeerName == c.ServerName) {
+		return "2"
+	}
+	c.Logger.Info("Pool certificate check: system roots replaced by ca/name/pin, verified on every pool connection")
+	return "1"
+}
+
 func (c *Client) InitTunnelPool() error {
+	tlsCode := c.poolTLSCode()
+
+	if c.Upstream != nil && c.PoolType == "1" {
+		return fmt.Errorf("InitTunnelPool: upstream proxy does not support QUIC pool")
+	}
+
+	var relayAddr, serverName string
+	if (c.Upstream != nil || c.RouteID != "") && (c.PoolType == "2" || c.PoolType == "3") {
+		addr, err := c.TunnelRelay()
+		if err != nil {
+			return fmt.Errorf("InitTunnelPool: %w", err)
+		}
+		relayAddr = addr
+		if c.PoolType == "2" && tlsCode == "2" {
+			tlsCode = "1"
+			serverName, _, _ = net.SplitHostPort(c.TunnelAddr)
+		}
+	}
+
 	switch c.PoolType {
 	case "0":
 		tcpPool := pool.NewClientPool(
@@ -20,15 +109,9 @@ func (c *Client) InitTunnelPool() error {
 			common.MinPoolInterval,
 			common.MaxPoolInterval,
 			common.ReportInterval,
-			c.TLSCode,
+			tlsCode,
 			c.ServerName,
-			func() (net.Conn, error) {
-				tcpAddr, err := c.GetTunnelTCPAddr()
-				if err != nil {
-					return nil, err
-				}
-				return net.DialTimeout("tcp", tcpAddr.String(), common.TCPDialTimeout)
-			})
+			c.DialPool)
 		go tcpPool.ClientManager()
 		c.TunnelPool = tcpPool
 	case "1":
@@ -38,7 +121,7 @@ func (c *Client) InitTunnelPool() error {
 			common.MinPoolInterval,
 			common.MaxPoolInterval,
 			common.ReportInterval,
-			c.TLSCode,
+			tlsCode,
 			c.ServerName,
 			func() (string, error) {
 				udpAddr, err := c.GetTunnelUDPAddr()
@@ -56,8 +139,8 @@ func (c *Client) InitTunnelPool() error {
 			common.MinPoolInterval,
 			common.MaxPoolInterval,
 			common.ReportInterval,
-			c.TLSCode,
-			c.TunnelAddr)
+			tlsCode,
+			cmp.Or(relayAddr, c.TunnelAddr))
 		go websocketPool.ClientManager()
 		c.TunnelPool = websocketPool
 	case "3":
@@ -67,9 +150,12 @@ func (c *Client) InitTunnelPool() error {
 			common.MinPoolInterval,
 			common.MaxPoolInterval,
 			common.ReportInterval,
-			c.TLSCode,
+			tlsCode,
 			c.ServerName,
 			func() (string, error) {
+				if relayAddr != "" {
+					return relayAddr, nil
+				}
 				tcpAddr, err := c.GetTunnelTCPAddr()
 				if err != nil {
 					return "", err
@@ -81,5 +167,9 @@ func (c *Client) InitTunnelPool() error {
 	default:
 		return fmt.Errorf("InitTunnelPool: unknown pool type: %s", c.PoolType)
 	}
+
+	if c.PeerVerifyEnabled() || serverName != "" {
+		c.TunnelPool = &verifiedPool{TransportPool: c.TunnelPool, client: c, serverName: serverName}
+	}
 	return nil
 }
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/NodePassProject/logs"
+	"github.com/NodePassProject/nodepass/internal/common"
+)
+
+func TestPoolTLSCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		tlsCode string
+		cas     *x509.CertPool
+		peer    string
+		pin     string
+		want    string
+	}{
+		{"plain", "0", nil, "", "", "0"},
+		{"self-signed", "1", nil, "", "pin", "1"},
+		{"system roots", "2", nil, "", "", "2"},
+		{"name matches server name", "2", nil, "tunnel.example.com", "", "2"},
+		{"name differs", "2", nil, "other.example.com", "", "1"},
+		{"private ca", "2", x509.NewCertPool(), "", "", "1"},
+		{"pinned", "2", nil, "", "sha256:00", "1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Client{Common: common.Common{
+				Logger:     logs.NewLogger(logs.None, false),
+				TLSCode:    tt.tlsCode,
+				ServerName: "tunnel.example.com",
+				PeerCAs:    tt.cas,
+				PeerName:   tt.peer,
+				PeerPin:    tt.pin,
+			}}
+			if got := c.poolTLSCode(); got != tt.want {
+				t.Fatalf("poolTLSCode = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
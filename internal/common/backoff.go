@@ -0,0 +1,48 @@
+package common
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+func (c *Common) MarkAttempt() {
+	c.RetryStart.Store(time.Now().UnixNano())
+}
+
+func (c *Common) ResetBackoff() {
+	c.RetryCount.Store(0)
+	c.RetryDelay.Store(0)
+}
+
+func (c *Common) checkStable() {
+	if c.RetryCount.Load() > 0 && time.Since(time.Unix(0, c.RetryStart.Load())) >= BackoffReset {
+		c.ResetBackoff()
+	}
+}
+
+func (c *Common) NextBackoff(base time.Duration) (time.Duration, int32) {
+	c.checkStable()
+	attempt := c.RetryCount.Add(1)
+
+	delay := base
+	for i := int32(1); i < attempt && delay < BackoffMax; i++ {
+		delay *= 2
+	}
+	delay = min(delay, max(BackoffMax, base))
+	if delay > 1 {
+		delay = delay/2 + rand.N(delay/2)
+	}
+
+	c.RetryDelay.Store(int64(delay))
+	return delay, attempt
+}
+
+func (c *Common) BackoffPoint() string {
+	c.checkStable()
+	attempt := c.RetryCount.Load()
+	if attempt == 0 {
+		return ""
+	}
+	return fmt.Sprintf("|RETRY=%v|BACKOFF=%vms", attempt, time.Duration(c.RetryDelay.Load()).Milliseconds())
+}
@@ -0,0 +1,94 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextBackoff(t *testing.T) {
+	saved := BackoffMax
+	t.Cleanup(func() { BackoffMax = saved })
+	BackoffMax = 8 * time.Second
+
+	tests := []struct {
+		name    string
+		base    time.Duration
+		attempt int32
+		want    time.Duration
+	}{
+		{"first attempt", time.Second, 1, time.Second},
+		{"second attempt", time.Second, 2, 2 * time.Second},
+		{"fourth attempt", time.Second, 4, 8 * time.Second},
+		{"capped", time.Second, 10, 8 * time.Second},
+		{"far past cap", time.Second, 200, 8 * time.Second},
+		{"base above cap", 20 * time.Second, 3, 20 * time.Second},
+		{"zero base", 0, 5, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Common{}
+			c.MarkAttempt()
+			for range 50 {
+				c.RetryCount.Store(tt.attempt - 1)
+				delay, attempt := c.NextBackoff(tt.base)
+				if attempt != tt.attempt {
+					t.Fatalf("attempt = %v, want %v", attempt, tt.attempt)
+				}
+				if delay < tt.want/2 || delay > tt.want {
+					t.Fatalf("delay = %v, want within [%v, %v]", delay, tt.want/2, tt.want)
+				}
+				if got := time.Duration(c.RetryDelay.Load()); got != delay {
+					t.Fatalf("RetryDelay = %v, want %v", got, delay)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffReset(t *testing.T) {
+	tests := []struct {
+		name  string
+		since time.Duration
+		want  int32
+		point bool
+	}{
+		{"recent attempt keeps count", 0, 4, true},
+		{"stable run resets count", BackoffReset, 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Common{}
+			c.RetryStart.Store(time.Now().Add(-tt.since).UnixNano())
+			c.RetryCount.Store(3)
+			c.RetryDelay.Store(int64(time.Second))
+
+			if got := c.BackoffPoint() != ""; got != tt.point {
+				t.Fatalf("BackoffPoint set = %v, want %v", got, tt.point)
+			}
+			if _, attempt := c.NextBackoff(time.Second); attempt != tt.want {
+				t.Fatalf("attempt = %v, want %v", attempt, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffPoint(t *testing.T) {
+	c := &Common{}
+	if got := c.BackoffPoint(); got != "" {
+		t.Fatalf("BackoffPoint = %q before any retry, want empty", got)
+	}
+
+	c.MarkAttempt()
+	c.RetryCount.Store(2)
+	c.RetryDelay.Store(int64(1500 * time.Millisecond))
+	if got, want := c.BackoffPoint(), "|RETRY=2|BACKOFF=1500ms"; got != want {
+		t.Fatalf("BackoffPoint = %q, want %q", got, want)
+	}
+
+	c.ResetBackoff()
+	if got := c.BackoffPoint(); got != "" {
+		t.Fatalf("BackoffPoint = %q after reset, want empty", got)
+	}
+}
@@ -0,0 +1,221 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync/atomic"
+
+	"github.com/NodePassProject/conn"
+)
+
+type UDPPacket struct {
+	Buffer []byte
+	Size   int
+	Addr   *net.UDPAddr
+	TX     *uint64
+}
+
+type UDPBatch struct {
+	Conn    *conn.StatConn
+	io      *udpBatchIO
+	packets []UDPPacket
+	queue   chan UDPPacket
+	workers []chan UDPPacket
+	Errors  chan error
+	common  *Common
+}
+
+func (c *Common) NewUDPBatch(statConn *conn.StatConn, handle func(buffer []byte, x int, clientAddr *net.UDPAddr) error) (*UDPBatch, error) {
+	udpConn, ok := statConn.AsUDPConn()
+	if !ok {
+		return nil, fmt.Errorf("NewUDPBatch: not a UDP connection")
+	}
+
+	batch := &UDPBatch{
+		Conn:    statConn,
+		io:      newUDPBatchIO(udpConn),
+		packets: make([]UDPPacket, UDPBatchSize),
+		queue:   make(chan UDPPacket, UDPBatchSize*UDPWorkerCount),
+		workers: make([]chan UDPPacket, UDPWorkerCount),
+		Errors:  make(chan error, 1),
+		common:  c,
+	}
+	for i := range batch.workers {
+		batch.workers[i] = make(chan UDPPacket, UDPBatchSize)
+		go batch.workerLoop(batch.workers[i], handle)
+	}
+
+	go batch.writeLoop()
+	return batch, nil
+}
+
+func (b *UDPBatch) View(statConn *conn.StatConn) *UDPBatch {
+	view := *b
+	view.Conn = statConn
+	return &view
+}
+
+func (b *UDPBatch) Dispatch() error {
+	c := b.common
+	for i := range b.packets {
+		if b.packets[i].Buffer == nil {
+			b.packets[i].Buffer = c.GetUDPBuffer()
+		}
+	}
+
+	n, err := b.read(b.packets)
+	if err != nil {
+		if c.Ctx.Err() != nil {
+			b.release()
+		}
+		return err
+	}
+
+	for i := range n {
+		select {
+		case b.workers[shardOf(b.packets[i].Addr, len(b.workers))] <- b.packets[i]:
+			b.packets[i].Buffer = nil
+		default:
+			atomic.AddUint64(&c.UDPDrop, 1)
+			c.Logger.Debug("UDPBatch: worker queue full, packet from %v dropped", b.packets[i].Addr)
+		}
+	}
+	return nil
+}
+
+func (b *UDPBatch) release() {
+	c := b.common
+	for i := range b.packets {
+		c.PutUDPBuffer(b.packets[i].Buffer)
+		b.packets[i].Buffer = nil
+	}
+}
+
+func (b *UDPBatch) drain(queue chan UDPPacket) {
+	c := b.common
+	for {
+		select {
+		case packet := <-queue:
+			c.PutUDPBuffer(packet.Buffer)
+		default:
+			return
+		}
+	}
+}
+
+func (b *UDPBatch) workerLoop(worker chan UDPPacket, handle func(buffer []byte, x int, clientAddr *net.UDPAddr) error) {
+	c := b.common
+	for {
+		select {
+		case <-c.Ctx.Done():
+			b.drain(worker)
+			return
+		case packet := <-worker:
+			if err := handle(packet.Buffer, packet.Size, packet.Addr); err != nil {
+				select {
+				case b.Errors <- err:
+				default:
+				}
+			}
+		}
+	}
+}
+
+func (b *UDPBatch) read(packets []UDPPacket) (int, error) {
+	n, err := b.io.read(packets)
+	for i := range n {
+		atomic.AddUint64(b.Conn.RX, uint64(packets[i].Size))
+		if b.Conn.Rate != nil {
+			b.Conn.Rate.WaitRead(int64(packets[i].Size))
+		}
+	}
+	return n, err
+}
+
+func (b *UDPBatch) WriteToUDP(data []byte, addr *net.UDPAddr) (int, error) {
+	c := b.common
+	if len(data) > UDPDataBufSize {
+		return b.Conn.WriteToUDP(data, addr)
+	}
+
+	buffer := c.GetUDPBuffer()
+	x := copy(buffer, data)
+
+	select {
+	case b.queue <- UDPPacket{Buffer: buffer, Size: x, Addr: addr, TX: b.Conn.TX}:
+		return x, nil
+	case <-c.Ctx.Done():
+		c.PutUDPBuffer(buffer)
+		return 0, net.ErrClosed
+	}
+}
+
+func (b *UDPBatch) writeLoop() {
+	c := b.common
+	packets := make([]UDPPacket, 0, UDPBatchSize)
+
+	for {
+		select {
+		case <-c.Ctx.Done():
+			b.drain(b.queue)
+			return
+		case packet := <-b.queue:
+			packets = append(packets[:0], packet)
+		}
+
+	collect:
+		for len(packets) < UDPBatchSize {
+			select {
+			case packet := <-b.queue:
+				packets = append(packets, packet)
+			default:
+				break collect
+			}
+		}
+
+		for _, packet := range packets {
+			if b.Conn.Rate != nil {
+				b.Conn.Rate.WaitWrite(int64(packet.Size))
+			}
+		}
+
+		b.writeBatch(packets)
+		for _, packet := range packets {
+			c.PutUDPBuffer(packet.Buffer)
+		}
+	}
+}
+
+func (b *UDPBatch) writeBatch(packets []UDPPacket) {
+	c := b.common
+	for len(packets) > 0 {
+		sent, err := b.io.write(packets)
+		for _, packet := range packets[:sent] {
+			atomic.AddUint64(packet.TX, uint64(packet.Size))
+		}
+		packets = packets[sent:]
+		if len(packets) == 0 {
+			return
+		}
+		if err == nil || errors.Is(err, net.ErrClosed) || c.Ctx.Err() != nil {
+			atomic.AddUint64(&c.UDPDrop, uint64(len(packets)))
+			return
+		}
+
+		atomic.AddUint64(&c.UDPDrop, 1)
+		c.Logger.Warn("UDPBatch: write to %v failed, packet dropped: %v", packets[0].Addr, err)
+		packets = packets[1:]
+	}
+}
+
+func shardOf(addr *net.UDPAddr, shards int) int {
+	if addr == nil || shards <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write(addr.IP)
+	h.Write([]byte{byte(addr.Port >> 8), byte(addr.Port)})
+	return int(h.Sum32() % uint32(shards))
+}
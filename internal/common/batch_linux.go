@@ -0,0 +1,74 @@
+//go:build linux
+
+package common
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+type batchPacketConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+type udpBatchIO struct {
+	conn  batchPacketConn
+	rmsgs []ipv4.Message
+	wmsgs []ipv4.Message
+}
+
+func newUDPBatchIO(udpConn *net.UDPConn) *udpBatchIO {
+	var packetConn batchPacketConn = ipv4.NewPacketConn(udpConn)
+	if addr, ok := udpConn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		packetConn = ipv6.NewPacketConn(udpConn)
+	}
+
+	b := &udpBatchIO{
+		conn:  packetConn,
+		rmsgs: make([]ipv4.Message, UDPBatchSize),
+		wmsgs: make([]ipv4.Message, UDPBatchSize),
+	}
+	for i := range b.rmsgs {
+		b.rmsgs[i].Buffers = make([][]byte, 1)
+		b.wmsgs[i].Buffers = make([][]byte, 1)
+	}
+	return b
+}
+
+func (b *udpBatchIO) read(packets []UDPPacket) (int, error) {
+	msgs := b.rmsgs[:len(packets)]
+	for i := range msgs {
+		msgs[i].Buffers[0] = packets[i].Buffer
+	}
+
+	n, err := b.conn.ReadBatch(msgs, 0)
+	for i := range n {
+		packets[i].Size = msgs[i].N
+		packets[i].Addr, _ = msgs[i].Addr.(*net.UDPAddr)
+	}
+	return n, err
+}
+
+func (b *udpBatchIO) write(packets []UDPPacket) (int, error) {
+	msgs := b.wmsgs[:len(packets)]
+	for i := range msgs {
+		msgs[i].Buffers[0] = packets[i].Buffer[:packets[i].Size]
+		msgs[i].Addr = packets[i].Addr
+	}
+
+	sent := 0
+	for sent < len(msgs) {
+		n, err := b.conn.WriteBatch(msgs[sent:], 0)
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	return sent, nil
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+
+package common
+
+import "net"
+
+type udpBatchIO struct {
+	conn *net.UDPConn
+}
+
+func newUDPBatchIO(udpConn *net.UDPConn) *udpBatchIO {
+	return &udpBatchIO{conn: udpConn}
+}
+
+func (b *udpBatchIO) read(packets []UDPPacket) (int, error) {
+	x, addr, err := b.conn.ReadFromUDP(packets[0].Buffer)
+	if err != nil {
+		return 0, err
+	}
+	packets[0].Size = x
+	packets[0].Addr = addr
+	return 1, nil
+}
+
+func (b *udpBatchIO) write(packets []UDPPacket) (int, error) {
+	for i, packet := range packets {
+		if _, err := b.conn.WriteToUDP(packet.Buffer[:packet.Size], packet.Addr); err != nil {
+			return i, err
+		}
+	}
+	return len(packets), nil
+}
@@ -0,0 +1,163 @@
+package common
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NodePassProject/conn"
+)
+
+func listenTestUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { udpConn.Close() })
+	return udpConn
+}
+
+func TestShardOf(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5353}
+
+	tests := []struct {
+		name   string
+		addr   *net.UDPAddr
+		shards int
+	}{
+		{"nil address", nil, 8},
+		{"single shard", addr, 1},
+		{"zero shards", addr, 0},
+		{"many shards", addr, 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := shardOf(tt.addr, tt.shards)
+			if got < 0 || (tt.shards > 1 && got >= tt.shards) || (tt.shards <= 1 && got != 0) {
+				t.Fatalf("shardOf = %v, out of range for %v shards", got, tt.shards)
+			}
+			if again := shardOf(tt.addr, tt.shards); again != got {
+				t.Fatalf("shardOf not stable: %v then %v", got, again)
+			}
+		})
+	}
+}
+
+func TestUDPBatchWriteToUDP(t *testing.T) {
+	c := newTestCommon(t)
+	local := listenTestUDP(t)
+	peer := listenTestUDP(t)
+
+	var rx, tx uint64
+	batch, err := c.NewUDPBatch(&conn.StatConn{Conn: local, RX: &rx, TX: &tx}, func(buffer []byte, x int, clientAddr *net.UDPAddr) error {
+		c.PutUDPBuffer(buffer)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("NewUDPBatch: %v", err)
+	}
+
+	if _, err := batch.WriteToUDP([]byte("hello"), peer.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatalf("WriteToUDP: %v", err)
+	}
+
+	buffer := make([]byte, 64)
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := peer.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(buffer[:n]) != "hello" {
+		t.Fatalf("got %q, want %q", buffer[:n], "hello")
+	}
+}
+
+func TestUDPBatchViewCountsOwnWrites(t *testing.T) {
+	c := newTestCommon(t)
+	local := listenTestUDP(t)
+	peer := listenTestUDP(t)
+
+	var rx, tx, viewRX, viewTX uint64
+	statConn := &conn.StatConn{Conn: local, RX: &rx, TX: &tx}
+	batch, err := c.NewUDPBatch(statConn, func(buffer []byte, x int, clientAddr *net.UDPAddr) error {
+		c.PutUDPBuffer(buffer)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("NewUDPBatch: %v", err)
+	}
+	view := batch.View(&conn.StatConn{Conn: local, RX: &viewRX, TX: &viewTX})
+
+	addr := peer.LocalAddr().(*net.UDPAddr)
+	if _, err := batch.WriteToUDP([]byte("parent"), addr); err != nil {
+		t.Fatalf("WriteToUDP: %v", err)
+	}
+	if _, err := view.WriteToUDP([]byte("view"), addr); err != nil {
+		t.Fatalf("WriteToUDP: %v", err)
+	}
+
+	buffer := make([]byte, 64)
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for range 2 {
+		if _, _, err := peer.ReadFromUDP(buffer); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for (atomic.LoadUint64(&tx) != 6 || atomic.LoadUint64(&viewTX) != 4) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, want := atomic.LoadUint64(&tx), uint64(len("parent")); got != want {
+		t.Fatalf("parent TX = %v, want %v", got, want)
+	}
+	if got, want := atomic.LoadUint64(&viewTX), uint64(len("view")); got != want {
+		t.Fatalf("view TX = %v, want %v", got, want)
+	}
+}
+
+func TestUDPBatchDispatchDropsOnFullWorker(t *testing.T) {
+	c := newTestCommon(t)
+	local := listenTestUDP(t)
+	sender := listenTestUDP(t)
+
+	block := make(chan struct{})
+	t.Cleanup(func() { close(block) })
+
+	var rx, tx uint64
+	batch, err := c.NewUDPBatch(&conn.StatConn{Conn: local, RX: &rx, TX: &tx}, func(buffer []byte, x int, clientAddr *net.UDPAddr) error {
+		<-block
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("NewUDPBatch: %v", err)
+	}
+
+	packets := uint64(UDPBatchSize * 3)
+	for range packets {
+		if _, err := sender.WriteToUDP([]byte("x"), local.LocalAddr().(*net.UDPAddr)); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for atomic.LoadUint64(&rx) < packets {
+			if err := batch.Dispatch(); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Dispatch blocked on a stalled worker")
+	}
+	if atomic.LoadUint64(&c.UDPDrop) == 0 {
+		t.Fatal("expected dropped packets to be counted")
+	}
+}
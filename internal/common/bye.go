@@ -0,0 +1,94 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	ByeStop    = "stop"
+	ByeRestart = "restart"
+	ByeConfig  = "config"
+	ByeAuth    = "auth"
+)
+
+var ErrPeerBye = errors.New("peer said goodbye")
+
+func IsPlannedBye(reason string) bool {
+	return reason == ByeRestart || reason == ByeConfig
+}
+
+func ByeCooldown(reason string) time.Duration {
+	switch reason {
+	case ByeRestart, ByeConfig:
+		return min(ByeRestartCooldown, ServiceCooldown)
+	case ByeAuth:
+		return max(ByeAuthCooldown, ServiceCooldown)
+	default:
+		return ServiceCooldown
+	}
+}
+
+func (c *Common) RestartCooldown(err error) (time.Duration, bool) {
+	if !errors.Is(err, ErrPeerBye) {
+		return ServiceCooldown, false
+	}
+	return ByeCooldown(c.PeerBye), IsPlannedBye(c.PeerBye)
+}
+
+func (c *Common) ShutdownContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.ByeReason = ByeStop
+
+	reasons := map[os.Signal]string{os.Interrupt: ByeStop, syscall.SIGTERM: ByeStop}
+	if RestartSignal != nil {
+		reasons[RestartSignal] = ByeRestart
+	}
+	if ConfigSignal != nil {
+		reasons[ConfigSignal] = ByeConfig
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	for sig := range reasons {
+		signal.Notify(sigChan, sig)
+	}
+
+	go func() {
+		defer signal.Stop(sigChan)
+		select {
+		case <-ctx.Done():
+		case sig := <-sigChan:
+			c.ByeReason = reasons[sig]
+			cancel()
+		}
+	}()
+	return ctx, cancel
+}
+
+func (c *Common) SendBye(reason string) {
+	_, controlConn := c.controlReader()
+	if controlConn == nil || !c.HasCapability("bye") {
+		return
+	}
+
+	signalData, _ := json.Marshal(Signal{ActionType: "bye", Reason: reason})
+	data, err := c.Encode(signalData)
+	if err != nil {
+		c.Logger.Debug("SendBye: %v", err)
+		return
+	}
+
+	c.WriteLock.Lock()
+	defer c.WriteLock.Unlock()
+	controlConn.SetWriteDeadline(time.Now().Add(ByeWriteTimeout))
+	if _, err := controlConn.Write(data); err != nil {
+		c.Logger.Debug("SendBye: write failed: %v", err)
+		return
+	}
+	c.Logger.Debug("Goodbye signal sent: reason=%v", reason)
+}
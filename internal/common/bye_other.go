@@ -0,0 +1,13 @@
+//go:build !windows
+
+package common
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	RestartSignal os.Signal = syscall.SIGHUP
+	ConfigSignal  os.Signal = syscall.SIGUSR2
+)
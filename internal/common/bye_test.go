@@ -0,0 +1,65 @@
+package common
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSendByeCooldown(t *testing.T) {
+	saved := ServiceCooldown
+	t.Cleanup(func() { ServiceCooldown = saved })
+	ServiceCooldown = 3 * time.Second
+
+	tests := []struct {
+		name     string
+		reason   string
+		cooldown time.Duration
+		planned  bool
+	}{
+		{"restart", ByeRestart, ByeRestartCooldown, true},
+		{"config", ByeConfig, ByeRestartCooldown, true},
+		{"auth", ByeAuth, ByeAuthCooldown, false},
+		{"stop", ByeStop, 3 * time.Second, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverState, clientState := tlsStatePair(t)
+			server, client := newCipherPair(t, serverState, clientState, "key", "key")
+			server.Capabilities = []string{"bye"}
+			serverConn, clientConn := net.Pipe()
+			t.Cleanup(func() {
+				serverConn.Close()
+				clientConn.Close()
+			})
+			server.ControlConn = serverConn
+			client.ControlConn = clientConn
+			client.BufReader = bufio.NewReader(clientConn)
+
+			errs := make(chan error, 1)
+			go func() { errs <- client.CommonQueue() }()
+			server.SendBye(tt.reason)
+
+			var err error
+			select {
+			case err = <-errs:
+			case <-time.After(2 * time.Second):
+				t.Fatal("goodbye signal not received")
+			}
+			if !errors.Is(err, ErrPeerBye) || client.PeerBye != tt.reason {
+				t.Fatalf("CommonQueue = %v, reason %q, want %q", err, client.PeerBye, tt.reason)
+			}
+
+			cooldown, planned := client.RestartCooldown(err)
+			if cooldown != tt.cooldown || planned != tt.planned {
+				t.Fatalf("RestartCooldown = %v, %v, want %v, %v", cooldown, planned, tt.cooldown, tt.planned)
+			}
+			if cooldown, planned := client.RestartCooldown(errors.New("control lost")); cooldown != ServiceCooldown || planned {
+				t.Fatalf("RestartCooldown without goodbye = %v, %v, want %v, false", cooldown, planned, ServiceCooldown)
+			}
+		})
+	}
+}
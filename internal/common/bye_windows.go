@@ -0,0 +1,10 @@
+//go:build windows
+
+package common
+
+import "os"
+
+var (
+	RestartSignal os.Signal
+	ConfigSignal  os.Signal
+)
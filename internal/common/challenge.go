@@ -0,0 +1,55 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+type ChallengeStore struct {
+	mu     sync.Mutex
+	issued map[string]time.Time
+	order  []challengeEntry
+}
+
+type challengeEntry struct {
+	nonce string
+	at    time.Time
+}
+
+func NewChallengeStore() *ChallengeStore {
+	return &ChallengeStore{issued: make(map[string]time.Time)}
+}
+
+func (s *ChallengeStore) Issue() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.expire(now)
+	if len(s.order) >= ChallengeLimit {
+		return "", false
+	}
+
+	nonce := NewControlNonce()
+	s.issued[nonce] = now
+	s.order = append(s.order, challengeEntry{nonce: nonce, at: now})
+	return nonce, true
+}
+
+func (s *ChallengeStore) Take(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	issued, ok := s.issued[nonce]
+	delete(s.issued, nonce)
+	return ok && time.Since(issued) <= HandshakeTimeout
+}
+
+func (s *ChallengeStore) expire(now time.Time) {
+	i := 0
+	for i < len(s.order) && now.Sub(s.order[i].at) > HandshakeTimeout {
+		delete(s.issued, s.order[i].nonce)
+		i++
+	}
+	s.order = s.order[i:]
+}
@@ -0,0 +1,96 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChallengeStoreTake(t *testing.T) {
+	tests := []struct {
+		name  string
+		age   time.Duration
+		nonce func(issued string) string
+		want  bool
+	}{
+		{"fresh", 0, func(n string) string { return n }, true},
+		{"unknown", 0, func(string) string { return NewControlNonce() }, false},
+		{"empty", 0, func(string) string { return "" }, false},
+		{"at expiry", HandshakeTimeout - time.Second, func(n string) string { return n }, true},
+		{"expired", HandshakeTimeout + time.Second, func(n string) string { return n }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewChallengeStore()
+			nonce, ok := s.Issue()
+			if !ok {
+				t.Fatal("Issue refused on an empty store")
+			}
+			s.issued[nonce] = s.issued[nonce].Add(-tt.age)
+			presented := tt.nonce(nonce)
+			if got := s.Take(presented); got != tt.want {
+				t.Fatalf("Take = %v, want %v", got, tt.want)
+			}
+			if s.Take(presented) {
+				t.Fatal("challenge accepted twice")
+			}
+		})
+	}
+}
+
+func TestChallengeStoreLimit(t *testing.T) {
+	s := NewChallengeStore()
+	for range ChallengeLimit {
+		if _, ok := s.Issue(); !ok {
+			t.Fatal("Issue refused below the limit")
+		}
+	}
+	if _, ok := s.Issue(); ok {
+		t.Fatal("Issue accepted past the limit")
+	}
+
+	for i := range s.order[:ChallengeLimit/2] {
+		s.order[i].at = s.order[i].at.Add(-2 * HandshakeTimeout)
+	}
+	if _, ok := s.Issue(); !ok {
+		t.Fatal("Issue refused after half the challenges expired")
+	}
+	if got, want := len(s.order), ChallengeLimit/2+1; got != want {
+		t.Fatalf("outstanding challenges = %v, want %v", got, want)
+	}
+	if len(s.issued) != len(s.order) {
+		t.Fatalf("map holds %v entries, queue %v", len(s.issued), len(s.order))
+	}
+}
+
+func TestVerifyAuthKey(t *testing.T) {
+	now := time.Now().Unix()
+	skew := int64(AuthClockSkew / time.Second)
+	token := func(key, role string, ts int64) string { return AuthToken(key, role, "cn", "sn", ts) }
+
+	tests := []struct {
+		name  string
+		token string
+		role  string
+		ts    int64
+		want  bool
+	}{
+		{"valid", token("key", "client", now), "client", now, true},
+		{"skew inside past", token("key", "client", now-skew+1), "client", now - skew + 1, true},
+		{"skew inside future", token("key", "client", now+skew-1), "client", now + skew - 1, true},
+		{"skew past", token("key", "client", now-skew-2), "client", now - skew - 2, false},
+		{"skew future", token("key", "client", now+skew+2), "client", now + skew + 2, false},
+		{"wrong key", token("other", "client", now), "client", now, false},
+		{"wrong role", token("key", "server", now), "client", now, false},
+		{"timestamp swapped", token("key", "client", now), "client", now - 1, false},
+		{"empty token", "", "client", now, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyAuthKey("key", tt.token, tt.role, "cn", "sn", tt.ts); got != tt.want {
+				t.Fatalf("VerifyAuthKey = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,15 +3,21 @@ package common
 import (
 	"bufio"
 	"context"
+	"crypto/cipher"
 	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"net"
 	"net/url"
+	"os"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/NodePassProject/conn"
 	"github.com/NodePassProject/logs"
+	"github.com/quic-go/quic-go"
 )
 
 const (
@@ -31,13 +37,59 @@ const (
 	DefaultBlockProtocol = "0"
 	DefaultTCPStrategy   = "0"
 	DefaultUDPStrategy   = "0"
+	DefaultDatagramPort  = "0"
+	DatagramALPN         = "np-dgram"
+	DatagramHeaderSize   = 4
+	DatagramQueueSize    = 256
+	DefaultUDPMux        = 0
+	DefaultUDPLimit      = 0
+	DefaultUDPLife       = 0 * time.Second
+	DefaultTCPIdle       = 0 * time.Second
+	DefaultTCPLife       = 0 * time.Second
+	DefaultTCPMaxBytes   = 0
+	MuxHeaderSize        = 4
+	MuxOpenLength        = 0xFFFF
+	MuxQueueSize         = 64
+	ControlNonceSize     = 16
+	ControlReplayWindow  = 4096
+	ControlExporterLabel = "EXPORTER-nodepass-control"
+	AuthClockSkew        = 30 * time.Second
+	ChallengeLimit       = 4096
+	DefaultInsecure      = "0"
+	IdentityCrtName      = "identity.crt"
+	IdentityKeyName      = "identity.key"
+	TrustFileName        = "known_servers"
+	KeyFileName          = "tunnel_keys"
+	DefaultClientLimit   = 0
+	DefaultFailoverMode  = "0"
+	ProtocolVersion      = 1
+	MinProtocolVersion   = 1
+	ClientQueueSize      = 4096
+	RouteMagic           = "NPRT"
+	RouteIDSize          = 8
+	HandshakeALPN        = "http/1.1"
+	MaxHelloSize         = 16384 + 5
+	PeekTimeout          = 200 * time.Millisecond
+	PeekRetryInterval    = 10 * time.Millisecond
+	ByeWriteTimeout      = 1 * time.Second
+	ByeRestartCooldown   = 1 * time.Second
+	ByeAuthCooldown      = 30 * time.Second
 )
 
 var (
 	SemaphoreLimit   = GetEnvAsInt("NP_SEMAPHORE_LIMIT", 65536)
 	TCPDataBufSize   = GetEnvAsInt("NP_TCP_DATA_BUF_SIZE", 16384)
 	UDPDataBufSize   = GetEnvAsInt("NP_UDP_DATA_BUF_SIZE", 16384)
+	UDPBatchSize     = GetEnvAsInt("NP_UDP_BATCH_SIZE", 64)
+	UDPWorkerCount   = GetEnvAsInt("NP_UDP_WORKER_COUNT", runtime.NumCPU())
 	HandshakeTimeout = GetEnvAsDuration("NP_HANDSHAKE_TIMEOUT", 5*time.Second)
+	HoldTimeout      = GetEnvAsDuration("NP_HOLD_TIMEOUT", 10*time.Second)
+	HoldQueueSize    = GetEnvAsInt("NP_HOLD_QUEUE_SIZE", 1024)
+	DrainTimeout     = GetEnvAsDuration("NP_DRAIN_TIMEOUT", 1*time.Minute)
+	AuthMaxFails     = GetEnvAsInt("NP_AUTH_MAX_FAILS", 5)
+	AuthBanTime      = GetEnvAsDuration("NP_AUTH_BAN_TIME", 10*time.Minute)
+	AuthRateLimit    = GetEnvAsInt("NP_AUTH_RATE_LIMIT", 50)
+	ConnectRateLimit = GetEnvAsInt("NP_CONNECT_RATE_LIMIT", 10)
 	TCPDialTimeout   = GetEnvAsDuration("NP_TCP_DIAL_TIMEOUT", 5*time.Second)
 	UDPDialTimeout   = GetEnvAsDuration("NP_UDP_DIAL_TIMEOUT", 5*time.Second)
 	UDPReadTimeout   = GetEnvAsDuration("NP_UDP_READ_TIMEOUT", 30*time.Second)
@@ -47,8 +99,11 @@ var (
 	ReportInterval   = GetEnvAsDuration("NP_REPORT_INTERVAL", 5*time.Second)
 	FallbackInterval = GetEnvAsDuration("NP_FALLBACK_INTERVAL", 5*time.Minute)
 	ServiceCooldown  = GetEnvAsDuration("NP_SERVICE_COOLDOWN", 3*time.Second)
+	BackoffMax       = GetEnvAsDuration("NP_BACKOFF_MAX", 1*time.Minute)
+	BackoffReset     = GetEnvAsDuration("NP_BACKOFF_RESET", 1*time.Minute)
 	ShutdownTimeout  = GetEnvAsDuration("NP_SHUTDOWN_TIMEOUT", 5*time.Second)
 	ReloadInterval   = GetEnvAsDuration("NP_RELOAD_INTERVAL", 1*time.Hour)
+	RekeyDir         = os.Getenv("NP_REKEY_DIR")
 )
 
 type Common struct {
@@ -58,6 +113,16 @@ type Common struct {
 	TCPTX            uint64
 	UDPRX            uint64
 	UDPTX            uint64
+	UDPEvictIdle     uint64
+	UDPEvictLife     uint64
+	UDPEvictError    uint64
+	UDPDrop          uint64
+	TCPEndIdle       uint64
+	TCPEndLife       uint64
+	TCPEndBytes      uint64
+	MuxIdx           uint64
+	ControlSendSeq   uint64
+	ClientIdx        uint64
 	ParsedURL        *url.URL
 	Logger           *logs.Logger
 	DNSCacheTTL      time.Duration
@@ -69,12 +134,27 @@ type Common struct {
 	PoolType         string
 	DataFlow         string
 	ServerName       string
+	PeerCAs          *x509.CertPool
+	PeerName         string
+	PeerPin          string
+	ClientCert       *tls.Certificate
+	StateDir         string
+	TrustPending     bool
 	ServerPort       string
 	ClientIP         string
+	RouteID          string
 	DialerIP         string
 	DialerIPv6       bool
 	TunnelKey        string
+	SessionKey       string
+	KeyLock          sync.RWMutex
+	Insecure         string
 	TunnelAddr       string
+	TunnelAddrs      []string
+	TunnelIdx        int
+	FailoverMode     string
+	FailoverTries    int
+	Capabilities     []string
 	TunnelTCPAddr    *net.TCPAddr
 	TunnelUDPAddr    *net.UDPAddr
 	TargetAddrs      []string
@@ -82,12 +162,29 @@ type Common struct {
 	TargetUDPAddrs   []*net.UDPAddr
 	BestLatency      int32
 	LBStrategy       string
-	TargetListener   *net.TCPListener
+	TargetListener   net.Listener
 	TunnelListener   net.Listener
+	TargetHold       *HoldListener
+	TunnelHold       *HoldListener
+	TargetUDPHold    *net.UDPConn
+	TunnelUDPHold    *net.UDPConn
 	ControlConn      net.Conn
+	ControlLock      sync.Mutex
+	WriteLock        sync.Mutex
+	StandbyConn      net.Conn
 	TunnelUDPConn    *conn.StatConn
 	TargetUDPConn    *conn.StatConn
 	TargetUDPSession sync.Map
+	TunnelUDPBatch   *UDPBatch
+	TargetUDPBatch   *UDPBatch
+	DatagramPort     string
+	DatagramListener *quic.Listener
+	DatagramConn     atomic.Pointer[quic.Conn]
+	DatagramSessions sync.Map
+	UDPMux           int
+	MuxLock          sync.Mutex
+	MuxChannels      []*MuxChannel
+	MuxSessions      sync.Map
 	TunnelPool       TransportPool
 	MinPoolCapacity  int
 	MaxPoolCapacity  int
@@ -99,9 +196,17 @@ type Common struct {
 	DisableTCP       string
 	DisableUDP       string
 	RateLimit        int
-	RateLimiter      *conn.RateLimiter
+	RateLimiter      atomic.Pointer[conn.RateLimiter]
 	ReadTimeout      time.Duration
+	UDPIdleTimeout   time.Duration
+	UDPLifeTimeout   time.Duration
+	TCPIdleTimeout   time.Duration
+	TCPLifeTimeout   time.Duration
+	TCPMaxBytes      uint64
 	BufReader        *bufio.Reader
+	ControlSealer    cipher.AEAD
+	ControlOpener    cipher.AEAD
+	ControlReplay    *ReplayWindow
 	TCPBufferPool    *sync.Pool
 	UDPBufferPool    *sync.Pool
 	SignalChan       chan Signal
@@ -112,6 +217,35 @@ type Common struct {
 	SlotLimit        int32
 	TCPSlot          int32
 	UDPSlot          int32
+	ActiveSlot       int32
+	UDPLimit         int32
+	LastPing         int64
+	Parent           *Common
+	ClientLimit      int32
+	ClientCount      int32
+	ClientMux        *ClientMux
+	Clients          sync.Map
+	TenantName       string
+	TenantFile       string
+	Tenants          sync.Map
+	AuthGuard        *AuthGuard
+	Decoy            string
+	ConnectACL       []ConnectRule
+	Upstream         *url.URL
+	KeyFile          string
+	KeyTime          time.Time
+	Keys             atomic.Pointer[TunnelKeys]
+	PolicyFile       string
+	PolicyTime       time.Time
+	Policy           atomic.Pointer[Policy]
+	PolicyLimits     atomic.Pointer[Limits]
+	DrainStart       atomic.Int64
+	RetryStart       atomic.Int64
+	RetryCount       atomic.Int32
+	RetryDelay       atomic.Int64
+	PreferredSwitch  atomic.Bool
+	ByeReason        string
+	PeerBye          string
 	Ctx              context.Context
 	Cancel           context.CancelFunc
 }
@@ -146,8 +280,11 @@ type TransportPool interface {
 }
 
 type Signal struct {
-	ActionType  string `json:"action"`
-	RemoteAddr  string `json:"remote,omitempty"`
-	PoolConnID  string `json:"id,omitempty"`
-	Fingerprint string `json:"fp,omitempty"`
+	ActionType  string  `json:"action"`
+	RemoteAddr  string  `json:"remote,omitempty"`
+	PoolConnID  string  `json:"id,omitempty"`
+	Fingerprint string  `json:"fp,omitempty"`
+	Policy      *Policy `json:"policy,omitempty"`
+	Reason      string  `json:"reason,omitempty"`
+	Key         string  `json:"key,omitempty"`
 }
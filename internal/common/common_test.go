@@ -0,0 +1,44 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NodePassProject/logs"
+)
+
+func newTestCommon(t *testing.T) *Common {
+	t.Helper()
+	c := &Common{
+		Logger: logs.NewLogger(logs.None, false),
+		TCPBufferPool: &sync.Pool{
+			New: func() any {
+				buf := make([]byte, TCPDataBufSize)
+				return &buf
+			},
+		},
+		UDPBufferPool: &sync.Pool{
+			New: func() any {
+				buf := make([]byte, UDPDataBufSize)
+				return &buf
+			},
+		},
+	}
+	c.SignalChan = make(chan Signal, ClientQueueSize)
+	c.Ctx, c.Cancel = context.WithCancel(context.Background())
+	t.Cleanup(c.Cancel)
+	return c
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
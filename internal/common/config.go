@@ -1,37 +1,40 @@
 package common
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"fmt"
 	"hash/fnv"
+	"math/rand/v2"
 	"net"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 )
 
 func (c *Common) GetAddress() error {
-	tunnelAddr := c.ParsedURL.Host
-	if tunnelAddr == "" {
-		return fmt.Errorf("GetAddress: no valid tunnel address found")
+	c.TunnelAddrs = c.TunnelAddrs[:0]
+	for addr := range strings.SplitSeq(c.ParsedURL.Host, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			c.TunnelAddrs = append(c.TunnelAddrs, addr)
+		}
 	}
-
-	c.TunnelAddr = tunnelAddr
-	if name, port, err := net.SplitHostPort(tunnelAddr); err == nil {
-		c.ServerName, c.ServerPort = name, port
+	if len(c.TunnelAddrs) == 0 {
+		return fmt.Errorf("GetAddress: no valid tunnel address found")
 	}
-
-	tcpAddr, err := c.ResolveAddr("tcp", tunnelAddr)
-	if err != nil {
-		return fmt.Errorf("GetAddress: resolveTCPAddr failed: %w", err)
+	if len(c.TunnelAddrs) > 1 && c.ParsedURL.Scheme != "client" {
+		return fmt.Errorf("GetAddress: multiple tunnel addresses are only supported by clients")
 	}
-	c.TunnelTCPAddr = tcpAddr.(*net.TCPAddr)
 
-	udpAddr, err := c.ResolveAddr("udp", tunnelAddr)
+	tunnelTCPAddr, tunnelUDPAddr, err := c.resolveTunnelAddr(c.TunnelAddrs[0])
 	if err != nil {
-		return fmt.Errorf("GetAddress: resolveUDPAddr failed: %w", err)
+		return fmt.Errorf("GetAddress: %w", err)
 	}
-	c.TunnelUDPAddr = udpAddr.(*net.UDPAddr)
+	c.setTunnelAddr(c.TunnelAddrs[0], tunnelTCPAddr, tunnelUDPAddr)
+	c.TunnelIdx = 0
 
 	targetAddr := strings.TrimPrefix(c.ParsedURL.Path, "/")
 	if targetAddr == "" {
@@ -83,17 +86,78 @@ func (c *Common) GetAddress() error {
 	return nil
 }
 
+func (c *Common) resolveTunnelAddr(tunnelAddr string) (*net.TCPAddr, *net.UDPAddr, error) {
+	tcpAddr, err := c.ResolveAddr("tcp", tunnelAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("resolveTCPAddr failed: %w", err)
+	}
+
+	udpAddr, err := c.ResolveAddr("udp", tunnelAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("resolveUDPAddr failed: %w", err)
+	}
+	return tcpAddr.(*net.TCPAddr), udpAddr.(*net.UDPAddr), nil
+}
+
+func (c *Common) setTunnelAddr(tunnelAddr string, tcpAddr *net.TCPAddr, udpAddr *net.UDPAddr) {
+	c.TunnelAddr = tunnelAddr
+	if name, port, err := net.SplitHostPort(tunnelAddr); err == nil {
+		c.ServerName, c.ServerPort = name, port
+	}
+	c.TunnelTCPAddr = tcpAddr
+	c.TunnelUDPAddr = udpAddr
+}
+
 func (c *Common) GetCoreType() {
 	c.CoreType = c.ParsedURL.Scheme
 }
 
 func (c *Common) GetTunnelKey() {
-	if key := c.ParsedURL.User.Username(); key != "" {
+	c.KeyLock.Lock()
+	defer c.KeyLock.Unlock()
+	c.TunnelKey = c.baseTunnelKey()
+}
+
+func (c *Common) baseTunnelKey() string {
+	return BaseTunnelKey(c.ParsedURL)
+}
+
+func BaseTunnelKey(parsedURL *url.URL) string {
+	if key := parsedURL.User.Username(); key != "" {
+		return key
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(parsedURL.Port()))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (c *Common) GetRotatedKey() error {
+	c.GetTunnelKey()
+	if c.StateDir == "" || c.CoreType != "client" {
+		return nil
+	}
+
+	key, err := LoadRotatedKey(c.StateDir, c.TunnelAddr, c.baseTunnelKey())
+	if err != nil {
+		return fmt.Errorf("GetRotatedKey: %w", err)
+	}
+	if key != "" {
+		c.KeyLock.Lock()
 		c.TunnelKey = key
+		c.KeyLock.Unlock()
+	}
+	return nil
+}
+
+func (c *Common) GetKeyFile() {
+	c.KeyFile = c.ParsedURL.Query().Get("keys")
+}
+
+func (c *Common) GetInsecure() {
+	if insecure := c.ParsedURL.Query().Get("insecure"); insecure != "" {
+		c.Insecure = insecure
 	} else {
-		hash := fnv.New32a()
-		hash.Write([]byte(c.ParsedURL.Port()))
-		c.TunnelKey = hex.EncodeToString(hash.Sum(nil))
+		c.Insecure = DefaultInsecure
 	}
 }
 
@@ -117,6 +181,70 @@ func (c *Common) GetServerName() {
 	}
 }
 
+func (c *Common) GetPeerVerify() error {
+	if caFile := c.ParsedURL.Query().Get("ca"); caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("GetPeerVerify: read CA bundle failed: %w", err)
+		}
+		c.PeerCAs = x509.NewCertPool()
+		if !c.PeerCAs.AppendCertsFromPEM(caPEM) {
+			return fmt.Errorf("GetPeerVerify: no valid certificate in CA bundle: %v", caFile)
+		}
+	}
+
+	if name := c.ParsedURL.Query().Get("name"); name != "" {
+		c.PeerName = name
+	} else if c.CoreType == "client" && c.PeerCAs != nil && c.ServerName != DefaultServerName {
+		c.PeerName = c.ServerName
+	}
+
+	if pin := strings.ToLower(c.ParsedURL.Query().Get("pin")); pin != "" {
+		pin = strings.TrimPrefix(pin, "sha256:")
+		if raw, err := hex.DecodeString(pin); err != nil || len(raw) != 32 {
+			return fmt.Errorf("GetPeerVerify: invalid sha256 fingerprint: %v", pin)
+		}
+		c.PeerPin = "sha256:" + pin
+	}
+	return nil
+}
+
+func (c *Common) GetClientCert() error {
+	crtFile, keyFile := c.ParsedURL.Query().Get("crt"), c.ParsedURL.Query().Get("key")
+	if c.CoreType != "client" || crtFile == "" || keyFile == "" {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(crtFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("GetClientCert: load key pair failed: %w", err)
+	}
+	c.ClientCert = &cert
+	return nil
+}
+
+func (c *Common) GetStateDir() error {
+	c.StateDir = c.ParsedURL.Query().Get("state")
+	if c.StateDir == "" || c.CoreType != "client" || c.PeerPin != "" {
+		return nil
+	}
+
+	if c.ParsedURL.Query().Get("retrust") == "1" {
+		c.TrustPending = true
+		return nil
+	}
+
+	pin, err := LoadTrustedPin(c.StateDir, c.TunnelAddr)
+	if err != nil {
+		return fmt.Errorf("GetStateDir: %w", err)
+	}
+	if pin != "" {
+		c.PeerPin = pin
+	} else {
+		c.TrustPending = true
+	}
+	return nil
+}
+
 func (c *Common) GetLBStrategy() {
 	if lbStrategy := c.ParsedURL.Query().Get("lbs"); lbStrategy != "" {
 		c.LBStrategy = lbStrategy
@@ -185,6 +313,66 @@ func (c *Common) GetReadTimeout() {
 	}
 }
 
+func (c *Common) GetTCPIdleTimeout() {
+	if timeout := c.ParsedURL.Query().Get("tidle"); timeout != "" {
+		if value, err := time.ParseDuration(timeout); err == nil && value > 0 {
+			c.TCPIdleTimeout = value
+		}
+	} else {
+		c.TCPIdleTimeout = DefaultTCPIdle
+	}
+}
+
+func (c *Common) GetTCPLifeTimeout() {
+	if timeout := c.ParsedURL.Query().Get("tlife"); timeout != "" {
+		if value, err := time.ParseDuration(timeout); err == nil && value > 0 {
+			c.TCPLifeTimeout = value
+		}
+	} else {
+		c.TCPLifeTimeout = DefaultTCPLife
+	}
+}
+
+func (c *Common) GetTCPMaxBytes() {
+	if limit := c.ParsedURL.Query().Get("tmax"); limit != "" {
+		if value, err := strconv.ParseUint(limit, 10, 64); err == nil && value > 0 {
+			c.TCPMaxBytes = value
+		}
+	} else {
+		c.TCPMaxBytes = DefaultTCPMaxBytes
+	}
+}
+
+func (c *Common) GetUDPIdleTimeout() {
+	if timeout := c.ParsedURL.Query().Get("uidle"); timeout != "" {
+		if value, err := time.ParseDuration(timeout); err == nil && value >= 0 {
+			c.UDPIdleTimeout = value
+		}
+	} else {
+		c.UDPIdleTimeout = UDPReadTimeout
+	}
+}
+
+func (c *Common) GetUDPLifeTimeout() {
+	if timeout := c.ParsedURL.Query().Get("ulife"); timeout != "" {
+		if value, err := time.ParseDuration(timeout); err == nil && value > 0 {
+			c.UDPLifeTimeout = value
+		}
+	} else {
+		c.UDPLifeTimeout = DefaultUDPLife
+	}
+}
+
+func (c *Common) GetUDPLimit() {
+	if limit := c.ParsedURL.Query().Get("umax"); limit != "" {
+		if value, err := strconv.Atoi(limit); err == nil && value > 0 {
+			c.UDPLimit = int32(value)
+		}
+	} else {
+		c.UDPLimit = DefaultUDPLimit
+	}
+}
+
 func (c *Common) GetRateLimit() {
 	if limit := c.ParsedURL.Query().Get("rate"); limit != "" {
 		if value, err := strconv.Atoi(limit); err == nil && value > 0 {
@@ -240,6 +428,108 @@ func (c *Common) GetUDPStrategy() {
 	}
 }
 
+func (c *Common) GetDatagramPort() {
+	if port := c.ParsedURL.Query().Get("dgram"); port != "" {
+		if value, err := strconv.Atoi(port); err == nil && value >= 0 && value <= 65535 {
+			c.DatagramPort = port
+		}
+	} else {
+		c.DatagramPort = DefaultDatagramPort
+	}
+}
+
+func (c *Common) GetUDPMux() {
+	if mux := c.ParsedURL.Query().Get("umux"); mux != "" {
+		if value, err := strconv.Atoi(mux); err == nil && value >= 0 {
+			c.UDPMux = value
+		}
+	} else {
+		c.UDPMux = DefaultUDPMux
+	}
+}
+
+func (c *Common) GetClientLimit() {
+	if limit := c.ParsedURL.Query().Get("clients"); limit != "" {
+		if value, err := strconv.Atoi(limit); err == nil && value >= 0 {
+			c.ClientLimit = int32(value)
+		}
+	} else {
+		c.ClientLimit = DefaultClientLimit
+	}
+}
+
+func (c *Common) GetTenantFile() {
+	c.TenantFile = c.ParsedURL.Query().Get("tenants")
+}
+
+func (c *Common) GetPolicyFile() {
+	c.PolicyFile = c.ParsedURL.Query().Get("policy")
+}
+
+func (c *Common) GetDecoy() error {
+	c.Decoy = ""
+	decoy := c.ParsedURL.Query().Get("decoy")
+	if decoy == "" {
+		return nil
+	}
+	if !strings.Contains(decoy, "://") {
+		decoy = "https://" + decoy
+	}
+
+	target, err := url.Parse(decoy)
+	if err != nil || target.Host == "" || target.Scheme != "https" {
+		return fmt.Errorf("GetDecoy: invalid decoy backend: %v", c.ParsedURL.Query().Get("decoy"))
+	}
+	c.Decoy = target.String()
+	return nil
+}
+
+func (c *Common) GetConnectACL() error {
+	rules, err := ParseConnectACL(c.ParsedURL.Query().Get("connect"))
+	if err != nil {
+		return fmt.Errorf("GetConnectACL: %w", err)
+	}
+	c.ConnectACL = rules
+	return nil
+}
+
+func (c *Common) GetUpstream() error {
+	c.Upstream = nil
+	upstream := c.ParsedURL.Query().Get("upstream")
+	if upstream == "" {
+		return nil
+	}
+
+	target, err := url.Parse(upstream)
+	if err != nil || target.Hostname() == "" || (target.Scheme != "http" && target.Scheme != "socks5") {
+		return fmt.Errorf("GetUpstream: upstream proxy must be an http:// or socks5:// URL")
+	}
+	if target.Port() == "" {
+		port := "80"
+		if target.Scheme == "socks5" {
+			port = "1080"
+		}
+		target.Host = net.JoinHostPort(target.Hostname(), port)
+	}
+	c.Upstream = target
+	return nil
+}
+
+func (c *Common) GetFailover() error {
+	if failover := c.ParsedURL.Query().Get("failover"); failover != "" {
+		c.FailoverMode = failover
+	} else {
+		c.FailoverMode = DefaultFailoverMode
+	}
+
+	if c.FailoverMode == "1" && len(c.TunnelAddrs) > 1 {
+		if err := c.SelectTunnelAddr(rand.IntN(len(c.TunnelAddrs))); err != nil {
+			return fmt.Errorf("GetFailover: %w", err)
+		}
+	}
+	return nil
+}
+
 func (c *Common) InitConfig() error {
 	if err := c.GetAddress(); err != nil {
 		return err
@@ -248,19 +538,56 @@ func (c *Common) InitConfig() error {
 	c.GetCoreType()
 	c.GetDNSTTL()
 	c.GetTunnelKey()
+	c.GetInsecure()
 	c.GetPoolCapacity()
 	c.GetServerName()
+	if err := c.GetPeerVerify(); err != nil {
+		return err
+	}
+	if err := c.GetClientCert(); err != nil {
+		return err
+	}
+	if err := c.GetStateDir(); err != nil {
+		return err
+	}
+	if err := c.GetRotatedKey(); err != nil {
+		return err
+	}
 	c.GetLBStrategy()
 	c.GetRunMode()
 	c.GetPoolType()
 	c.GetDialerIP()
 	c.GetReadTimeout()
+	c.GetTCPIdleTimeout()
+	c.GetTCPLifeTimeout()
+	c.GetTCPMaxBytes()
+	c.GetUDPIdleTimeout()
+	c.GetUDPLifeTimeout()
+	c.GetUDPLimit()
 	c.GetRateLimit()
 	c.GetSlotLimit()
 	c.GetProxyProtocol()
 	c.GetBlockProtocol()
 	c.GetTCPStrategy()
 	c.GetUDPStrategy()
+	c.GetDatagramPort()
+	c.GetUDPMux()
+	c.GetClientLimit()
+	c.GetTenantFile()
+	c.GetPolicyFile()
+	c.GetKeyFile()
+	if err := c.GetDecoy(); err != nil {
+		return err
+	}
+	if err := c.GetConnectACL(); err != nil {
+		return err
+	}
+	if err := c.GetUpstream(); err != nil {
+		return err
+	}
+	if err := c.GetFailover(); err != nil {
+		return err
+	}
 
 	return nil
 }
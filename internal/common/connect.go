@@ -0,0 +1,94 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type ConnectRule struct {
+	Network *net.IPNet
+	MinPort int
+	MaxPort int
+}
+
+func (r ConnectRule) String() string {
+	network := r.Network.String()
+	if r.Network.IP.To4() == nil {
+		network = "[" + network + "]"
+	}
+	switch {
+	case r.MinPort == 1 && r.MaxPort == 65535:
+		return r.Network.String()
+	case r.MinPort == r.MaxPort:
+		return fmt.Sprintf("%v:%v", network, r.MinPort)
+	default:
+		return fmt.Sprintf("%v:%v-%v", network, r.MinPort, r.MaxPort)
+	}
+}
+
+func ParseConnectACL(value string) ([]ConnectRule, error) {
+	var rules []ConnectRule
+	for entry := range strings.SplitSeq(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		prefix, ports := entry, ""
+		if strings.HasPrefix(entry, "[") {
+			end := strings.Index(entry, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("ParseConnectACL: invalid rule: %v", entry)
+			}
+			prefix, ports = entry[1:end], strings.TrimPrefix(entry[end+1:], ":")
+		} else if strings.Count(entry, ":") == 1 {
+			prefix, ports, _ = strings.Cut(entry, ":")
+		}
+
+		if !strings.Contains(prefix, "/") {
+			if ip := net.ParseIP(prefix); ip != nil && ip.To4() != nil {
+				prefix += "/32"
+			} else {
+				prefix += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("ParseConnectACL: invalid network: %v", entry)
+		}
+
+		rule := ConnectRule{Network: network, MinPort: 1, MaxPort: 65535}
+		if ports != "" {
+			low, high, found := strings.Cut(ports, "-")
+			if !found {
+				high = low
+			}
+			minPort, err1 := strconv.Atoi(low)
+			maxPort, err2 := strconv.Atoi(high)
+			if err1 != nil || err2 != nil || minPort < 1 || maxPort > 65535 || minPort > maxPort {
+				return nil, fmt.Errorf("ParseConnectACL: invalid ports: %v", entry)
+			}
+			rule.MinPort, rule.MaxPort = minPort, maxPort
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (c *Common) AllowConnect(addr *net.TCPAddr) bool {
+	for _, rule := range c.ConnectACL {
+		if rule.Network.Contains(addr.IP) && addr.Port >= rule.MinPort && addr.Port <= rule.MaxPort {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Common) ConnectACLString() string {
+	rules := make([]string, len(c.ConnectACL))
+	for i, rule := range c.ConnectACL {
+		rules[i] = rule.String()
+	}
+	return strings.Join(rules, ",")
+}
@@ -0,0 +1,91 @@
+package common
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseConnectACL(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"empty", "", "", false},
+		{"host", "10.0.0.5", "10.0.0.5/32", false},
+		{"network with port", "10.0.0.0/8:443", "10.0.0.0/8:443", false},
+		{"port range", "0.0.0.0/0:8000-8080", "0.0.0.0/0:8000-8080", false},
+		{"ipv6 host", "2001:db8::1", "2001:db8::1/128", false},
+		{"ipv6 with ports", "[2001:db8::/32]:22-23", "[2001:db8::/32]:22-23", false},
+		{"several with spaces", " 10.0.0.5:22 , 192.168.0.0/16 ", "10.0.0.5/32:22,192.168.0.0/16", false},
+		{"hostname", "example.com:443", "", true},
+		{"port zero", "10.0.0.5:0", "", true},
+		{"port too high", "10.0.0.5:65536", "", true},
+		{"reversed range", "10.0.0.5:90-80", "", true},
+		{"bad port", "10.0.0.5:ssh", "", true},
+		{"unclosed bracket", "[2001:db8::1:22", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := ParseConnectACL(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseConnectACL(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			c := &Common{ConnectACL: rules}
+			got := c.ConnectACLString()
+			if got != tt.want {
+				t.Fatalf("ConnectACLString = %q, want %q", got, tt.want)
+			}
+			again, err := ParseConnectACL(got)
+			if err != nil || (&Common{ConnectACL: again}).ConnectACLString() != got {
+				t.Fatalf("rules do not round-trip through %q: %v", got, err)
+			}
+		})
+	}
+}
+
+func TestAllowConnect(t *testing.T) {
+	rules, err := ParseConnectACL("10.0.0.0/8:443,192.168.1.5,[2001:db8::/32]:22-23")
+	if err != nil {
+		t.Fatalf("ParseConnectACL: %v", err)
+	}
+	c := &Common{ConnectACL: rules}
+
+	tests := []struct {
+		name string
+		addr string
+		want bool
+	}{
+		{"network and port", "10.1.2.3:443", true},
+		{"network wrong port", "10.1.2.3:80", false},
+		{"host any port", "192.168.1.5:8080", true},
+		{"neighbour host", "192.168.1.6:8080", false},
+		{"loopback", "127.0.0.1:443", false},
+		{"ipv6 range low", "[2001:db8::1]:22", true},
+		{"ipv6 range high", "[2001:db8::1]:23", true},
+		{"ipv6 outside range", "[2001:db8::1]:24", false},
+		{"ipv6 other network", "[2001:db9::1]:22", false},
+		{"ipv4 mapped", "[::ffff:10.0.0.1]:443", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := net.ResolveTCPAddr("tcp", tt.addr)
+			if err != nil {
+				t.Fatalf("resolve %v: %v", tt.addr, err)
+			}
+			if got := c.AllowConnect(addr); got != tt.want {
+				t.Fatalf("AllowConnect(%v) = %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+
+	if (&Common{}).AllowConnect(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}) {
+		t.Fatal("empty allowlist allowed a destination")
+	}
+}
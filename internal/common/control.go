@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"net"
 	"time"
 
 	"github.com/NodePassProject/conn"
@@ -39,10 +40,7 @@ func (c *Common) SetControlConn() error {
 			case <-c.Ctx.Done():
 				return
 			case data := <-c.WriteChan:
-				_, err := c.ControlConn.Write(data)
-				if err != nil {
-					c.Logger.Error("SetControlConn: write failed: %v", err)
-				}
+				c.writeControl(data)
 			}
 		}
 	}()
@@ -53,6 +51,100 @@ func (c *Common) SetControlConn() error {
 	return nil
 }
 
+func (c *Common) writeControl(data []byte) {
+	for c.Ctx.Err() == nil {
+		_, controlConn := c.controlReader()
+		c.WriteLock.Lock()
+		_, err := controlConn.Write(data)
+		c.WriteLock.Unlock()
+		if err == nil {
+			return
+		}
+		if !c.ResumeControl(controlConn) {
+			c.Logger.Error("SetControlConn: write failed: %v", err)
+			return
+		}
+	}
+}
+
+func (c *Common) controlReader() (*bufio.Reader, net.Conn) {
+	c.ControlLock.Lock()
+	defer c.ControlLock.Unlock()
+	return c.BufReader, c.ControlConn
+}
+
+func (c *Common) ResumeControl(broken net.Conn) bool {
+	c.ControlLock.Lock()
+	defer c.ControlLock.Unlock()
+
+	if c.Ctx.Err() != nil {
+		return false
+	}
+	if c.ControlConn != broken {
+		return true
+	}
+	if c.StandbyConn == nil {
+		return false
+	}
+
+	broken.Close()
+	c.ControlConn, c.StandbyConn = c.StandbyConn, nil
+	c.BufReader = bufio.NewReader(&conn.TimeoutReader{Conn: c.ControlConn, Timeout: 3 * ReportInterval})
+	c.Logger.Warn("Control connection lost, resumed on standby: %v", c.ControlConn.LocalAddr())
+
+	if c.CoreType == "server" {
+		go c.ReserveStandby()
+	}
+	return true
+}
+
+func (c *Common) ReserveStandby() {
+	if !c.HasCapability("resume") {
+		return
+	}
+
+	id, standbyConn, err := c.TunnelPool.IncomingGet(PoolGetTimeout)
+	if err != nil {
+		c.Logger.Warn("ReserveStandby: incomingGet failed: %v", err)
+		return
+	}
+	if !c.setStandby(standbyConn) {
+		return
+	}
+
+	signalData, _ := json.Marshal(Signal{ActionType: "standby", PoolConnID: id})
+	if err := c.QueueSignal(signalData); err != nil {
+		c.Logger.Error("ReserveStandby: %v", err)
+	}
+	c.Logger.Debug("Standby control connection reserved: %v", id)
+}
+
+func (c *Common) AcceptStandby(signal Signal) {
+	standbyConn, err := c.TunnelPool.OutgoingGet(signal.PoolConnID, PoolGetTimeout)
+	if err != nil {
+		c.Logger.Warn("AcceptStandby: outgoingGet failed: %v", err)
+		return
+	}
+	if c.setStandby(standbyConn) {
+		c.Logger.Debug("Standby control connection accepted: %v", signal.PoolConnID)
+	}
+}
+
+func (c *Common) setStandby(standbyConn net.Conn) bool {
+	c.ControlLock.Lock()
+	defer c.ControlLock.Unlock()
+
+	if c.Ctx.Err() != nil {
+		standbyConn.Close()
+		return false
+	}
+	if c.StandbyConn != nil {
+		c.StandbyConn.Close()
+	}
+	c.StandbyConn = standbyConn
+	return true
+}
+
 func (c *Common) CommonControl() error {
 	errChan := make(chan error, 3)
 
@@ -70,8 +162,12 @@ func (c *Common) CommonControl() error {
 
 func (c *Common) CommonQueue() error {
 	for c.Ctx.Err() == nil {
-		rawSignal, err := c.BufReader.ReadBytes('\n')
+		reader, controlConn := c.controlReader()
+		rawSignal, err := reader.ReadBytes('\n')
 		if err != nil {
+			if c.ResumeControl(controlConn) {
+				continue
+			}
 			return fmt.Errorf("CommonQueue: readBytes failed: %w", err)
 		}
 
@@ -96,11 +192,15 @@ func (c *Common) CommonQueue() error {
 			}
 			continue
 		}
+		if signal.ActionType == "bye" {
+			c.PeerBye = signal.Reason
+			return fmt.Errorf("CommonQueue: %w: %v", ErrPeerBye, signal.Reason)
+		}
 
 		select {
 		case c.SignalChan <- signal:
 		default:
-			c.Logger.Error("CommonQueue: queue limit reached: %v", SemaphoreLimit)
+			c.Logger.Error("CommonQueue: queue limit reached: %v", cap(c.SignalChan))
 			select {
 			case <-c.Ctx.Done():
 				return fmt.Errorf("CommonQueue: context error: %w", c.Ctx.Err())
@@ -130,7 +230,9 @@ func (c *Common) HealthCheck() error {
 		if c.TunnelPool.ErrorCount() > c.TunnelPool.Active()/2 {
 			if c.Ctx.Err() == nil && c.ControlConn != nil {
 				signalData, _ := json.Marshal(Signal{ActionType: "flush"})
-				c.WriteChan <- c.Encode(signalData)
+				if err := c.QueueSignal(signalData); err != nil {
+					c.Logger.Error("HealthCheck: %v", err)
+				}
 			}
 			c.TunnelPool.Flush()
 			c.TunnelPool.ResetError()
@@ -151,7 +253,9 @@ func (c *Common) HealthCheck() error {
 		c.CheckPoint = time.Now()
 		if c.Ctx.Err() == nil && c.ControlConn != nil {
 			signalData, _ := json.Marshal(Signal{ActionType: "ping"})
-			c.WriteChan <- c.Encode(signalData)
+			if err := c.QueueSignal(signalData); err != nil {
+				c.Logger.Error("HealthCheck: %v", err)
+			}
 		}
 		select {
 		case <-c.Ctx.Done():
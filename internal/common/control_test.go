@@ -0,0 +1,78 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestResumeControlStandby(t *testing.T) {
+	serverState, clientState := tlsStatePair(t)
+	server, client := newCipherPair(t, serverState, clientState, "key", "key")
+
+	serverActive, clientActive := net.Pipe()
+	serverStandby, clientStandby := net.Pipe()
+	t.Cleanup(func() {
+		serverStandby.Close()
+		clientStandby.Close()
+	})
+	server.ControlConn, server.StandbyConn = serverActive, serverStandby
+	client.ControlConn, client.StandbyConn = clientActive, clientStandby
+	client.BufReader = bufio.NewReader(clientActive)
+
+	errs := make(chan error, 1)
+	go func() { errs <- client.CommonQueue() }()
+
+	send := func(action string) []byte {
+		t.Helper()
+		signalData, _ := json.Marshal(Signal{ActionType: action})
+		frame, err := server.Encode(signalData)
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		server.writeControl(frame)
+		return frame
+	}
+	expect := func(action string) {
+		t.Helper()
+		select {
+		case signal := <-client.SignalChan:
+			if signal.ActionType != action {
+				t.Fatalf("signal = %v, want %v", signal.ActionType, action)
+			}
+		case err := <-errs:
+			t.Fatalf("CommonQueue: %v", err)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("signal %v not received", action)
+		}
+	}
+
+	first := send("ping")
+	expect("ping")
+
+	serverActive.Close()
+	send("flush")
+	expect("flush")
+
+	for _, c := range []*Common{server, client} {
+		c.ControlLock.Lock()
+		promoted := c.StandbyConn == nil && (c.ControlConn == serverStandby || c.ControlConn == clientStandby)
+		c.ControlLock.Unlock()
+		if !promoted {
+			t.Fatalf("%v standby not promoted to the control connection", c.CoreType)
+		}
+	}
+
+	if _, err := serverStandby.Write(first); err != nil {
+		t.Fatalf("replay write: %v", err)
+	}
+	send("ping")
+	expect("ping")
+	select {
+	case signal := <-client.SignalChan:
+		t.Fatalf("unexpected signal %v, replayed frame accepted", signal.ActionType)
+	default:
+	}
+}
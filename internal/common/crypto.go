@@ -2,37 +2,163 @@ package common
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/hkdf"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"math/big"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/NodePassProject/conn"
 )
 
 func NewTLSConfig() (*tls.Config, error) {
-	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	crtPEM, keyPEM, err := generateCertPEM()
 	if err != nil {
 		return nil, err
 	}
 
-	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	cert, err := tls.X509KeyPair(crtPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+func LoadTLSConfig(stateDir string) (*tls.Config, error) {
+	crtFile := filepath.Join(stateDir, IdentityCrtName)
+	keyFile := filepath.Join(stateDir, IdentityKeyName)
+
+	if cert, err := tls.LoadX509KeyPair(crtFile, keyFile); err == nil {
+		if cert.Leaf != nil && time.Now().Before(cert.Leaf.NotAfter) {
+			return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("LoadTLSConfig: %w", err)
+	}
+
+	crtPEM, keyPEM, err := generateCertPEM()
 	if err != nil {
 		return nil, err
 	}
 
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, fmt.Errorf("LoadTLSConfig: mkdirAll failed: %w", err)
+	}
+	if err := writeFileAtomic(keyFile, keyPEM, 0600); err != nil {
+		return nil, fmt.Errorf("LoadTLSConfig: %w", err)
+	}
+	if err := writeFileAtomic(crtFile, crtPEM, 0644); err != nil {
+		return nil, fmt.Errorf("LoadTLSConfig: %w", err)
+	}
+
+	cert, err := tls.X509KeyPair(crtPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+func LoadTrustedPin(stateDir, addr string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir, TrustFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("LoadTrustedPin: %w", err)
+	}
+
+	for line := range strings.Lines(string(data)) {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == addr {
+			return fields[1], nil
+		}
+	}
+	return "", nil
+}
+
+func SaveTrustedPin(stateDir, addr, pin string) error {
+	trustFile := filepath.Join(stateDir, TrustFileName)
+	data, err := os.ReadFile(trustFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("SaveTrustedPin: %w", err)
+	}
+
+	var buf bytes.Buffer
+	for line := range strings.Lines(string(data)) {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] != addr {
+			fmt.Fprintf(&buf, "%s %s\n", fields[0], fields[1])
+		}
+	}
+	fmt.Fprintf(&buf, "%s %s\n", addr, pin)
+
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return fmt.Errorf("SaveTrustedPin: mkdirAll failed: %w", err)
+	}
+	if err := writeFileAtomic(trustFile, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("SaveTrustedPin: %w", err)
+	}
+	return nil
+}
+
+func writeFileAtomic(filePath string, data []byte, perm os.FileMode) error {
+	tempFile, err := os.CreateTemp(filepath.Dir(filePath), "np-*.tmp")
+	if err != nil {
+		return fmt.Errorf("createTemp failed: %w", err)
+	}
+	tempPath := tempFile.Name()
+
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		os.Remove(tempPath)
+		return fmt.Errorf("write temp file failed: %w", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("close temp file failed: %w", err)
+	}
+	if err := os.Chmod(tempPath, perm); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("chmod temp file failed: %w", err)
+	}
+	if err := os.Rename(tempPath, filePath); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("rename temp file failed: %w", err)
+	}
+	return nil
+}
+
+func generateCertPEM() ([]byte, []byte, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
 		NotBefore:    time.Now(),
@@ -43,23 +169,17 @@ func NewTLSConfig() (*tls.Config, error) {
 
 	crtBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &private.PublicKey, private)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	keyBytes, err := x509.MarshalPKCS8PrivateKey(private)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	crtPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crtBytes})
 	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
-
-	cert, err := tls.X509KeyPair(crtPEM, keyPEM)
-	if err != nil {
-		return nil, err
-	}
-
-	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	return crtPEM, keyPEM, nil
 }
 
 func (c *Common) FormatCertFingerprint(certRaw []byte) string {
@@ -67,44 +187,158 @@ func (c *Common) FormatCertFingerprint(certRaw []byte) string {
 	return "sha256:" + hex.EncodeToString(hash[:])
 }
 
-func (c *Common) Xor(data []byte) []byte {
-	for i := range data {
-		data[i] ^= c.TunnelKey[i%len(c.TunnelKey)]
+func (c *Common) PeerVerifyEnabled() bool {
+	return c.PeerCAs != nil || c.PeerName != "" || c.PeerPin != ""
+}
+
+func (c *Common) VerifyPeerCertificates(certs []*x509.Certificate) error {
+	if !c.PeerVerifyEnabled() {
+		return nil
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("VerifyPeerCertificates: no peer certificate")
 	}
-	return data
+
+	if c.PeerPin != "" {
+		if fingerprint := c.FormatCertFingerprint(certs[0].Raw); fingerprint != c.PeerPin {
+			return fmt.Errorf("VerifyPeerCertificates: fingerprint mismatch: got %v, want %v", fingerprint, c.PeerPin)
+		}
+	}
+
+	if c.PeerCAs != nil || c.PeerName != "" {
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		keyUsage := x509.ExtKeyUsageServerAuth
+		if c.CoreType == "server" {
+			keyUsage = x509.ExtKeyUsageClientAuth
+		}
+		if _, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         c.PeerCAs,
+			DNSName:       c.PeerName,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{keyUsage},
+		}); err != nil {
+			return fmt.Errorf("VerifyPeerCertificates: %w", err)
+		}
+	}
+	return nil
 }
 
-func (c *Common) GenerateAuthToken() string {
-	return hex.EncodeToString(hmac.New(sha256.New, []byte(c.TunnelKey)).Sum(nil))
+func (c *Common) PeerAuthTLSConfig(base *tls.Config) *tls.Config {
+	if base == nil || c.CoreType != "server" || !c.PeerVerifyEnabled() {
+		return base
+	}
+	tlsConfig := base.Clone()
+	tlsConfig.ClientAuth = tls.RequireAnyClientCert
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		return c.VerifyPeerCertificates(state.PeerCertificates)
+	}
+	return tlsConfig
 }
 
-func (c *Common) VerifyAuthToken(token string) bool {
-	return hmac.Equal([]byte(token), []byte(c.GenerateAuthToken()))
+func (c *Common) ClientCertificates() []tls.Certificate {
+	if c.ClientCert == nil {
+		return nil
+	}
+	return []tls.Certificate{*c.ClientCert}
 }
 
-func (c *Common) VerifyPreAuth(r *http.Request) bool {
+func (c *Common) ReportPeerCert(certs []*x509.Certificate) {
+	if len(certs) == 0 {
+		return
+	}
+	if subject := certs[0].Subject.String(); subject != "" {
+		c.Logger.Event("PEER_CERT|SUBJECT=%v", subject)
+	}
+}
+
+func (c *Common) VerifyPeerConn(peerConn net.Conn) error {
+	if !c.PeerVerifyEnabled() {
+		return nil
+	}
+	stateConn, ok := peerConn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return fmt.Errorf("VerifyPeerConn: no TLS state on %v", peerConn.RemoteAddr())
+	}
+	return c.VerifyPeerCertificates(stateConn.ConnectionState().PeerCertificates)
+}
+
+func (c *Common) GenerateAuthToken(role, clientNonce, serverNonce string, timestamp int64) string {
+	return AuthToken(c.LoadSessionKey(), role, clientNonce, serverNonce, timestamp)
+}
+
+func (c *Common) VerifyAuthToken(token, role, clientNonce, serverNonce string, timestamp int64) bool {
+	return VerifyAuthKey(c.LoadSessionKey(), token, role, clientNonce, serverNonce, timestamp)
+}
+
+func AuthToken(key, role, clientNonce, serverNonce string, timestamp int64) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s|%s|%s|%d", role, clientNonce, serverNonce, timestamp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func VerifyAuthKey(key, token, role, clientNonce, serverNonce string, timestamp int64) bool {
+	if skew := time.Since(time.Unix(timestamp, 0)); skew > AuthClockSkew || skew < -AuthClockSkew {
+		return false
+	}
+	return hmac.Equal([]byte(token), []byte(AuthToken(key, role, clientNonce, serverNonce, timestamp)))
+}
+
+func VerifyPreAuth(r *http.Request, key string) bool {
 	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(r.Header.Get("Proxy-Authorization"), "Basic "))
-	return err == nil && strings.HasPrefix(string(decoded), c.TunnelKey+":")
+	if err != nil {
+		return false
+	}
+	user, _, ok := strings.Cut(string(decoded), ":")
+	return ok && hmac.Equal([]byte(user), []byte(key))
 }
 
 func (c *Common) HandlePreAuth(w http.ResponseWriter, r *http.Request) {
-	hj, ok := w.(http.Hijacker)
-	if !ok {
-		return
+	start := time.Now()
+	audit := func(result string, rx, tx uint64) {
+		c.Logger.Event("CONNECT|SRC=%v|DST=%v|RESULT=%v|RX=%v|TX=%v|TIME=%vms",
+			r.RemoteAddr, r.URL.Host, result, rx, tx, time.Since(start).Milliseconds())
 	}
-	clientConn, _, err := hj.Hijack()
+
+	addr, err := c.ResolveAddr("tcp", r.URL.Host)
 	if err != nil {
+		audit("unresolved", 0, 0)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	targetAddr := addr.(*net.TCPAddr)
+	if !c.AllowConnect(targetAddr) {
+		c.Logger.Warn("HandlePreAuth: %v to %v denied by connect ACL", r.RemoteAddr, targetAddr)
+		audit("denied", 0, 0)
+		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
-	defer clientConn.Close()
 
 	dialFunc := c.GetDialFunc("tcp", TCPDialTimeout)
-	targetConn, err := dialFunc(r.URL.Host)
+	targetConn, err := dialFunc(targetAddr.String())
 	if err != nil {
+		audit("failed", 0, 0)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
 		return
 	}
 	defer targetConn.Close()
 
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		audit("failed", 0, 0)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	clientConn, _, err := hj.Hijack()
+	if err != nil {
+		c.Logger.Warn("HandlePreAuth: hijack failed: %v", err)
+		audit("failed", 0, 0)
+		return
+	}
+	defer clientConn.Close()
+
 	clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
 
 	buffer1 := c.GetTCPBuffer()
@@ -114,19 +348,153 @@ func (c *Common) HandlePreAuth(w http.ResponseWriter, r *http.Request) {
 		c.PutTCPBuffer(buffer2)
 	}()
 
-	conn.DataExchange(clientConn, targetConn, c.ReadTimeout, buffer1, buffer2)
+	var rx, tx uint64
+	conn.DataExchange(&conn.StatConn{Conn: clientConn, RX: &rx, TX: &tx}, targetConn, c.Limits().ReadTimeout, buffer1, buffer2)
+	audit("ok", rx, tx)
+}
+
+func NewControlNonce() string {
+	nonce := make([]byte, ControlNonceSize)
+	rand.Read(nonce)
+	return hex.EncodeToString(nonce)
+}
+
+func (c *Common) InitControlCipher(clientNonce, serverNonce string, state *tls.ConnectionState) error {
+	rawClient, err := hex.DecodeString(clientNonce)
+	if err != nil || len(rawClient) != ControlNonceSize {
+		return fmt.Errorf("InitControlCipher: invalid client nonce")
+	}
+	rawServer, err := hex.DecodeString(serverNonce)
+	if err != nil || len(rawServer) != ControlNonceSize {
+		return fmt.Errorf("InitControlCipher: invalid server nonce")
+	}
+	salt := append(rawClient, rawServer...)
+
+	if state == nil {
+		return fmt.Errorf("InitControlCipher: handshake has no TLS session")
+	}
+	exporter, err := state.ExportKeyingMaterial(ControlExporterLabel, salt, 32)
+	if err != nil {
+		return fmt.Errorf("InitControlCipher: exportKeyingMaterial failed: %w", err)
+	}
+	secret := append(exporter, c.LoadSessionKey()...)
+
+	newAEAD := func(info string) (cipher.AEAD, error) {
+		key, err := hkdf.Key(sha256.New, secret, salt, info, 32)
+		if err != nil {
+			return nil, err
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+
+	serverAEAD, err := newAEAD("nodepass control server")
+	if err != nil {
+		return fmt.Errorf("InitControlCipher: %w", err)
+	}
+	clientAEAD, err := newAEAD("nodepass control client")
+	if err != nil {
+		return fmt.Errorf("InitControlCipher: %w", err)
+	}
+
+	if c.CoreType == "server" {
+		c.ControlSealer, c.ControlOpener = serverAEAD, clientAEAD
+	} else {
+		c.ControlSealer, c.ControlOpener = clientAEAD, serverAEAD
+	}
+	atomic.StoreUint64(&c.ControlSendSeq, 0)
+	c.ControlReplay = &ReplayWindow{}
+	return nil
+}
+
+func (c *Common) Encode(data []byte) ([]byte, error) {
+	if c.ControlSealer == nil {
+		return nil, fmt.Errorf("Encode: control cipher not initialized")
+	}
+
+	seq := atomic.AddUint64(&c.ControlSendSeq, 1)
+	frame := make([]byte, 8, 8+len(data)+c.ControlSealer.Overhead())
+	binary.BigEndian.PutUint64(frame, seq)
+	frame = c.ControlSealer.Seal(frame, controlNonce(c.ControlSealer, seq), data, frame[:8])
+	return append([]byte(base64.StdEncoding.EncodeToString(frame)), '\n'), nil
 }
 
-func (c *Common) Encode(data []byte) []byte {
-	return append([]byte(base64.StdEncoding.EncodeToString(c.Xor(data))), '\n')
+func (c *Common) QueueSignal(signalData []byte) error {
+	data, err := c.Encode(signalData)
+	if err != nil {
+		return err
+	}
+	c.WriteChan <- data
+	return nil
 }
 
 func (c *Common) Decode(data []byte) ([]byte, error) {
-	decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSuffix(data, []byte{'\n'})))
+	if c.ControlOpener == nil {
+		return nil, fmt.Errorf("Decode: control cipher not initialized")
+	}
+
+	frame, err := base64.StdEncoding.DecodeString(string(bytes.TrimSuffix(data, []byte{'\n'})))
 	if err != nil {
 		return nil, fmt.Errorf("Decode: base64 decode failed: %w", err)
 	}
-	return c.Xor(decoded), nil
+	if len(frame) < 8+c.ControlOpener.Overhead() {
+		return nil, fmt.Errorf("Decode: frame too short: %d", len(frame))
+	}
+
+	seq := binary.BigEndian.Uint64(frame[:8])
+	plain, err := c.ControlOpener.Open(nil, controlNonce(c.ControlOpener, seq), frame[8:], frame[:8])
+	if err != nil {
+		return nil, fmt.Errorf("Decode: authentication failed: %w", err)
+	}
+	if !c.ControlReplay.Accept(seq) {
+		return nil, fmt.Errorf("Decode: replayed signal: seq %d", seq)
+	}
+	return plain, nil
+}
+
+func controlNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+type ReplayWindow struct {
+	mu      sync.Mutex
+	highest uint64
+	bitmap  [ControlReplayWindow / 64]uint64
+}
+
+func (rw *ReplayWindow) Accept(seq uint64) bool {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if seq == 0 {
+		return false
+	}
+
+	if seq > rw.highest {
+		shift := seq - rw.highest
+		if shift >= ControlReplayWindow {
+			rw.bitmap = [ControlReplayWindow / 64]uint64{}
+		} else {
+			for i := rw.highest + 1; i <= seq; i++ {
+				rw.bitmap[(i/64)%uint64(len(rw.bitmap))] &^= 1 << (i % 64)
+			}
+		}
+		rw.highest = seq
+	} else if rw.highest-seq >= ControlReplayWindow {
+		return false
+	}
+
+	word, bit := (seq/64)%uint64(len(rw.bitmap)), uint64(1)<<(seq%64)
+	if rw.bitmap[word]&bit != 0 {
+		return false
+	}
+	rw.bitmap[word] |= bit
+	return true
 }
 
 func (c *Common) IncomingVerify() {
@@ -173,7 +541,9 @@ func (c *Common) IncomingVerify() {
 			PoolConnID:  id,
 			Fingerprint: fingerprint,
 		})
-		c.WriteChan <- c.Encode(signalData)
+		if err := c.QueueSignal(signalData); err != nil {
+			c.Logger.Error("IncomingVerify: %v", err)
+		}
 	}
 
 	c.Logger.Debug("TLS code-1: verify signal: cid %v -> %v", id, c.ControlConn.RemoteAddr())
@@ -246,6 +616,7 @@ func (c *Common) OutgoingVerify(signal Signal) {
 
 	if serverFingerprint != clientFingerprint {
 		c.Logger.Error("OutgoingVerify: certificate fingerprint mismatch: server: %v - client: %v", serverFingerprint, clientFingerprint)
+		c.SendBye(ByeAuth)
 		c.Cancel()
 		return
 	}
@@ -0,0 +1,288 @@
+package common
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReplayWindow(t *testing.T) {
+	tests := []struct {
+		name string
+		seqs []uint64
+		want []bool
+	}{
+		{"zero rejected", []uint64{0}, []bool{false}},
+		{"in order", []uint64{1, 2, 3}, []bool{true, true, true}},
+		{"duplicate", []uint64{1, 1}, []bool{true, false}},
+		{"reordered inside window", []uint64{5, 3, 4, 3}, []bool{true, true, true, false}},
+		{"oldest edge accepted", []uint64{ControlReplayWindow, 1}, []bool{true, true}},
+		{"past oldest edge rejected", []uint64{ControlReplayWindow + 1, 1}, []bool{true, false}},
+		{"jump clears window", []uint64{1, 2 + 2*ControlReplayWindow, 2 + ControlReplayWindow, 1}, []bool{true, true, false, false}},
+		{"jump beyond window keeps new slot", []uint64{7, 7 + ControlReplayWindow, 7 + ControlReplayWindow}, []bool{true, true, false}},
+		{"bitmap slot reused after wrap", []uint64{64, 64 + ControlReplayWindow, 65}, []bool{true, true, true}},
+		{"word boundary", []uint64{63, 64, 63, 64}, []bool{true, true, false, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := &ReplayWindow{}
+			for i, seq := range tt.seqs {
+				if got := rw.Accept(seq); got != tt.want[i] {
+					t.Fatalf("Accept(%v) at step %v = %v, want %v", seq, i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func tlsStatePair(t *testing.T) (*tls.ConnectionState, *tls.ConnectionState) {
+	t.Helper()
+	serverConfig, err := NewTLSConfig()
+	if err != nil {
+		t.Fatalf("NewTLSConfig: %v", err)
+	}
+
+	clientRaw, serverRaw := net.Pipe()
+	t.Cleanup(func() {
+		clientRaw.Close()
+		serverRaw.Close()
+	})
+	server := tls.Server(serverRaw, serverConfig)
+	client := tls.Client(clientRaw, &tls.Config{InsecureSkipVerify: true})
+
+	errs := make(chan error, 1)
+	go func() { errs <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("server handshake: %v", err)
+	}
+
+	serverState, clientState := server.ConnectionState(), client.ConnectionState()
+	return &serverState, &clientState
+}
+
+func newCipherPair(t *testing.T, serverState, clientState *tls.ConnectionState, serverKey, clientKey string) (*Common, *Common) {
+	t.Helper()
+	clientNonce, serverNonce := NewControlNonce(), NewControlNonce()
+
+	server := newTestCommon(t)
+	server.CoreType, server.SessionKey = "server", serverKey
+	if err := server.InitControlCipher(clientNonce, serverNonce, serverState); err != nil {
+		t.Fatalf("server InitControlCipher: %v", err)
+	}
+	client := newTestCommon(t)
+	client.CoreType, client.SessionKey = "client", clientKey
+	if err := client.InitControlCipher(clientNonce, serverNonce, clientState); err != nil {
+		t.Fatalf("client InitControlCipher: %v", err)
+	}
+	return server, client
+}
+
+func TestControlCipherRoundTrip(t *testing.T) {
+	serverState, clientState := tlsStatePair(t)
+	server, client := newCipherPair(t, serverState, clientState, "key", "key")
+
+	frame, err := client.Encode([]byte(`{"action":"ping"}`))
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	plain, err := server.Decode(frame)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if string(plain) != `{"action":"ping"}` {
+		t.Fatalf("Decode = %q", plain)
+	}
+
+	if _, err := server.Decode(frame); err == nil {
+		t.Fatal("replayed frame accepted")
+	}
+	if _, err := client.Decode(frame); err == nil {
+		t.Fatal("frame accepted in the wrong direction")
+	}
+}
+
+func TestControlCipherBinding(t *testing.T) {
+	serverState, clientState := tlsStatePair(t)
+	_, otherState := tlsStatePair(t)
+
+	tests := []struct {
+		name        string
+		clientState *tls.ConnectionState
+		clientKey   string
+	}{
+		{"different TLS session", otherState, "key"},
+		{"different tunnel key", clientState, "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := newCipherPair(t, serverState, tt.clientState, "key", tt.clientKey)
+			frame, err := client.Encode([]byte("signal"))
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if _, err := server.Decode(frame); err == nil {
+				t.Fatal("frame from a mismatched cipher accepted")
+			}
+		})
+	}
+}
+
+func TestControlCipherErrors(t *testing.T) {
+	c := &Common{}
+	if _, err := c.Encode([]byte("signal")); err == nil {
+		t.Fatal("Encode without cipher returned no error")
+	}
+	if _, err := c.Decode([]byte("signal\n")); err == nil {
+		t.Fatal("Decode without cipher returned no error")
+	}
+
+	nonce := NewControlNonce()
+	tests := []struct {
+		name        string
+		clientNonce string
+		serverNonce string
+		state       *tls.ConnectionState
+	}{
+		{"no TLS session", nonce, nonce, nil},
+		{"short nonce", "abcd", nonce, &tls.ConnectionState{}},
+		{"non-hex nonce", nonce, "zz", &tls.ConnectionState{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := c.InitControlCipher(tt.clientNonce, tt.serverNonce, tt.state); err == nil {
+				t.Fatal("InitControlCipher returned no error")
+			}
+		})
+	}
+
+	serverState, clientState := tlsStatePair(t)
+	server, client := newCipherPair(t, serverState, clientState, "key", "key")
+	frame, _ := client.Encode([]byte("signal"))
+	frame[len(frame)/2] ^= 0x01
+	if _, err := server.Decode(frame); err == nil {
+		t.Fatal("tampered frame accepted")
+	}
+}
+
+func TestVerifyPreAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{"matching key", "Basic " + base64.StdEncoding.EncodeToString([]byte("key:")), true},
+		{"matching key with password", "Basic " + base64.StdEncoding.EncodeToString([]byte("key:secret")), true},
+		{"key prefix", "Basic " + base64.StdEncoding.EncodeToString([]byte("ke:")), false},
+		{"key with suffix", "Basic " + base64.StdEncoding.EncodeToString([]byte("key2:")), false},
+		{"no separator", "Basic " + base64.StdEncoding.EncodeToString([]byte("key")), false},
+		{"wrong key", "Basic " + base64.StdEncoding.EncodeToString([]byte("other:key")), false},
+		{"bad encoding", "Basic !!!", false},
+		{"missing", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodConnect, "127.0.0.1:22", nil)
+			if tt.header != "" {
+				r.Header.Set("Proxy-Authorization", tt.header)
+			}
+			if got := VerifyPreAuth(r, "key"); got != tt.want {
+				t.Fatalf("VerifyPreAuth(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlePreAuthNoHijack(t *testing.T) {
+	target := listenTestTCP(t, func(serverConn net.Conn) { serverConn.Close() })
+	rules, err := ParseConnectACL(target.Addr().String())
+	if err != nil {
+		t.Fatalf("ParseConnectACL: %v", err)
+	}
+	c := newTestCommon(t)
+	c.ConnectACL = rules
+
+	w := httptest.NewRecorder()
+	c.HandlePreAuth(w, httptest.NewRequest(http.MethodConnect, target.Addr().String(), nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %v, want %v", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestPeerAuthClientCert(t *testing.T) {
+	newCert := func() *tls.Certificate {
+		config, err := NewTLSConfig()
+		if err != nil {
+			t.Fatalf("NewTLSConfig: %v", err)
+		}
+		return &config.Certificates[0]
+	}
+	trusted, other := newCert(), newCert()
+	serverConfig, err := NewTLSConfig()
+	if err != nil {
+		t.Fatalf("NewTLSConfig: %v", err)
+	}
+	server := &Common{CoreType: "server"}
+	server.PeerPin = server.FormatCertFingerprint(trusted.Certificate[0])
+
+	handshake := func(config *tls.Config, cert *tls.Certificate) (*tls.Conn, error) {
+		clientRaw, serverRaw := net.Pipe()
+		t.Cleanup(func() {
+			clientRaw.Close()
+			serverRaw.Close()
+		})
+		clientConfig := &tls.Config{InsecureSkipVerify: true}
+		if cert != nil {
+			clientConfig.Certificates = []tls.Certificate{*cert}
+		}
+		go func() {
+			tls.Client(clientRaw, clientConfig).Handshake()
+			io.Copy(io.Discard, clientRaw)
+		}()
+		serverConn := tls.Server(serverRaw, config)
+		return serverConn, serverConn.Handshake()
+	}
+
+	tests := []struct {
+		name string
+		cert *tls.Certificate
+		want bool
+	}{
+		{"trusted cert", trusted, true},
+		{"wrong cert", other, false},
+		{"no cert", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := handshake(server.PeerAuthTLSConfig(serverConfig), tt.cert); (err == nil) != tt.want {
+				t.Fatalf("mutual TLS handshake error = %v, want accepted %v", err, tt.want)
+			}
+
+			poolConfig := serverConfig.Clone()
+			poolConfig.ClientAuth = tls.RequestClientCert
+			poolConn, err := handshake(poolConfig, tt.cert)
+			if err != nil {
+				t.Fatalf("pool handshake: %v", err)
+			}
+			if err := server.VerifyPeerConn(poolConn); (err == nil) != tt.want {
+				t.Fatalf("VerifyPeerConn = %v, want accepted %v", err, tt.want)
+			}
+		})
+	}
+
+	plainConn, _ := net.Pipe()
+	defer plainConn.Close()
+	if err := server.VerifyPeerConn(plainConn); err == nil {
+		t.Fatal("VerifyPeerConn accepted a connection without TLS")
+	}
+}
@@ -0,0 +1,418 @@
+package common
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+type DatagramSession struct {
+	ID        string
+	RawID     []byte
+	Packets   chan []byte
+	Errors    chan error
+	Confirmed atomic.Bool
+	Stream    net.Conn
+	Done      chan struct{}
+	closeOnce sync.Once
+}
+
+type SessionConn struct {
+	net.Conn
+	Session *DatagramSession
+}
+
+func SessionOf(conn net.Conn) *DatagramSession {
+	if sessionConn, ok := conn.(*SessionConn); ok {
+		return sessionConn.Session
+	}
+	return nil
+}
+
+func (c *Common) InitDatagramListener() error {
+	if c.PoolType != "1" || c.DisableUDP == "1" || c.TLSConfig == nil {
+		return nil
+	}
+
+	tlsConfig := c.PeerAuthTLSConfig(c.TLSConfig).Clone()
+	tlsConfig.NextProtos = []string{DatagramALPN}
+	tlsConfig.MinVersion = tls.VersionTLS13
+
+	var listenHost string
+	if c.TunnelTCPAddr.IP != nil {
+		listenHost = c.TunnelTCPAddr.IP.String()
+	}
+
+	listenAddr := net.JoinHostPort(listenHost, c.DatagramPort)
+	listener, err := quic.ListenAddr(listenAddr, tlsConfig, c.datagramQUICConfig())
+	if err != nil {
+		return fmt.Errorf("InitDatagramListener: listenAddr failed: %w", err)
+	}
+	c.DatagramListener = listener
+	c.Logger.Debug("Datagram listener: %v", listener.Addr())
+	return nil
+}
+
+func (c *Common) DatagramListenPort() int {
+	if c.DatagramListener == nil {
+		return 0
+	}
+	if udpAddr, ok := c.DatagramListener.Addr().(*net.UDPAddr); ok {
+		return udpAddr.Port
+	}
+	return 0
+}
+
+func (c *Common) AcceptDatagramConn() {
+	if c.DatagramListener == nil {
+		return
+	}
+
+	for c.Ctx.Err() == nil {
+		quicConn, err := c.DatagramListener.Accept(c.Ctx)
+		if err != nil {
+			if c.Ctx.Err() != nil {
+				return
+			}
+			c.Logger.Error("AcceptDatagramConn: accept failed: %v", err)
+
+			select {
+			case <-c.Ctx.Done():
+				return
+			case <-time.After(ContextCheckInterval):
+			}
+			continue
+		}
+
+		if err := c.verifyDatagramConn(quicConn); err != nil {
+			c.Logger.Warn("AcceptDatagramConn: %v", err)
+			quicConn.CloseWithError(0, "unauthorized")
+			continue
+		}
+
+		if oldConn := c.DatagramConn.Swap(quicConn); oldConn != nil {
+			oldConn.CloseWithError(0, "replaced")
+		}
+		c.Logger.Info("QUIC datagram channel established: %v", quicConn.RemoteAddr())
+
+		go c.DatagramLoop(quicConn)
+	}
+}
+
+func (c *Common) verifyDatagramConn(quicConn *quic.Conn) error {
+	if !quicConn.ConnectionState().SupportsDatagrams.Remote {
+		return fmt.Errorf("verifyDatagramConn: peer does not support datagrams")
+	}
+
+	if host, _, err := net.SplitHostPort(quicConn.RemoteAddr().String()); err != nil || (c.ClientIP != "" && host != c.ClientIP) {
+		return fmt.Errorf("verifyDatagramConn: unexpected peer %v", quicConn.RemoteAddr())
+	}
+
+	stream, err := quicConn.AcceptStream(c.Ctx)
+	if err != nil {
+		return fmt.Errorf("verifyDatagramConn: acceptStream failed: %w", err)
+	}
+	defer stream.Close()
+
+	stream.SetDeadline(time.Now().Add(HandshakeTimeout))
+	reader := bufio.NewReader(stream)
+	clientNonce, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("verifyDatagramConn: read nonce failed: %w", err)
+	}
+
+	serverNonce := NewControlNonce()
+	if _, err := stream.Write([]byte(serverNonce + "\n")); err != nil {
+		return fmt.Errorf("verifyDatagramConn: write challenge failed: %w", err)
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("verifyDatagramConn: read token failed: %w", err)
+	}
+
+	var timestamp int64
+	var token string
+	if _, err := fmt.Sscanf(line, "%d %s", &timestamp, &token); err != nil ||
+		!c.VerifyAuthToken(token, "datagram", strings.TrimSuffix(clientNonce, "\n"), serverNonce, timestamp) {
+		return fmt.Errorf("verifyDatagramConn: invalid token from %v", quicConn.RemoteAddr())
+	}
+	return nil
+}
+
+func (c *Common) datagramDialPort() int {
+	port, err := strconv.Atoi(c.DatagramPort)
+	if err != nil || port <= 0 || c.PoolType != "1" || c.DisableUDP == "1" || c.Parent != nil {
+		return 0
+	}
+	return port
+}
+
+func (c *Common) datagramEnabled() bool {
+	return c.DatagramListener != nil || c.DatagramConn.Load() != nil || c.datagramDialPort() > 0
+}
+
+func (c *Common) DatagramDialLoop() {
+	if c.datagramDialPort() == 0 {
+		return
+	}
+
+	for c.Ctx.Err() == nil {
+		if err := c.DialDatagramConn(); err != nil {
+			c.Logger.Warn("DatagramDialLoop: %v", err)
+		} else if quicConn := c.DatagramConn.Load(); quicConn != nil {
+			select {
+			case <-c.Ctx.Done():
+				return
+			case <-quicConn.Context().Done():
+			}
+		}
+
+		select {
+		case <-c.Ctx.Done():
+			return
+		case <-time.After(ReportInterval):
+		}
+	}
+}
+
+func (c *Common) DialDatagramConn() error {
+	port := c.datagramDialPort()
+	if port == 0 {
+		return nil
+	}
+
+	udpAddr, err := c.GetTunnelUDPAddr()
+	if err != nil {
+		return fmt.Errorf("DialDatagramConn: resolve failed: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.TLSCode != "2" || c.PeerVerifyEnabled(),
+		ServerName:         c.ServerName,
+		Certificates:       c.ClientCertificates(),
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return c.VerifyPeerCertificates(state.PeerCertificates)
+		},
+		NextProtos: []string{DatagramALPN},
+		MinVersion: tls.VersionTLS13,
+	}
+
+	dialAddr := net.JoinHostPort(udpAddr.IP.String(), strconv.Itoa(port))
+	quicConn, err := quic.DialAddr(c.Ctx, dialAddr, tlsConfig, c.datagramQUICConfig())
+	if err != nil {
+		return fmt.Errorf("DialDatagramConn: dialAddr failed: %w", err)
+	}
+
+	if !quicConn.ConnectionState().SupportsDatagrams.Remote {
+		quicConn.CloseWithError(0, "unsupported")
+		return fmt.Errorf("DialDatagramConn: peer does not support datagrams")
+	}
+
+	stream, err := quicConn.OpenStreamSync(c.Ctx)
+	if err != nil {
+		quicConn.CloseWithError(0, "stream failed")
+		return fmt.Errorf("DialDatagramConn: openStreamSync failed: %w", err)
+	}
+	stream.SetDeadline(time.Now().Add(HandshakeTimeout))
+	clientNonce := NewControlNonce()
+	if _, err := stream.Write([]byte(clientNonce + "\n")); err != nil {
+		quicConn.CloseWithError(0, "auth failed")
+		return fmt.Errorf("DialDatagramConn: write nonce failed: %w", err)
+	}
+
+	serverNonce, err := bufio.NewReader(stream).ReadString('\n')
+	if err != nil {
+		quicConn.CloseWithError(0, "auth failed")
+		return fmt.Errorf("DialDatagramConn: read challenge failed: %w", err)
+	}
+	serverNonce = strings.TrimSuffix(serverNonce, "\n")
+
+	timestamp := time.Now().Unix()
+	token := c.GenerateAuthToken("datagram", clientNonce, serverNonce, timestamp)
+	if _, err := fmt.Fprintf(stream, "%d %s\n", timestamp, token); err != nil {
+		quicConn.CloseWithError(0, "auth failed")
+		return fmt.Errorf("DialDatagramConn: write token failed: %w", err)
+	}
+	stream.Close()
+
+	c.DatagramConn.Store(quicConn)
+	c.Logger.Info("QUIC datagram channel established: %v", quicConn.RemoteAddr())
+
+	go c.DatagramLoop(quicConn)
+	return nil
+}
+
+func (c *Common) datagramQUICConfig() *quic.Config {
+	return &quic.Config{
+		KeepAlivePeriod: ReportInterval,
+		MaxIdleTimeout:  3 * ReportInterval,
+		EnableDatagrams: true,
+	}
+}
+
+func (c *Common) DatagramLoop(quicConn *quic.Conn) {
+	defer c.DatagramConn.CompareAndSwap(quicConn, nil)
+
+	for c.Ctx.Err() == nil {
+		data, err := quicConn.ReceiveDatagram(c.Ctx)
+		if err != nil {
+			if c.Ctx.Err() == nil {
+				c.Logger.Warn("DatagramLoop: receive failed, falling back to stream framing: %v", err)
+			}
+			return
+		}
+
+		if len(data) < DatagramHeaderSize {
+			continue
+		}
+
+		value, ok := c.DatagramSessions.Load(hex.EncodeToString(data[:DatagramHeaderSize]))
+		if !ok {
+			c.Logger.Debug("DatagramLoop: unknown session %x, packet dropped", data[:DatagramHeaderSize])
+			continue
+		}
+
+		session := value.(*DatagramSession)
+		if !session.Confirmed.Swap(true) {
+			quicConn.SendDatagram(session.RawID)
+			c.Logger.Debug("DatagramLoop: session %v switched to datagrams", session.ID)
+		}
+		if len(data) == DatagramHeaderSize {
+			continue
+		}
+
+		select {
+		case session.Packets <- data[DatagramHeaderSize:]:
+		default:
+			c.Logger.Debug("DatagramLoop: session %v queue full, packet dropped", session.ID)
+		}
+	}
+}
+
+func (c *Common) NewDatagramSession(id string, remoteConn net.Conn) *DatagramSession {
+	if !c.datagramEnabled() {
+		return nil
+	}
+
+	rawID, err := hex.DecodeString(id)
+	if err != nil || len(rawID) != DatagramHeaderSize {
+		return nil
+	}
+
+	session := &DatagramSession{
+		ID:      id,
+		RawID:   rawID,
+		Packets: make(chan []byte, DatagramQueueSize),
+		Errors:  make(chan error, 1),
+		Stream:  remoteConn,
+		Done:    make(chan struct{}),
+	}
+	c.DatagramSessions.Store(id, session)
+
+	go func() {
+		for c.Ctx.Err() == nil {
+			buffer := c.GetUDPBuffer()
+			x, err := readUDPFrame(remoteConn, buffer, 0)
+			if err != nil {
+				c.PutUDPBuffer(buffer)
+				select {
+				case session.Errors <- err:
+				default:
+				}
+				return
+			}
+
+			select {
+			case session.Packets <- buffer[:x]:
+			case <-session.Done:
+				c.PutUDPBuffer(buffer)
+				return
+			case <-c.Ctx.Done():
+				c.PutUDPBuffer(buffer)
+				return
+			}
+		}
+	}()
+
+	return session
+}
+
+func (c *Common) CloseDatagramSession(session *DatagramSession) {
+	if session == nil {
+		return
+	}
+	session.closeOnce.Do(func() {
+		c.DatagramSessions.Delete(session.ID)
+		close(session.Done)
+		if session.Stream != nil {
+			session.Stream.Close()
+		}
+		for {
+			select {
+			case packet := <-session.Packets:
+				c.PutUDPBuffer(packet[:cap(packet)])
+			default:
+				return
+			}
+		}
+	})
+}
+
+func (c *Common) writeUDPPacket(session *DatagramSession, remoteConn net.Conn, data []byte) error {
+	if session != nil {
+		if quicConn := c.DatagramConn.Load(); quicConn != nil {
+			if !session.Confirmed.Load() {
+				quicConn.SendDatagram(session.RawID)
+			} else {
+				packet := make([]byte, DatagramHeaderSize+len(data))
+				copy(packet, session.RawID)
+				copy(packet[DatagramHeaderSize:], data)
+				if err := quicConn.SendDatagram(packet); err == nil {
+					return nil
+				}
+			}
+		}
+	}
+	return writeUDPFrame(remoteConn, data)
+}
+
+func (c *Common) readUDPPacket(session *DatagramSession, remoteConn net.Conn, buf []byte, timeout time.Duration) (int, error) {
+	if session == nil {
+		return readUDPFrame(remoteConn, buf, timeout)
+	}
+
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	select {
+	case packet := <-session.Packets:
+		if len(packet) > len(buf) {
+			c.PutUDPBuffer(packet[:cap(packet)])
+			return 0, fmt.Errorf("readUDPPacket: datagram too large: %d > buffer %d", len(packet), len(buf))
+		}
+		n := copy(buf, packet)
+		c.PutUDPBuffer(packet[:cap(packet)])
+		return n, nil
+	case err := <-session.Errors:
+		return 0, err
+	case <-timer:
+		return 0, os.ErrDeadlineExceeded
+	case <-c.Ctx.Done():
+		return 0, c.Ctx.Err()
+	}
+}
@@ -0,0 +1,103 @@
+package common
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newDatagramPair(t *testing.T, clientKey string) (*Common, *Common) {
+	t.Helper()
+	tlsConfig, err := NewTLSConfig()
+	if err != nil {
+		t.Fatalf("NewTLSConfig: %v", err)
+	}
+
+	server := newTestCommon(t)
+	server.CoreType, server.PoolType, server.SessionKey = "server", "1", "key"
+	server.TLSConfig = tlsConfig
+	server.DatagramPort = "0"
+	server.TunnelTCPAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	if err := server.InitDatagramListener(); err != nil {
+		t.Fatalf("InitDatagramListener: %v", err)
+	}
+	t.Cleanup(func() { server.DatagramListener.Close() })
+	go server.AcceptDatagramConn()
+
+	client := newTestCommon(t)
+	client.CoreType, client.PoolType, client.TLSCode, client.SessionKey = "client", "1", "1", clientKey
+	client.DatagramPort = strconv.Itoa(server.DatagramListenPort())
+	client.TunnelAddr = "127.0.0.1:" + client.DatagramPort
+	return server, client
+}
+
+func TestDatagramChannelAuth(t *testing.T) {
+	server, client := newDatagramPair(t, "other")
+	if err := client.DialDatagramConn(); err != nil {
+		t.Fatalf("DialDatagramConn: %v", err)
+	}
+	waitFor(t, "the server to close the channel", func() bool {
+		return client.DatagramConn.Load() == nil
+	})
+	if server.DatagramConn.Load() != nil {
+		t.Fatal("datagram channel accepted with a wrong session key")
+	}
+}
+
+func TestDatagramSession(t *testing.T) {
+	server, client := newDatagramPair(t, "key")
+	if err := client.DialDatagramConn(); err != nil {
+		t.Fatalf("DialDatagramConn: %v", err)
+	}
+	waitFor(t, "the server to accept the channel", func() bool {
+		return server.DatagramConn.Load() != nil
+	})
+
+	serverStream, clientStream := net.Pipe()
+	t.Cleanup(func() {
+		serverStream.Close()
+		clientStream.Close()
+	})
+	serverSession := server.NewDatagramSession("01020304", serverStream)
+	clientSession := client.NewDatagramSession("01020304", clientStream)
+	if serverSession == nil || clientSession == nil {
+		t.Fatal("NewDatagramSession returned nil with a datagram channel")
+	}
+	if session := client.NewDatagramSession("0102", clientStream); session != nil {
+		t.Fatal("NewDatagramSession accepted a short session ID")
+	}
+
+	read := func(c *Common, session *DatagramSession, want string) {
+		t.Helper()
+		buf := make([]byte, UDPDataBufSize)
+		n, err := c.readUDPPacket(session, nil, buf, 2*time.Second)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("readUDPPacket = %q, %v, want %q", buf[:n], err, want)
+		}
+	}
+
+	if err := client.writeUDPPacket(clientSession, clientStream, []byte("framed")); err != nil {
+		t.Fatalf("writeUDPPacket before confirmation: %v", err)
+	}
+	read(server, serverSession, "framed")
+	waitFor(t, "both sides to confirm the session", func() bool {
+		return serverSession.Confirmed.Load() && clientSession.Confirmed.Load()
+	})
+
+	closedConn, _ := net.Pipe()
+	closedConn.Close()
+	if err := client.writeUDPPacket(clientSession, closedConn, []byte("upstream")); err != nil {
+		t.Fatalf("writeUDPPacket fell back to the stream: %v", err)
+	}
+	read(server, serverSession, "upstream")
+	if err := server.writeUDPPacket(serverSession, closedConn, []byte("downstream")); err != nil {
+		t.Fatalf("writeUDPPacket fell back to the stream: %v", err)
+	}
+	read(client, clientSession, "downstream")
+
+	server.CloseDatagramSession(serverSession)
+	if _, ok := server.DatagramSessions.Load("01020304"); ok {
+		t.Fatal("closed session still registered")
+	}
+}
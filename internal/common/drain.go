@@ -0,0 +1,79 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"time"
+)
+
+func (c *Common) IsDraining() bool {
+	return c.DrainStart.Load() != 0 || (c.Parent != nil && c.Parent.IsDraining())
+}
+
+func (c *Common) StartDrain() {
+	if !c.DrainStart.CompareAndSwap(0, time.Now().UnixNano()) {
+		return
+	}
+	c.CloseIngress()
+}
+
+func (c *Common) CloseIngress() {
+	if c.TargetHold != nil {
+		c.TargetHold.Close()
+	}
+	if c.TunnelHold != nil && c.CoreType == "client" {
+		c.TunnelHold.Close()
+	}
+}
+
+func (c *Common) ActiveSessions() int32 {
+	return atomic.LoadInt32(&c.ActiveSlot)
+}
+
+func (c *Common) DrainPoint() string {
+	start := c.DrainStart.Load()
+	if start == 0 {
+		return ""
+	}
+	left := max(DrainTimeout-time.Since(time.Unix(0, start)), 0)
+	return fmt.Sprintf("|DRAIN=%vs", int(left.Seconds()))
+}
+
+func (c *Common) DrainLoop(ctx context.Context, stop func(), drain func(), active func() int32) {
+	if DrainSignal == nil {
+		return
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, DrainSignal)
+	defer signal.Stop(sigChan)
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-sigChan:
+	}
+	drain()
+	c.Logger.Info("Drain started: refusing new sessions, waiting up to %v for %v active", DrainTimeout, active())
+
+	ticker := time.NewTicker(ContextCheckInterval)
+	defer ticker.Stop()
+	deadline := time.After(DrainTimeout)
+
+	for count := active(); count > 0; count = active() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			c.Logger.Warn("Drain deadline reached: closing %v active sessions", count)
+			stop()
+			return
+		case <-ticker.C:
+		}
+	}
+	c.Logger.Info("Drain complete: no active sessions left")
+	stop()
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package common
+
+import (
+	"os"
+	"syscall"
+)
+
+var DrainSignal os.Signal = syscall.SIGUSR1
@@ -0,0 +1,7 @@
+//go:build windows
+
+package common
+
+import "os"
+
+var DrainSignal os.Signal
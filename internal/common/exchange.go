@@ -0,0 +1,134 @@
+package common
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NodePassProject/conn"
+)
+
+type ExchangeSession struct {
+	Conns  [2]net.Conn
+	Start  time.Time
+	Bytes  atomic.Uint64
+	Active atomic.Int64
+	Reason atomic.Pointer[string]
+	once   sync.Once
+}
+
+type exchangeConn struct {
+	net.Conn
+	session  *ExchangeSession
+	maxBytes uint64
+}
+
+func (ec *exchangeConn) Read(b []byte) (int, error) {
+	n, err := ec.Conn.Read(b)
+	if n > 0 {
+		ec.session.Active.Store(time.Now().UnixNano())
+		if total := ec.session.Bytes.Add(uint64(n)); ec.maxBytes > 0 && total >= ec.maxBytes {
+			ec.session.Terminate("bytes")
+		}
+	}
+	return n, err
+}
+
+func (es *ExchangeSession) Terminate(reason string) {
+	es.once.Do(func() {
+		es.Reason.Store(&reason)
+		for _, c := range es.Conns {
+			c.Close()
+		}
+	})
+}
+
+func (c *Common) ExchangeData(conn1, conn2 net.Conn, buffer1, buffer2 []byte) (string, error) {
+	readTimeout := c.Limits().ReadTimeout
+	if c.TCPIdleTimeout == 0 && c.TCPLifeTimeout == 0 && c.TCPMaxBytes == 0 {
+		err := conn.DataExchange(conn1, conn2, readTimeout, buffer1, buffer2)
+		return c.exchangeReason(err), err
+	}
+
+	session := &ExchangeSession{Conns: [2]net.Conn{conn1, conn2}, Start: time.Now()}
+	session.Active.Store(session.Start.UnixNano())
+
+	done := make(chan struct{})
+	go c.watchExchange(session, done)
+
+	err := conn.DataExchange(
+		&exchangeConn{Conn: conn1, session: session, maxBytes: c.TCPMaxBytes},
+		&exchangeConn{Conn: conn2, session: session, maxBytes: c.TCPMaxBytes},
+		readTimeout, buffer1, buffer2)
+	close(done)
+
+	if reason := session.Reason.Load(); reason != nil {
+		switch *reason {
+		case "idle":
+			atomic.AddUint64(&c.TCPEndIdle, 1)
+		case "lifetime":
+			atomic.AddUint64(&c.TCPEndLife, 1)
+		case "bytes":
+			atomic.AddUint64(&c.TCPEndBytes, 1)
+		}
+		return *reason, err
+	}
+	return c.exchangeReason(err), err
+}
+
+func (c *Common) watchExchange(session *ExchangeSession, done <-chan struct{}) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		wait := time.Duration(-1)
+		if c.TCPLifeTimeout > 0 {
+			remain := c.TCPLifeTimeout - time.Since(session.Start)
+			if remain <= 0 {
+				session.Terminate("lifetime")
+				return
+			}
+			wait = remain
+		}
+		if c.TCPIdleTimeout > 0 {
+			remain := c.TCPIdleTimeout - time.Since(time.Unix(0, session.Active.Load()))
+			if remain <= 0 {
+				session.Terminate("idle")
+				return
+			}
+			if wait < 0 || remain < wait {
+				wait = remain
+			}
+		}
+		if wait < 0 {
+			<-done
+			return
+		}
+
+		timer.Reset(wait)
+		select {
+		case <-done:
+			return
+		case <-c.Ctx.Done():
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Common) exchangeReason(err error) string {
+	switch {
+	case err == nil || err == io.EOF:
+		return "eof"
+	case c.Ctx.Err() != nil || errors.Is(err, net.ErrClosed):
+		return "closed"
+	default:
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return "read"
+		}
+		return "error"
+	}
+}
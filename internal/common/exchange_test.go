@@ -0,0 +1,82 @@
+package common
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExchangeDataLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		idle    time.Duration
+		life    time.Duration
+		max     uint64
+		traffic func(client net.Conn)
+		want    string
+		counter func(c *Common) *uint64
+	}{
+		{"idle", 100 * time.Millisecond, 0, 0, func(net.Conn) {}, "idle", func(c *Common) *uint64 { return &c.TCPEndIdle }},
+		{"lifetime", time.Second, 200 * time.Millisecond, 0, func(client net.Conn) {
+			for {
+				if _, err := client.Write([]byte("ping")); err != nil {
+					return
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		}, "lifetime", func(c *Common) *uint64 { return &c.TCPEndLife }},
+		{"bytes", time.Second, 0, 10, func(client net.Conn) {
+			client.Write(make([]byte, 16))
+		}, "bytes", func(c *Common) *uint64 { return &c.TCPEndBytes }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCommon(t)
+			c.TCPIdleTimeout, c.TCPLifeTimeout, c.TCPMaxBytes = tt.idle, tt.life, tt.max
+
+			client, tunnel := net.Pipe()
+			target, remote := net.Pipe()
+			defer client.Close()
+			defer remote.Close()
+			go io.Copy(io.Discard, client)
+			go io.Copy(io.Discard, remote)
+			go tt.traffic(client)
+
+			done := make(chan string, 1)
+			start := time.Now()
+			go func() {
+				reason, _ := c.ExchangeData(tunnel, target, make([]byte, 1024), make([]byte, 1024))
+				done <- reason
+			}()
+
+			select {
+			case reason := <-done:
+				if reason != tt.want {
+					t.Fatalf("reason = %v, want %v", reason, tt.want)
+				}
+				if tt.want == "lifetime" && time.Since(start) < tt.life {
+					t.Fatalf("session ended after %v, before its lifetime %v", time.Since(start), tt.life)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("exchange did not end")
+			}
+
+			counters := map[*uint64]string{&c.TCPEndIdle: "idle", &c.TCPEndLife: "lifetime", &c.TCPEndBytes: "bytes"}
+			for counter, name := range counters {
+				want := uint64(0)
+				if tt.counter(c) == counter {
+					want = 1
+				}
+				if got := atomic.LoadUint64(counter); got != want {
+					t.Fatalf("%v counter = %v, want %v", name, got, want)
+				}
+			}
+			if _, err := client.Write([]byte("x")); err == nil {
+				t.Fatal("client connection still open after the exchange ended")
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package common
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+type TunnelError struct {
+	Err error
+}
+
+func (e *TunnelError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TunnelError) Unwrap() error {
+	return e.Err
+}
+
+func (c *Common) SelectTunnelAddr(idx int) error {
+	tunnelAddr := c.TunnelAddrs[idx]
+	tcpAddr, udpAddr, err := c.resolveTunnelAddr(tunnelAddr)
+	if err != nil {
+		return fmt.Errorf("SelectTunnelAddr: %v: %w", tunnelAddr, err)
+	}
+
+	restore := c.saveTunnelAddr()
+	c.setTunnelAddr(tunnelAddr, tcpAddr, udpAddr)
+	if err := c.selectPeer(); err != nil {
+		restore()
+		return fmt.Errorf("SelectTunnelAddr: %v: %w", tunnelAddr, err)
+	}
+	c.TunnelIdx = idx
+	return nil
+}
+
+func (c *Common) selectPeer() error {
+	c.GetServerName()
+	c.PeerName, c.PeerPin, c.TrustPending = "", "", false
+	if err := c.GetPeerVerify(); err != nil {
+		return err
+	}
+	if err := c.GetStateDir(); err != nil {
+		return err
+	}
+	return c.GetRotatedKey()
+}
+
+func (c *Common) saveTunnelAddr() func() {
+	idx, tunnelAddr, tcpAddr, udpAddr := c.TunnelIdx, c.TunnelAddr, c.TunnelTCPAddr, c.TunnelUDPAddr
+	serverName, serverPort := c.ServerName, c.ServerPort
+	peerName, peerPin, peerCAs, trustPending := c.PeerName, c.PeerPin, c.PeerCAs, c.TrustPending
+	stateDir, tunnelKey := c.StateDir, c.LoadTunnelKey()
+	return func() {
+		c.TunnelIdx, c.TunnelAddr, c.TunnelTCPAddr, c.TunnelUDPAddr = idx, tunnelAddr, tcpAddr, udpAddr
+		c.ServerName, c.ServerPort = serverName, serverPort
+		c.PeerName, c.PeerPin, c.PeerCAs, c.TrustPending = peerName, peerPin, peerCAs, trustPending
+		c.StateDir = stateDir
+		c.KeyLock.Lock()
+		c.TunnelKey = tunnelKey
+		c.KeyLock.Unlock()
+	}
+}
+
+func (c *Common) NextTunnelAddr() (bool, error) {
+	count := len(c.TunnelAddrs)
+	if count < 2 {
+		return true, nil
+	}
+
+	idx := c.TunnelIdx
+	if c.PreferredSwitch.Swap(false) {
+		idx = count - 1
+	}
+
+	c.FailoverTries++
+	var err error
+	for range count {
+		next := (idx + 1) % count
+		if c.FailoverMode == "1" {
+			next = (idx + 1 + rand.IntN(count-1)) % count
+		}
+		if err = c.SelectTunnelAddr(next); err == nil {
+			break
+		}
+		c.Logger.Warn("NextTunnelAddr: %v", err)
+		idx = next
+		c.FailoverTries++
+	}
+	if err != nil {
+		c.FailoverTries = 0
+		return true, fmt.Errorf("NextTunnelAddr: no tunnel server available, staying on %v: %w", c.TunnelAddr, err)
+	}
+	c.Logger.Info("Switching to tunnel server %v (%v/%v)", c.TunnelAddr, c.TunnelIdx+1, count)
+
+	if c.FailoverTries >= count {
+		c.FailoverTries = 0
+		return true, nil
+	}
+	return false, nil
+}
+
+func (c *Common) PreferredLoop(probe func(idx int) (bool, error)) {
+	if c.FailoverMode != "0" || c.TunnelIdx == 0 || len(c.TunnelAddrs) < 2 {
+		return
+	}
+
+	ticker := time.NewTicker(FallbackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.Ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		answered, err := probe(0)
+		if err != nil {
+			c.Logger.Debug("PreferredLoop: preferred server %v still unavailable: %v", c.TunnelAddrs[0], err)
+			continue
+		}
+
+		if answered {
+			c.Logger.Info("Preferred server %v passed a handshake probe, switching back after %v active sessions end", c.TunnelAddrs[0], c.ActiveSessions())
+			if !c.waitIdle() {
+				return
+			}
+		} else {
+			c.Logger.Info("Preferred server %v accepted the probe as a client, switching back now", c.TunnelAddrs[0])
+		}
+		c.PreferredSwitch.Store(true)
+		c.Cancel()
+		return
+	}
+}
+
+func (c *Common) waitIdle() bool {
+	ticker := time.NewTicker(ContextCheckInterval)
+	defer ticker.Stop()
+	deadline := time.After(DrainTimeout)
+
+	for count := c.ActiveSessions(); count > 0; count = c.ActiveSessions() {
+		select {
+		case <-c.Ctx.Done():
+			return false
+		case <-deadline:
+			c.Logger.Warn("PreferredLoop: drain deadline reached, closing %v active sessions", count)
+			return true
+		case <-ticker.C:
+		}
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTunnelError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		tunnel bool
+		bye    bool
+	}{
+		{"local error", fmt.Errorf("CommonStart: initTargetListener failed: %w", errors.New("bind")), false, false},
+		{"tunnel error", &TunnelError{Err: errors.New("CommonStart: tunnelHandshake failed")}, true, false},
+		{"wrapped bye", &TunnelError{Err: fmt.Errorf("CommonStart: commonControl failed: %w", ErrPeerBye)}, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tunnelErr *TunnelError
+			if got := errors.As(tt.err, &tunnelErr); got != tt.tunnel {
+				t.Fatalf("errors.As = %v, want %v", got, tt.tunnel)
+			}
+			if got := errors.Is(tt.err, ErrPeerBye); got != tt.bye {
+				t.Fatalf("errors.Is(ErrPeerBye) = %v, want %v", got, tt.bye)
+			}
+		})
+	}
+}
+
+func TestWaitIdle(t *testing.T) {
+	c := newTestCommon(t)
+	if !c.TryAcquireSlot(false) {
+		t.Fatal("TryAcquireSlot refused without limits")
+	}
+
+	done := make(chan bool, 1)
+	go func() { done <- c.waitIdle() }()
+
+	select {
+	case <-done:
+		t.Fatal("waitIdle returned with an active session")
+	case <-time.After(3 * ContextCheckInterval):
+	}
+
+	c.ReleaseSlot(false)
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatal("waitIdle = false after the session ended")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("waitIdle did not return after the session ended")
+	}
+
+	c.TryAcquireSlot(true)
+	go func() { done <- c.waitIdle() }()
+	c.Cancel()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Fatal("waitIdle = true after the context was canceled")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("waitIdle ignored the canceled context")
+	}
+}
+
+func newFailoverCommon(t *testing.T, addrs ...string) *Common {
+	t.Helper()
+	c := newTestCommon(t)
+	c.ParsedURL, _ = url.Parse("client://key@127.0.0.1:10101/127.0.0.1:8080")
+	c.CoreType = "client"
+	c.FailoverMode = "0"
+	c.TunnelAddrs = addrs
+	if err := c.SelectTunnelAddr(0); err != nil {
+		t.Fatalf("SelectTunnelAddr: %v", err)
+	}
+	return c
+}
+
+func TestNextTunnelAddr(t *testing.T) {
+	tests := []struct {
+		name      string
+		addrs     []string
+		start     int
+		preferred bool
+		want      int
+		backoff   bool
+	}{
+		{"next address", []string{"127.0.0.1:1001", "127.0.0.1:1002", "127.0.0.1:1003"}, 0, false, 1, false},
+		{"skips unresolvable", []string{"127.0.0.1:1001", "bad", "127.0.0.1:1003"}, 0, false, 2, false},
+		{"wraps around", []string{"127.0.0.1:1001", "127.0.0.1:1002", "127.0.0.1:1003"}, 2, false, 0, false},
+		{"back to preferred", []string{"127.0.0.1:1001", "127.0.0.1:1002", "127.0.0.1:1003"}, 1, true, 0, false},
+		{"back to current", []string{"127.0.0.1:1001", "bad", "worse"}, 0, false, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newFailoverCommon(t, tt.addrs...)
+			if err := c.SelectTunnelAddr(tt.start); err != nil {
+				t.Fatalf("SelectTunnelAddr: %v", err)
+			}
+			c.PreferredSwitch.Store(tt.preferred)
+
+			backoff, err := c.NextTunnelAddr()
+			if err != nil || backoff != tt.backoff {
+				t.Fatalf("NextTunnelAddr = %v, %v, want backoff %v", backoff, err, tt.backoff)
+			}
+			if c.TunnelIdx != tt.want || c.TunnelAddr != tt.addrs[tt.want] || c.TunnelTCPAddr.String() != tt.addrs[tt.want] {
+				t.Fatalf("tunnel = %v %v %v, want %v", c.TunnelIdx, c.TunnelAddr, c.TunnelTCPAddr, tt.addrs[tt.want])
+			}
+			if c.PreferredSwitch.Load() {
+				t.Fatal("preferred switch not cleared")
+			}
+		})
+	}
+}
+
+func TestNextTunnelAddrUnavailable(t *testing.T) {
+	c := newFailoverCommon(t, "127.0.0.1:1001", "bad")
+	c.TunnelAddrs = []string{"gone", "bad"}
+
+	backoff, err := c.NextTunnelAddr()
+	if err == nil || !backoff {
+		t.Fatalf("NextTunnelAddr = %v, %v, want an error and a backoff", backoff, err)
+	}
+	if c.TunnelIdx != 0 || c.TunnelAddr != "127.0.0.1:1001" || c.TunnelTCPAddr.Port != 1001 || c.FailoverTries != 0 {
+		t.Fatalf("tunnel = %v %v %v, tries %v, want the current address kept", c.TunnelIdx, c.TunnelAddr, c.TunnelTCPAddr, c.FailoverTries)
+	}
+}
+
+func TestSelectTunnelAddrKeepsCurrent(t *testing.T) {
+	c := newFailoverCommon(t, "127.0.0.1:1001", "127.0.0.1:1002")
+	c.ParsedURL.RawQuery = "ca=" + url.QueryEscape(t.TempDir()+"/missing.pem")
+
+	if err := c.SelectTunnelAddr(1); err == nil {
+		t.Fatal("SelectTunnelAddr succeeded without the CA bundle")
+	}
+	if c.TunnelIdx != 0 || c.TunnelAddr != "127.0.0.1:1001" || c.TunnelTCPAddr.Port != 1001 || c.TunnelUDPAddr.Port != 1001 || c.ServerPort != "1001" {
+		t.Fatalf("tunnel = %v %v %v %v, want the first address kept", c.TunnelIdx, c.TunnelAddr, c.TunnelTCPAddr, c.TunnelUDPAddr)
+	}
+}
@@ -0,0 +1,100 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+type AuthGuard struct {
+	mu       sync.Mutex
+	sources  map[string]*authSource
+	window   time.Time
+	count    int
+	connects map[string]int
+}
+
+type authSource struct {
+	fails    int
+	first    time.Time
+	banUntil time.Time
+}
+
+func NewAuthGuard() *AuthGuard {
+	return &AuthGuard{sources: make(map[string]*authSource), connects: make(map[string]int)}
+}
+
+func (g *AuthGuard) Banned(ip string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if source, ok := g.sources[ip]; ok {
+		return max(time.Until(source.banUntil), 0)
+	}
+	return 0
+}
+
+func (g *AuthGuard) Throttle() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.roll(time.Now())
+	if AuthRateLimit > 0 && g.count >= AuthRateLimit {
+		return false
+	}
+	g.count++
+	return true
+}
+
+func (g *AuthGuard) Connect(ip string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.roll(time.Now())
+	if ConnectRateLimit > 0 && g.connects[ip] >= ConnectRateLimit {
+		return false
+	}
+	g.connects[ip]++
+	return true
+}
+
+func (g *AuthGuard) Fail(ip string) (int, time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	source, ok := g.sources[ip]
+	if !ok || now.Sub(source.first) > AuthBanTime {
+		source = &authSource{first: now}
+		g.sources[ip] = source
+	}
+
+	source.fails++
+	fails := source.fails
+	if AuthMaxFails > 0 && fails >= AuthMaxFails {
+		source.fails, source.first, source.banUntil = 0, now, now.Add(AuthBanTime)
+		return fails, AuthBanTime
+	}
+	return fails, 0
+}
+
+func (g *AuthGuard) Success(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.sources, ip)
+}
+
+func (g *AuthGuard) roll(now time.Time) {
+	if now.Sub(g.window) >= time.Second {
+		g.window, g.count = now, 0
+		clear(g.connects)
+		g.prune(now)
+	}
+}
+
+func (g *AuthGuard) prune(now time.Time) {
+	for ip, source := range g.sources {
+		if now.After(source.banUntil) && now.Sub(source.first) > AuthBanTime {
+			delete(g.sources, ip)
+		}
+	}
+}
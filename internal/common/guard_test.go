@@ -0,0 +1,130 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func setGuardLimits(t *testing.T, maxFails int, banTime time.Duration, authRate, connectRate int) {
+	t.Helper()
+	savedFails, savedBan, savedAuth, savedConnect := AuthMaxFails, AuthBanTime, AuthRateLimit, ConnectRateLimit
+	t.Cleanup(func() {
+		AuthMaxFails, AuthBanTime, AuthRateLimit, ConnectRateLimit = savedFails, savedBan, savedAuth, savedConnect
+	})
+	AuthMaxFails, AuthBanTime, AuthRateLimit, ConnectRateLimit = maxFails, banTime, authRate, connectRate
+}
+
+func TestAuthGuardFail(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxFails int
+		fails    int
+		banned   bool
+	}{
+		{"below limit", 3, 2, false},
+		{"at limit", 3, 3, true},
+		{"no limit", 0, 10, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGuardLimits(t, tt.maxFails, time.Minute, 0, 0)
+			g := NewAuthGuard()
+
+			var ban time.Duration
+			for range tt.fails {
+				_, ban = g.Fail("192.0.2.1")
+			}
+			if got := ban > 0; got != tt.banned {
+				t.Fatalf("Fail ban = %v, want banned %v", ban, tt.banned)
+			}
+			if got := g.Banned("192.0.2.1") > 0; got != tt.banned {
+				t.Fatalf("Banned = %v, want %v", got, tt.banned)
+			}
+			if g.Banned("192.0.2.2") > 0 {
+				t.Fatal("ban leaked to another source")
+			}
+		})
+	}
+}
+
+func TestAuthGuardBanExpiry(t *testing.T) {
+	banTime := 100 * time.Millisecond
+	setGuardLimits(t, 2, banTime, 0, 0)
+	g := NewAuthGuard()
+
+	g.Fail("192.0.2.1")
+	if _, ban := g.Fail("192.0.2.1"); ban != banTime {
+		t.Fatalf("Fail ban = %v, want %v", ban, banTime)
+	}
+	if left := g.Banned("192.0.2.1"); left <= 0 || left > banTime {
+		t.Fatalf("Banned = %v, want within (0, %v]", left, banTime)
+	}
+
+	time.Sleep(banTime + 20*time.Millisecond)
+	if left := g.Banned("192.0.2.1"); left != 0 {
+		t.Fatalf("Banned = %v after expiry, want 0", left)
+	}
+	if fails, ban := g.Fail("192.0.2.1"); fails != 1 || ban != 0 {
+		t.Fatalf("Fail after expiry = %v, %v, want a fresh count", fails, ban)
+	}
+
+	g.mu.Lock()
+	g.window = time.Time{}
+	g.sources["192.0.2.1"].first = time.Now().Add(-2 * banTime)
+	g.mu.Unlock()
+	g.Throttle()
+	g.mu.Lock()
+	_, kept := g.sources["192.0.2.1"]
+	g.mu.Unlock()
+	if kept {
+		t.Fatal("expired source was not pruned")
+	}
+}
+
+func TestAuthGuardSuccess(t *testing.T) {
+	setGuardLimits(t, 2, time.Minute, 0, 0)
+	g := NewAuthGuard()
+
+	g.Fail("192.0.2.1")
+	g.Success("192.0.2.1")
+	if _, ban := g.Fail("192.0.2.1"); ban != 0 {
+		t.Fatal("Success did not clear earlier failures")
+	}
+}
+
+func TestAuthGuardRates(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		check func(g *AuthGuard) bool
+	}{
+		{"handshake rate", 3, func(g *AuthGuard) bool { return g.Throttle() }},
+		{"connect rate", 3, func(g *AuthGuard) bool { return g.Connect("192.0.2.1") }},
+		{"no limit", 0, func(g *AuthGuard) bool { return g.Throttle() && g.Connect("192.0.2.1") }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGuardLimits(t, 0, time.Minute, tt.limit, tt.limit)
+			g := NewAuthGuard()
+
+			allowed := 0
+			for range 10 {
+				if tt.check(g) {
+					allowed++
+				}
+			}
+			if want := tt.limit; want > 0 && allowed != want || want == 0 && allowed != 10 {
+				t.Fatalf("allowed %v attempts, limit %v", allowed, tt.limit)
+			}
+
+			g.mu.Lock()
+			g.window = time.Time{}
+			g.mu.Unlock()
+			if !tt.check(g) {
+				t.Fatal("attempt refused after the window rolled over")
+			}
+		})
+	}
+}
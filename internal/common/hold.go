@@ -0,0 +1,165 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type HoldListener struct {
+	listener net.Listener
+	queue    chan *heldConn
+	done     chan struct{}
+	once     sync.Once
+}
+
+type heldConn struct {
+	net.Conn
+	timer   *time.Timer
+	claimed atomic.Bool
+}
+
+func NewHoldListener(listener net.Listener) *HoldListener {
+	l := &HoldListener{
+		listener: listener,
+		queue:    make(chan *heldConn, HoldQueueSize),
+		done:     make(chan struct{}),
+	}
+	go l.serve()
+	return l
+}
+
+func (l *HoldListener) serve() {
+	defer l.Close()
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			time.Sleep(ContextCheckInterval)
+			continue
+		}
+
+		held := &heldConn{Conn: conn}
+		held.timer = time.AfterFunc(HoldTimeout, func() {
+			if held.claimed.CompareAndSwap(false, true) {
+				conn.Close()
+			}
+		})
+
+		select {
+		case l.queue <- held:
+		default:
+			held.timer.Stop()
+			conn.Close()
+		}
+	}
+}
+
+func (l *HoldListener) View() net.Listener {
+	return &holdView{hold: l, done: make(chan struct{})}
+}
+
+func (l *HoldListener) accept(done chan struct{}) (net.Conn, error) {
+	for {
+		select {
+		case held := <-l.queue:
+			if held.claimed.CompareAndSwap(false, true) {
+				held.timer.Stop()
+				return held.Conn, nil
+			}
+		case <-done:
+			return nil, net.ErrClosed
+		case <-l.done:
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+func (l *HoldListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.listener.Close()
+		for {
+			select {
+			case held := <-l.queue:
+				if held.claimed.CompareAndSwap(false, true) {
+					held.timer.Stop()
+					held.Conn.Close()
+				}
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (l *HoldListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+type holdView struct {
+	hold *HoldListener
+	done chan struct{}
+	once sync.Once
+}
+
+func (v *holdView) Accept() (net.Conn, error) {
+	return v.hold.accept(v.done)
+}
+
+func (v *holdView) Close() error {
+	v.once.Do(func() { close(v.done) })
+	return nil
+}
+
+func (v *holdView) Addr() net.Addr {
+	return v.hold.Addr()
+}
+
+func HoldTCP(hold **HoldListener, addr *net.TCPAddr) (net.Listener, error) {
+	if *hold == nil {
+		listener, err := net.ListenTCP("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		*hold = NewHoldListener(listener)
+	}
+	return (*hold).View(), nil
+}
+
+func HoldUDP(hold **net.UDPConn, addr *net.UDPAddr) (*net.UDPConn, error) {
+	if *hold == nil {
+		udpConn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		*hold = udpConn
+	} else {
+		(*hold).SetReadDeadline(time.Time{})
+	}
+	return *hold, nil
+}
+
+func (c *Common) ReleaseListeners() {
+	if c.TargetHold != nil {
+		c.TargetHold.Close()
+		c.TargetHold = nil
+	}
+	if c.TunnelHold != nil {
+		c.TunnelHold.Close()
+		c.TunnelHold = nil
+	}
+	if c.TargetUDPHold != nil {
+		c.TargetUDPHold.Close()
+		c.TargetUDPHold = nil
+	}
+	if c.TunnelUDPHold != nil {
+		c.TunnelUDPHold.Close()
+		c.TunnelUDPHold = nil
+	}
+}
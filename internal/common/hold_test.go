@@ -0,0 +1,50 @@
+package common
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHoldTCPKeepsPortAcrossViews(t *testing.T) {
+	var hold *HoldListener
+	first, err := HoldTCP(&hold, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("HoldTCP: %v", err)
+	}
+	t.Cleanup(func() { hold.Close() })
+	addr := first.Addr().String()
+	first.Close()
+
+	dialed, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial between views: %v", err)
+	}
+	defer dialed.Close()
+
+	second, err := HoldTCP(&hold, nil)
+	if err != nil {
+		t.Fatalf("HoldTCP second view: %v", err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := second.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+	select {
+	case c := <-accepted:
+		if _, ok := c.(*net.TCPConn); !ok {
+			t.Fatalf("held connection is %T, want *net.TCPConn", c)
+		}
+		c.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection made between views was not held")
+	}
+
+	c := &Common{CoreType: "server", TunnelHold: hold}
+	c.CloseIngress()
+	if _, err := net.Dial("tcp", addr); err != nil {
+		t.Fatalf("server tunnel port closed by drain: %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type TunnelKeys struct {
+	Current  string
+	Previous map[string]time.Time
+}
+
+func ParseKeys(data string) (*TunnelKeys, error) {
+	keys := &TunnelKeys{Previous: make(map[string]time.Time)}
+	for line := range strings.Lines(data) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 1:
+			if keys.Current != "" {
+				return nil, fmt.Errorf("ParseKeys: more than one current key")
+			}
+			keys.Current = fields[0]
+		case 2:
+			expiry, err := time.Parse(time.RFC3339, fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("ParseKeys: invalid expiry: %v", fields[1])
+			}
+			keys.Previous[fields[0]] = expiry
+		default:
+			return nil, fmt.Errorf("ParseKeys: invalid line: %v", line)
+		}
+	}
+
+	if keys.Current == "" {
+		return nil, fmt.Errorf("ParseKeys: no current key")
+	}
+	delete(keys.Previous, keys.Current)
+	return keys, nil
+}
+
+func (k *TunnelKeys) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s\n", k.Current)
+	for key, expiry := range k.Previous {
+		fmt.Fprintf(&buf, "%s %s\n", key, expiry.UTC().Format(time.RFC3339))
+	}
+	return buf.String()
+}
+
+func (k *TunnelKeys) Match(verify func(key string) bool) (string, bool) {
+	if verify(k.Current) {
+		return k.Current, true
+	}
+	now := time.Now()
+	for key, expiry := range k.Previous {
+		if now.Before(expiry) && verify(key) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+func SaveKeys(keyFile string, keys *TunnelKeys) error {
+	if err := writeFileAtomic(keyFile, []byte(keys.String()), 0600); err != nil {
+		return fmt.Errorf("SaveKeys: %w", err)
+	}
+	return nil
+}
+
+func (c *Common) ReadKeys() (*TunnelKeys, time.Time, error) {
+	if c.KeyFile == "" {
+		return nil, time.Time{}, nil
+	}
+
+	info, err := os.Stat(c.KeyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, time.Time{}, nil
+	} else if err != nil {
+		return nil, time.Time{}, fmt.Errorf("ReadKeys: %w", err)
+	}
+	if info.ModTime().Equal(c.KeyTime) {
+		return nil, time.Time{}, nil
+	}
+
+	data, err := os.ReadFile(c.KeyFile)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("ReadKeys: %w", err)
+	}
+	keys, err := ParseKeys(string(data))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("ReadKeys: %w", err)
+	}
+	return keys, info.ModTime(), nil
+}
+
+func (c *Common) LoadKeys() (bool, error) {
+	keys, modTime, err := c.ReadKeys()
+	if err != nil {
+		return false, fmt.Errorf("LoadKeys: %w", err)
+	}
+	if keys == nil {
+		return false, nil
+	}
+
+	c.Keys.Store(keys)
+	c.KeyTime = modTime
+	return true, nil
+}
+
+func KeyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (c *Common) LoadTunnelKey() string {
+	c.KeyLock.RLock()
+	defer c.KeyLock.RUnlock()
+	return c.TunnelKey
+}
+
+func (c *Common) LoadSessionKey() string {
+	c.KeyLock.RLock()
+	defer c.KeyLock.RUnlock()
+	return c.SessionKey
+}
+
+func (c *Common) StoreSessionKey(key string) {
+	c.KeyLock.Lock()
+	defer c.KeyLock.Unlock()
+	c.SessionKey = key
+}
+
+func (c *Common) TunnelKeyString() string {
+	if key := c.LoadTunnelKey(); key != c.baseTunnelKey() {
+		return "rotated:" + KeyFingerprint(key)
+	}
+	return c.baseTunnelKey()
+}
+
+func (c *Common) SendRekey(current string) {
+	if current == "" || current == c.LoadSessionKey() || c.Ctx.Err() != nil || c.ControlConn == nil {
+		return
+	}
+	if !c.HasCapability("rekey") {
+		c.Logger.Warn("SendRekey: client %v does not support key rotation, keeping previous key", c.ClientIP)
+		return
+	}
+
+	signalData, _ := json.Marshal(Signal{ActionType: "rekey", Key: current})
+	if err := c.QueueSignal(signalData); err != nil {
+		c.Logger.Error("SendRekey: %v", err)
+	}
+	c.Logger.Info("Sending rotated tunnel key to client %v", c.ClientIP)
+}
+
+func (c *Common) ApplyRekey(key string) {
+	c.KeyLock.Lock()
+	if key == "" || key == c.TunnelKey {
+		c.KeyLock.Unlock()
+		return
+	}
+	c.TunnelKey = key
+	c.KeyLock.Unlock()
+
+	for _, stateDir := range []string{c.StateDir, RekeyDir} {
+		if stateDir == "" {
+			continue
+		}
+		if err := SaveRotatedKey(stateDir, c.TunnelAddr, c.baseTunnelKey(), key); err != nil {
+			c.Logger.Warn("ApplyRekey: %v", err)
+		}
+	}
+
+	c.Logger.Info("Tunnel key rotated by server %v", c.TunnelAddr)
+	c.Logger.Event("KEY_ROTATED|SERVER=%v|FP=%v", c.TunnelAddr, KeyFingerprint(key))
+}
+
+func LoadRotatedKey(stateDir, addr, baseKey string) (string, error) {
+	return findRotatedKey(stateDir, func(fields []string) bool {
+		return fields[0] == addr && fields[1] == baseKey
+	})
+}
+
+func FindRotatedKey(stateDir, addr, fingerprint string) (string, error) {
+	return findRotatedKey(stateDir, func(fields []string) bool {
+		return fields[0] == addr && KeyFingerprint(fields[2]) == fingerprint
+	})
+}
+
+func findRotatedKey(stateDir string, match func(fields []string) bool) (string, error) {
+	data, err := os.ReadFile(filepath.Join(stateDir, KeyFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("LoadRotatedKey: %w", err)
+	}
+
+	for line := range strings.Lines(string(data)) {
+		if fields := strings.Fields(line); len(fields) == 3 && match(fields) {
+			return fields[2], nil
+		}
+	}
+	return "", nil
+}
+
+func SaveRotatedKey(stateDir, addr, baseKey, key string) error {
+	keyFile := filepath.Join(stateDir, KeyFileName)
+	data, err := os.ReadFile(keyFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("SaveRotatedKey: %w", err)
+	}
+
+	var buf bytes.Buffer
+	for line := range strings.Lines(string(data)) {
+		if fields := strings.Fields(line); len(fields) == 3 && fields[0] != addr {
+			fmt.Fprintf(&buf, "%s %s %s\n", fields[0], fields[1], fields[2])
+		}
+	}
+	fmt.Fprintf(&buf, "%s %s %s\n", addr, baseKey, key)
+
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return fmt.Errorf("SaveRotatedKey: mkdirAll failed: %w", err)
+	}
+	if err := writeFileAtomic(keyFile, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("SaveRotatedKey: %w", err)
+	}
+	return nil
+}
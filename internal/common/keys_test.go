@@ -0,0 +1,107 @@
+package common
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestKeyFingerprint(t *testing.T) {
+	fingerprint := KeyFingerprint("secret")
+	if len(fingerprint) != 16 || strings.Contains(fingerprint, "secret") {
+		t.Fatalf("KeyFingerprint = %q", fingerprint)
+	}
+	if KeyFingerprint("secret") != fingerprint {
+		t.Fatal("KeyFingerprint not stable")
+	}
+	if KeyFingerprint("other") == fingerprint {
+		t.Fatal("different keys share a fingerprint")
+	}
+}
+
+func TestFindRotatedKey(t *testing.T) {
+	stateDir := t.TempDir()
+	if err := SaveRotatedKey(stateDir, "a.example.com:10101", "base", "next"); err != nil {
+		t.Fatalf("SaveRotatedKey: %v", err)
+	}
+	if err := SaveRotatedKey(stateDir, "b.example.com:10101", "base", "other"); err != nil {
+		t.Fatalf("SaveRotatedKey: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		stateDir    string
+		addr        string
+		fingerprint string
+		want        string
+	}{
+		{"match", stateDir, "a.example.com:10101", KeyFingerprint("next"), "next"},
+		{"other server", stateDir, "b.example.com:10101", KeyFingerprint("other"), "other"},
+		{"wrong fingerprint", stateDir, "a.example.com:10101", KeyFingerprint("other"), ""},
+		{"unknown server", stateDir, "c.example.com:10101", KeyFingerprint("next"), ""},
+		{"missing file", t.TempDir(), "a.example.com:10101", KeyFingerprint("next"), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FindRotatedKey(tt.stateDir, tt.addr, tt.fingerprint)
+			if err != nil {
+				t.Fatalf("FindRotatedKey: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("FindRotatedKey = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyRekey(t *testing.T) {
+	saved := RekeyDir
+	t.Cleanup(func() { RekeyDir = saved })
+	RekeyDir = t.TempDir()
+
+	c := newTestCommon(t)
+	c.ParsedURL, _ = url.Parse("client://base@a.example.com:10101/127.0.0.1:8080")
+	c.TunnelAddr = "a.example.com:10101"
+	c.GetTunnelKey()
+	c.StoreSessionKey("base")
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				c.LoadTunnelKey()
+				c.GenerateAuthToken("client", "", "", 0)
+			}
+		}()
+	}
+	c.ApplyRekey("next")
+	wg.Wait()
+
+	if got := c.LoadTunnelKey(); got != "next" {
+		t.Fatalf("TunnelKey = %q, want %q", got, "next")
+	}
+	if got := c.LoadSessionKey(); got != "base" {
+		t.Fatalf("SessionKey = %q, want the key of the running session", got)
+	}
+	if got := c.TunnelKeyString(); strings.Contains(got, "next") {
+		t.Fatalf("TunnelKeyString = %q exposes the rotated key", got)
+	}
+
+	key, err := FindRotatedKey(RekeyDir, c.TunnelAddr, KeyFingerprint("next"))
+	if err != nil || key != "next" {
+		t.Fatalf("FindRotatedKey = %q, %v, want the rotated key", key, err)
+	}
+	info, err := os.Stat(filepath.Join(RekeyDir, KeyFileName))
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("key file mode = %v, want 0600", perm)
+	}
+}
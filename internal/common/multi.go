@@ -0,0 +1,265 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/NodePassProject/conn"
+)
+
+type QueueListener struct {
+	addr  net.Addr
+	queue chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func NewQueueListener(addr net.Addr) *QueueListener {
+	return &QueueListener{
+		addr:  addr,
+		queue: make(chan net.Conn, ClientQueueSize),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *QueueListener) Push(conn net.Conn) bool {
+	select {
+	case <-l.done:
+		return false
+	default:
+	}
+
+	select {
+	case l.queue <- conn:
+		return true
+	case <-l.done:
+		return false
+	default:
+		return false
+	}
+}
+
+func (l *QueueListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.queue:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *QueueListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		for {
+			select {
+			case conn := <-l.queue:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (l *QueueListener) Addr() net.Addr {
+	return l.addr
+}
+
+type ClientMux struct {
+	listener  net.Listener
+	fallback  *QueueListener
+	listeners sync.Map
+}
+
+func NewClientMux(listener net.Listener) *ClientMux {
+	return &ClientMux{
+		listener: listener,
+		fallback: NewQueueListener(listener.Addr()),
+	}
+}
+
+func (m *ClientMux) Fallback() net.Listener {
+	return m.fallback
+}
+
+func (m *ClientMux) Register() (string, *QueueListener) {
+	listener := NewQueueListener(m.listener.Addr())
+	for {
+		rawID := make([]byte, RouteIDSize)
+		rand.Read(rawID)
+		routeID := hex.EncodeToString(rawID)
+		if _, loaded := m.listeners.LoadOrStore(routeID, listener); !loaded {
+			return routeID, listener
+		}
+	}
+}
+
+func (m *ClientMux) Unregister(routeID string, listener *QueueListener) bool {
+	if !m.listeners.CompareAndDelete(routeID, listener) {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+func (m *ClientMux) Serve() error {
+	defer m.fallback.Close()
+	for {
+		tunnelConn, err := m.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go m.route(tunnelConn)
+	}
+}
+
+func (m *ClientMux) route(tunnelConn net.Conn) {
+	listener := m.fallback
+	routeID, tunnelConn := readRoute(tunnelConn)
+	if routeID != "" {
+		value, ok := m.listeners.Load(routeID)
+		if !ok {
+			tunnelConn.Close()
+			return
+		}
+		listener = value.(*QueueListener)
+	}
+	if !listener.Push(tunnelConn) {
+		tunnelConn.Close()
+	}
+}
+
+func routeComplete(data []byte) bool {
+	n := min(len(data), len(RouteMagic))
+	return n > 0 && (string(data[:n]) != RouteMagic[:n] || len(data) >= len(RouteMagic)+RouteIDSize)
+}
+
+func readRoute(tunnelConn net.Conn) (string, net.Conn) {
+	header := make([]byte, len(RouteMagic)+RouteIDSize)
+	if PeekSupported {
+		data := peekConn(tunnelConn, time.Now().Add(PeekTimeout), routeComplete)
+		if len(data) < len(header) || string(data[:len(RouteMagic)]) != RouteMagic {
+			return "", tunnelConn
+		}
+		if _, err := io.ReadFull(tunnelConn, header); err != nil {
+			return "", tunnelConn
+		}
+		return hex.EncodeToString(header[len(RouteMagic):]), tunnelConn
+	}
+
+	tunnelConn.SetReadDeadline(time.Now().Add(PeekTimeout))
+	n, _ := io.ReadFull(tunnelConn, header)
+	tunnelConn.SetReadDeadline(time.Time{})
+	if n < len(header) || string(header[:len(RouteMagic)]) != RouteMagic {
+		return "", &ReaderConn{Conn: tunnelConn, Reader: io.MultiReader(bytes.NewReader(header[:n]), tunnelConn)}
+	}
+	return hex.EncodeToString(header[len(RouteMagic):]), tunnelConn
+}
+
+func (c *Common) WriteRoute(tunnelConn net.Conn) error {
+	if c.RouteID == "" {
+		return nil
+	}
+	rawID, err := hex.DecodeString(c.RouteID)
+	if err != nil || len(rawID) != RouteIDSize {
+		return fmt.Errorf("WriteRoute: invalid route id %v", c.RouteID)
+	}
+	if _, err := tunnelConn.Write(append([]byte(RouteMagic), rawID...)); err != nil {
+		return fmt.Errorf("WriteRoute: %w", err)
+	}
+	return nil
+}
+
+type SharedConn struct {
+	net.Conn
+}
+
+func (sc *SharedConn) Close() error {
+	return nil
+}
+
+func (c *Common) InitPeer(peer *Common, clientIP string) {
+	peer.Parent = c
+	peer.ParsedURL = c.ParsedURL
+	peer.Logger = c.Logger
+	peer.DNSCacheTTL = c.DNSCacheTTL
+	peer.TLSCode = c.TLSCode
+	peer.TLSConfig = c.TLSConfig
+	peer.CoreType = c.CoreType
+	peer.RunMode = c.RunMode
+	peer.PoolType = c.PoolType
+	peer.DataFlow = c.DataFlow
+	peer.ServerName = c.ServerName
+	peer.PeerCAs = c.PeerCAs
+	peer.PeerName = c.PeerName
+	peer.PeerPin = c.PeerPin
+	peer.StateDir = c.StateDir
+	peer.ServerPort = c.ServerPort
+	peer.ClientIP = clientIP
+	peer.DialerIP = c.DialerIP
+	peer.DialerIPv6 = c.DialerIPv6
+	peer.TunnelKey = c.LoadTunnelKey()
+	peer.Insecure = c.Insecure
+	peer.TunnelAddr = c.TunnelAddr
+	peer.TunnelTCPAddr = c.TunnelTCPAddr
+	peer.TunnelUDPAddr = c.TunnelUDPAddr
+	peer.TargetAddrs = c.TargetAddrs
+	peer.TargetTCPAddrs = c.TargetTCPAddrs
+	peer.TargetUDPAddrs = c.TargetUDPAddrs
+	peer.LBStrategy = c.LBStrategy
+	peer.DatagramPort = c.DatagramPort
+	peer.UDPMux = c.UDPMux
+	peer.MinPoolCapacity = c.MinPoolCapacity
+	peer.MaxPoolCapacity = c.MaxPoolCapacity
+	peer.ProxyProtocol = c.ProxyProtocol
+	peer.BlockProtocol = c.BlockProtocol
+	peer.BlockSOCKS = c.BlockSOCKS
+	peer.BlockHTTP = c.BlockHTTP
+	peer.BlockTLS = c.BlockTLS
+	peer.DisableTCP = c.DisableTCP
+	peer.DisableUDP = c.DisableUDP
+	peer.RateLimit = c.RateLimit
+	peer.ReadTimeout = c.ReadTimeout
+	peer.UDPIdleTimeout = c.UDPIdleTimeout
+	peer.UDPLifeTimeout = c.UDPLifeTimeout
+	peer.TCPIdleTimeout = c.TCPIdleTimeout
+	peer.TCPLifeTimeout = c.TCPLifeTimeout
+	peer.TCPMaxBytes = c.TCPMaxBytes
+	peer.SlotLimit = c.SlotLimit
+	peer.UDPLimit = c.UDPLimit
+	peer.TCPBufferPool = c.TCPBufferPool
+	peer.UDPBufferPool = c.UDPBufferPool
+	peer.SignalChan = make(chan Signal, ClientQueueSize)
+	peer.WriteChan = make(chan []byte, ClientQueueSize)
+	peer.VerifyChan = make(chan struct{})
+	peer.HandshakeStart = time.Now()
+	peer.Ctx, peer.Cancel = context.WithCancel(c.Ctx)
+	peer.InitRateLimiter()
+
+	if c.TargetListener != nil {
+		peer.TargetListener = NewQueueListener(c.TargetListener.Addr())
+	}
+	if c.TargetUDPConn != nil {
+		peer.TargetUDPConn = &conn.StatConn{Conn: &SharedConn{Conn: c.TargetUDPConn.Conn}, RX: &peer.UDPRX, TX: &peer.UDPTX, Rate: c.RateLimiter.Load()}
+		if c.TargetUDPBatch != nil {
+			peer.TargetUDPBatch = c.TargetUDPBatch.View(peer.TargetUDPConn)
+		}
+		if c.UDPMux > 0 {
+			peer.MuxChannels = make([]*MuxChannel, c.UDPMux)
+		}
+	}
+}
+
+func (c *Common) HasUDPSession(key string) bool {
+	_, ok := c.TargetUDPSession.Load(key)
+	return ok
+}
@@ -0,0 +1,124 @@
+package common
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientMuxRoute(t *testing.T) {
+	tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	mux := NewClientMux(tcpListener)
+	go mux.Serve()
+	t.Cleanup(func() { tcpListener.Close() })
+
+	routeA, peerA := mux.Register()
+	routeB, peerB := mux.Register()
+	if routeA == routeB {
+		t.Fatal("two clients from one address share a route")
+	}
+	routed := func(routeID string) func(net.Conn) {
+		return func(c net.Conn) {
+			(&Common{RouteID: routeID}).WriteRoute(c)
+			c.Write([]byte("pool"))
+		}
+	}
+
+	tests := []struct {
+		name   string
+		dial   func(net.Conn)
+		want   net.Listener
+		prefix string
+	}{
+		{"first client", routed(routeA), peerA, "pool"},
+		{"second client same address", routed(routeB), peerB, "pool"},
+		{"silent connection", func(net.Conn) {}, mux.Fallback(), ""},
+		{"tls without route", func(c net.Conn) {
+			go tls.Client(c, &tls.Config{InsecureSkipVerify: true}).Handshake()
+		}, mux.Fallback(), "\x16"},
+		{"handshake", func(c net.Conn) {
+			go tls.Client(c, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{HandshakeALPN}}).Handshake()
+		}, mux.Fallback(), "\x16"},
+		{"unknown route", routed("0011223344556677"), nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnelConn, err := net.Dial("tcp", tcpListener.Addr().String())
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer tunnelConn.Close()
+			start := time.Now()
+			tt.dial(tunnelConn)
+
+			if tt.want == nil {
+				tunnelConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				_, err := tunnelConn.Read(make([]byte, 1))
+				if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+					t.Fatalf("read = %v, want the connection closed", err)
+				}
+				return
+			}
+
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				if c, err := tt.want.Accept(); err == nil {
+					accepted <- c
+				}
+			}()
+			select {
+			case c := <-accepted:
+				defer c.Close()
+				if tt.prefix != "" {
+					got := make([]byte, len(tt.prefix))
+					c.SetReadDeadline(time.Now().Add(2 * time.Second))
+					if _, err := io.ReadFull(c, got); err != nil || string(got) != tt.prefix {
+						t.Fatalf("first bytes = %q, %v, want %q", got, err, tt.prefix)
+					}
+				}
+				if tt.want != mux.Fallback() && time.Since(start) >= PeekTimeout {
+					t.Fatalf("pool connection routed after %v, want no peek timeout", time.Since(start))
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("connection not routed to the expected listener")
+			}
+			for _, other := range []net.Listener{peerA, peerB, mux.Fallback()} {
+				if other != tt.want && len(other.(*QueueListener).queue) != 0 {
+					t.Fatal("connection routed to more than one listener")
+				}
+			}
+		})
+	}
+
+	if !mux.Unregister(routeA, peerA) || mux.Unregister(routeA, peerA) {
+		t.Fatal("Unregister did not remove the route exactly once")
+	}
+}
+
+func TestReadRoute(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"empty", nil, false},
+		{"magic prefix", []byte(RouteMagic[:2]), false},
+		{"partial route", []byte(RouteMagic + "\x01\x02"), false},
+		{"full route", []byte(RouteMagic + "\x01\x02\x03\x04\x05\x06\x07\x08"), true},
+		{"other bytes", []byte("GET / HTTP/1.1"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := routeComplete(tt.data); got != tt.want {
+				t.Fatalf("routeComplete(%q) = %v, want %v", tt.data, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package common
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"time"
+)
+
+var errHelloOnly = errors.New("client hello only")
+
+type helloConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (h *helloConn) Read(b []byte) (int, error) {
+	return h.reader.Read(b)
+}
+
+func (h *helloConn) Write(b []byte) (int, error) {
+	return 0, errHelloOnly
+}
+
+func ParseClientHello(data []byte) *tls.ClientHelloInfo {
+	var hello *tls.ClientHelloInfo
+	tls.Server(&helloConn{reader: bytes.NewReader(data)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errHelloOnly
+		},
+	}).Handshake()
+	return hello
+}
+
+func helloComplete(data []byte) bool {
+	if len(data) == 0 || data[0] != 0x16 {
+		return len(data) > 0
+	}
+	if len(data) < 5 {
+		return false
+	}
+	return len(data) >= 5+(int(data[3])<<8|int(data[4]))
+}
+
+func PeekClientHello(tunnelConn net.Conn, timeout time.Duration) *tls.ClientHelloInfo {
+	data := peekConn(tunnelConn, time.Now().Add(timeout), helloComplete)
+	if len(data) == 0 || data[0] != 0x16 {
+		return nil
+	}
+	return ParseClientHello(data)
+}
+
+func IsHandshakeHello(hello *tls.ClientHelloInfo) bool {
+	return hello != nil && slices.Contains(hello.SupportedProtos, HandshakeALPN)
+}
+
+func IsTunnelHello(hello *tls.ClientHelloInfo) bool {
+	return IsHandshakeHello(hello) && !slices.Contains(hello.SupportedProtos, "h2")
+}
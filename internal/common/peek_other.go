@@ -0,0 +1,41 @@
+//go:build !windows
+
+package common
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+const PeekSupported = true
+
+func peekConn(tunnelConn net.Conn, deadline time.Time, complete func([]byte) bool) []byte {
+	sysConn, ok := tunnelConn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rawConn, err := sysConn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	tunnelConn.SetReadDeadline(deadline)
+	defer tunnelConn.SetReadDeadline(time.Time{})
+
+	buffer := make([]byte, MaxHelloSize)
+	for {
+		var n int
+		var peekErr error
+		if err := rawConn.Read(func(fd uintptr) bool {
+			n, _, peekErr = syscall.Recvfrom(int(fd), buffer, syscall.MSG_PEEK)
+			return peekErr != syscall.EAGAIN
+		}); err != nil || peekErr != nil || n <= 0 {
+			return nil
+		}
+		if complete(buffer[:n]) || n == len(buffer) || time.Now().After(deadline) {
+			return buffer[:n]
+		}
+		time.Sleep(PeekRetryInterval)
+	}
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func captureClientHello(t *testing.T, config *tls.Config) []byte {
+	t.Helper()
+	clientRaw, serverRaw := net.Pipe()
+	t.Cleanup(func() {
+		clientRaw.Close()
+		serverRaw.Close()
+	})
+	go tls.Client(clientRaw, config).Handshake()
+
+	serverRaw.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data := make([]byte, 0, MaxHelloSize)
+	buffer := make([]byte, MaxHelloSize)
+	for !helloComplete(data) {
+		n, err := serverRaw.Read(buffer)
+		if err != nil {
+			t.Fatalf("read hello: %v", err)
+		}
+		data = append(data, buffer[:n]...)
+	}
+	return data
+}
+
+func TestParseClientHello(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     *tls.Config
+		serverName string
+		handshake  bool
+		tunnel     bool
+	}{
+		{"handshake", &tls.Config{ServerName: "tunnel.example.com", NextProtos: []string{HandshakeALPN}}, "tunnel.example.com", true, true},
+		{"pool without alpn", &tls.Config{InsecureSkipVerify: true}, "", false, false},
+		{"h2 pool", &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}}, "", false, false},
+		{"browser", &tls.Config{ServerName: "site.example.com", NextProtos: []string{"h2", HandshakeALPN}}, "site.example.com", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello := ParseClientHello(captureClientHello(t, tt.config))
+			if hello == nil {
+				t.Fatal("ParseClientHello returned nil")
+			}
+			if hello.ServerName != tt.serverName {
+				t.Fatalf("ServerName = %q, want %q", hello.ServerName, tt.serverName)
+			}
+			if got := IsHandshakeHello(hello); got != tt.handshake {
+				t.Fatalf("IsHandshakeHello = %v, want %v", got, tt.handshake)
+			}
+			if got := IsTunnelHello(hello); got != tt.tunnel {
+				t.Fatalf("IsTunnelHello = %v, want %v", got, tt.tunnel)
+			}
+		})
+	}
+}
+
+func TestParseClientHelloInvalid(t *testing.T) {
+	hello := captureClientHello(t, &tls.Config{InsecureSkipVerify: true})
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"http", []byte("GET / HTTP/1.1\r\n\r\n")},
+		{"truncated", hello[:len(hello)/2]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ParseClientHello(tt.data) != nil {
+				t.Fatal("ParseClientHello accepted invalid data")
+			}
+		})
+	}
+}
+
+func TestHelloComplete(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"empty", nil, false},
+		{"plain data", []byte("GET"), true},
+		{"short header", []byte{0x16, 0x03, 0x01}, false},
+		{"partial record", []byte{0x16, 0x03, 0x01, 0x00, 0x04, 0x01}, false},
+		{"full record", []byte{0x16, 0x03, 0x01, 0x00, 0x01, 0x01}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := helloComplete(tt.data); got != tt.want {
+				t.Fatalf("helloComplete = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
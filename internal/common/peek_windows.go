@@ -0,0 +1,14 @@
+//go:build windows
+
+package common
+
+import (
+	"net"
+	"time"
+)
+
+const PeekSupported = false
+
+func peekConn(net.Conn, time.Time, func([]byte) bool) []byte {
+	return nil
+}
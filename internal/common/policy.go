@@ -0,0 +1,184 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NodePassProject/conn"
+)
+
+type Limits struct {
+	RateLimit     int
+	SlotLimit     int32
+	ReadTimeout   time.Duration
+	ProxyProtocol string
+	BlockProtocol string
+	BlockSOCKS    bool
+	BlockHTTP     bool
+	BlockTLS      bool
+}
+
+type Policy struct {
+	Rate  int    `json:"rate,omitempty"`
+	Slot  int32  `json:"slot,omitempty"`
+	Read  string `json:"read,omitempty"`
+	Proxy string `json:"proxy,omitempty"`
+	Block string `json:"block,omitempty"`
+}
+
+func (p *Policy) String() string {
+	return fmt.Sprintf("RATE=%v|SLOT=%v|READ=%v|PROXY=%v|BLOCK=%v", p.Rate, p.Slot, p.Read, p.Proxy, p.Block)
+}
+
+func ParsePolicy(data string) (*Policy, error) {
+	var lines []string
+	for line := range strings.SplitSeq(data, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+
+	query, err := url.ParseQuery(strings.Join(lines, "&"))
+	if err != nil {
+		return nil, fmt.Errorf("ParsePolicy: %w", err)
+	}
+
+	policy := &Policy{}
+	for key := range query {
+		value := query.Get(key)
+		switch key {
+		case "rate":
+			rate, err := strconv.Atoi(value)
+			if err != nil || rate < 0 {
+				return nil, fmt.Errorf("ParsePolicy: invalid rate: %v", value)
+			}
+			policy.Rate = rate
+		case "slot":
+			slot, err := strconv.Atoi(value)
+			if err != nil || slot < 0 {
+				return nil, fmt.Errorf("ParsePolicy: invalid slot: %v", value)
+			}
+			policy.Slot = int32(slot)
+		case "read":
+			if timeout, err := time.ParseDuration(value); err != nil || timeout < 0 {
+				return nil, fmt.Errorf("ParsePolicy: invalid read: %v", value)
+			}
+			policy.Read = value
+		case "proxy":
+			if value != "0" && value != "1" {
+				return nil, fmt.Errorf("ParsePolicy: invalid proxy: %v", value)
+			}
+			policy.Proxy = value
+		case "block":
+			if strings.Trim(value, "0123") != "" {
+				return nil, fmt.Errorf("ParsePolicy: invalid block: %v", value)
+			}
+			policy.Block = value
+		default:
+			return nil, fmt.Errorf("ParsePolicy: unknown key: %v", key)
+		}
+	}
+	return policy, nil
+}
+
+func (c *Common) LoadPolicy() (bool, error) {
+	if c.PolicyFile == "" {
+		return false, nil
+	}
+
+	info, err := os.Stat(c.PolicyFile)
+	if err != nil {
+		return false, fmt.Errorf("LoadPolicy: %w", err)
+	}
+	if info.ModTime().Equal(c.PolicyTime) {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(c.PolicyFile)
+	if err != nil {
+		return false, fmt.Errorf("LoadPolicy: %w", err)
+	}
+	policy, err := ParsePolicy(string(data))
+	if err != nil {
+		return false, fmt.Errorf("LoadPolicy: %w", err)
+	}
+
+	c.Policy.Store(policy)
+	c.PolicyTime = info.ModTime()
+	return true, nil
+}
+
+func (c *Common) SendPolicy() {
+	if c.Ctx.Err() != nil || c.ControlConn == nil || !c.HasCapability("policy") {
+		return
+	}
+	signalData, _ := json.Marshal(Signal{ActionType: "policy", Policy: c.Policy.Load()})
+	if err := c.QueueSignal(signalData); err != nil {
+		c.Logger.Error("SendPolicy: %v", err)
+	}
+}
+
+func (c *Common) Limits() Limits {
+	if limits := c.PolicyLimits.Load(); limits != nil {
+		return *limits
+	}
+	return c.configLimits()
+}
+
+func (c *Common) configLimits() Limits {
+	return Limits{
+		RateLimit:     c.RateLimit,
+		SlotLimit:     c.SlotLimit,
+		ReadTimeout:   c.ReadTimeout,
+		ProxyProtocol: c.ProxyProtocol,
+		BlockProtocol: c.BlockProtocol,
+		BlockSOCKS:    c.BlockSOCKS,
+		BlockHTTP:     c.BlockHTTP,
+		BlockTLS:      c.BlockTLS,
+	}
+}
+
+func (c *Common) ApplyPolicy(policy *Policy) {
+	limits := c.configLimits()
+
+	if policy != nil {
+		if rate := policy.Rate * 125000; rate > 0 && (limits.RateLimit == 0 || limits.RateLimit > rate) {
+			limits.RateLimit = rate
+		}
+		if policy.Slot > 0 && (limits.SlotLimit == 0 || limits.SlotLimit > policy.Slot) {
+			limits.SlotLimit = policy.Slot
+		}
+		if timeout, _ := time.ParseDuration(policy.Read); timeout > 0 && (limits.ReadTimeout == 0 || limits.ReadTimeout > timeout) {
+			limits.ReadTimeout = timeout
+		}
+		if policy.Proxy == "1" {
+			limits.ProxyProtocol = "1"
+		}
+		for _, protocol := range policy.Block {
+			if protocol != '0' && !strings.ContainsRune(limits.BlockProtocol, protocol) {
+				limits.BlockProtocol = strings.TrimPrefix(limits.BlockProtocol+string(protocol), "0")
+			}
+		}
+		limits.BlockSOCKS = strings.Contains(limits.BlockProtocol, "1")
+		limits.BlockHTTP = strings.Contains(limits.BlockProtocol, "2")
+		limits.BlockTLS = strings.Contains(limits.BlockProtocol, "3")
+	}
+	c.Policy.Store(policy)
+	c.PolicyLimits.Store(&limits)
+
+	if rateLimiter := c.RateLimiter.Load(); rateLimiter != nil {
+		rateLimiter.SetRate(int64(limits.RateLimit), int64(limits.RateLimit))
+	} else if limits.RateLimit > 0 {
+		c.RateLimiter.Store(conn.NewRateLimiter(int64(limits.RateLimit), int64(limits.RateLimit)))
+	}
+
+	if policy != nil {
+		c.Logger.Info("Applying server policy: RATE=%v|SLOT=%v|READ=%v|PROXY=%v|BLOCK=%v",
+			limits.RateLimit/125000, limits.SlotLimit, limits.ReadTimeout, limits.ProxyProtocol, limits.BlockProtocol)
+	}
+}
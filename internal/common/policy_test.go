@@ -0,0 +1,142 @@
+package common
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    Policy
+		wantErr bool
+	}{
+		{"empty", "", Policy{}, false},
+		{"comments and blanks", "# limits\n\nslot=10\n  # read\nread=30s\n", Policy{Slot: 10, Read: "30s"}, false},
+		{"all keys", "rate=100&slot=50\nread=1m\nproxy=1\nblock=13", Policy{Rate: 100, Slot: 50, Read: "1m", Proxy: "1", Block: "13"}, false},
+		{"negative rate", "rate=-1", Policy{}, true},
+		{"invalid slot", "slot=many", Policy{}, true},
+		{"invalid read", "read=soon", Policy{}, true},
+		{"invalid proxy", "proxy=2", Policy{}, true},
+		{"invalid block", "block=14", Policy{}, true},
+		{"unknown key", "tls=1", Policy{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := ParsePolicy(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePolicy error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && *policy != tt.want {
+				t.Fatalf("ParsePolicy = %+v, want %+v", *policy, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Limits
+		policy *Policy
+		want   Limits
+	}{
+		{
+			"no policy keeps config",
+			Limits{SlotLimit: 100, ReadTimeout: time.Minute, ProxyProtocol: "0", BlockProtocol: "0"},
+			nil,
+			Limits{SlotLimit: 100, ReadTimeout: time.Minute, ProxyProtocol: "0", BlockProtocol: "0"},
+		},
+		{
+			"policy tightens limits",
+			Limits{RateLimit: 200 * 125000, SlotLimit: 100, ReadTimeout: time.Minute, ProxyProtocol: "0", BlockProtocol: "0"},
+			&Policy{Rate: 100, Slot: 10, Read: "30s", Proxy: "1", Block: "13"},
+			Limits{RateLimit: 100 * 125000, SlotLimit: 10, ReadTimeout: 30 * time.Second, ProxyProtocol: "1", BlockProtocol: "13", BlockSOCKS: true, BlockTLS: true},
+		},
+		{
+			"policy never loosens limits",
+			Limits{RateLimit: 50 * 125000, SlotLimit: 5, ReadTimeout: 10 * time.Second, ProxyProtocol: "1", BlockProtocol: "2", BlockHTTP: true},
+			&Policy{Rate: 100, Slot: 10, Read: "30s", Proxy: "0", Block: "0"},
+			Limits{RateLimit: 50 * 125000, SlotLimit: 5, ReadTimeout: 10 * time.Second, ProxyProtocol: "1", BlockProtocol: "2", BlockHTTP: true},
+		},
+		{
+			"policy fills unlimited config",
+			Limits{ProxyProtocol: "0", BlockProtocol: "2", BlockHTTP: true},
+			&Policy{Rate: 10, Slot: 3, Read: "5s", Block: "1"},
+			Limits{RateLimit: 10 * 125000, SlotLimit: 3, ReadTimeout: 5 * time.Second, ProxyProtocol: "0", BlockProtocol: "21", BlockSOCKS: true, BlockHTTP: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCommon(t)
+			c.RateLimit, c.SlotLimit, c.ReadTimeout = tt.config.RateLimit, tt.config.SlotLimit, tt.config.ReadTimeout
+			c.ProxyProtocol, c.BlockProtocol = tt.config.ProxyProtocol, tt.config.BlockProtocol
+			c.BlockSOCKS, c.BlockHTTP, c.BlockTLS = tt.config.BlockSOCKS, tt.config.BlockHTTP, tt.config.BlockTLS
+
+			c.ApplyPolicy(tt.policy)
+			if got := c.Limits(); got != tt.want {
+				t.Fatalf("Limits = %+v, want %+v", got, tt.want)
+			}
+			if c.Policy.Load() != tt.policy {
+				t.Fatal("Policy not stored")
+			}
+			if (c.RateLimiter.Load() != nil) != (tt.want.RateLimit > 0) {
+				t.Fatalf("RateLimiter = %v, want one only with a rate limit", c.RateLimiter.Load())
+			}
+
+			c.ApplyPolicy(nil)
+			if got := c.Limits(); got != tt.config {
+				t.Fatalf("Limits after clearing = %+v, want config %+v", got, tt.config)
+			}
+		})
+	}
+}
+
+func TestApplyPolicyConcurrent(t *testing.T) {
+	c := newTestCommon(t)
+	c.SlotLimit = 1000
+	c.ProxyProtocol, c.BlockProtocol = "0", "0"
+	policies := []*Policy{{Slot: 10, Read: "1s", Block: "3"}, {Rate: 5, Proxy: "1"}, nil}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+			isUDP := i%2 == 0
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if c.TryAcquireSlot(isUDP) {
+					c.ReleaseSlot(isUDP)
+				}
+				c.SlotRefusal(isUDP)
+				c.SendProxyV1Header("127.0.0.1:1", clientConn)
+				c.Limits()
+				_ = c.RateLimiter.Load()
+			}
+		}()
+	}
+
+	for i := range 300 {
+		c.ApplyPolicy(policies[i%len(policies)])
+	}
+	close(done)
+	wg.Wait()
+
+	if got := c.ActiveSessions(); got != 0 {
+		t.Fatalf("ActiveSessions = %v after all releases, want 0", got)
+	}
+}
@@ -4,10 +4,28 @@ import (
 	"bufio"
 	"fmt"
 	"net"
+	"slices"
+	"strings"
 )
 
+var Capabilities = []string{"umux", "dgram", "policy", "resume", "bye", "rekey"}
+
+func NegotiateCapabilities(offered string) []string {
+	negotiated := make([]string, 0, len(Capabilities))
+	for capability := range strings.SplitSeq(offered, ",") {
+		if capability = strings.TrimSpace(capability); slices.Contains(Capabilities, capability) && !slices.Contains(negotiated, capability) {
+			negotiated = append(negotiated, capability)
+		}
+	}
+	return negotiated
+}
+
+func (c *Common) HasCapability(name string) bool {
+	return slices.Contains(c.Capabilities, name)
+}
+
 func (c *Common) SendProxyV1Header(ip string, conn net.Conn) error {
-	if c.ProxyProtocol != "1" {
+	if c.Limits().ProxyProtocol != "1" {
 		return nil
 	}
 
@@ -43,7 +61,8 @@ func (c *Common) SendProxyV1Header(ip string, conn net.Conn) error {
 }
 
 func (c *Common) DetectBlockProtocol(conn net.Conn) (string, net.Conn) {
-	if !c.BlockSOCKS && !c.BlockHTTP && !c.BlockTLS {
+	limits := c.Limits()
+	if !limits.BlockSOCKS && !limits.BlockHTTP && !limits.BlockTLS {
 		return "", conn
 	}
 
@@ -53,7 +72,7 @@ func (c *Common) DetectBlockProtocol(conn net.Conn) (string, net.Conn) {
 		return "", &ReaderConn{Conn: conn, Reader: reader}
 	}
 
-	if c.BlockSOCKS && len(b) >= 2 {
+	if limits.BlockSOCKS && len(b) >= 2 {
 		if b[0] == 0x04 && (b[1] == 0x01 || b[1] == 0x02) {
 			return "SOCKS4", &ReaderConn{Conn: conn, Reader: reader}
 		}
@@ -62,7 +81,7 @@ func (c *Common) DetectBlockProtocol(conn net.Conn) (string, net.Conn) {
 		}
 	}
 
-	if c.BlockHTTP && len(b) >= 4 && b[0] >= 'A' && b[0] <= 'Z' {
+	if limits.BlockHTTP && len(b) >= 4 && b[0] >= 'A' && b[0] <= 'Z' {
 		for i, c := range b[1:] {
 			if c == ' ' {
 				return "HTTP", &ReaderConn{Conn: conn, Reader: reader}
@@ -73,7 +92,7 @@ func (c *Common) DetectBlockProtocol(conn net.Conn) (string, net.Conn) {
 		}
 	}
 
-	if c.BlockTLS && b[0] == 0x16 {
+	if limits.BlockTLS && b[0] == 0x16 {
 		return "TLS", &ReaderConn{Conn: conn, Reader: reader}
 	}
 
@@ -0,0 +1,87 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+
+	"github.com/NodePassProject/conn"
+)
+
+func (c *Common) DialPool() (net.Conn, error) {
+	var tunnelConn net.Conn
+	if c.Upstream != nil {
+		upstreamConn, err := c.DialTunnel(c.Ctx, c.TunnelAddr)
+		if err != nil {
+			return nil, err
+		}
+		tunnelConn = upstreamConn
+	} else {
+		tcpAddr, err := c.GetTunnelTCPAddr()
+		if err != nil {
+			return nil, err
+		}
+		directConn, err := net.DialTimeout("tcp", tcpAddr.String(), TCPDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		tunnelConn = directConn
+	}
+
+	if err := c.WriteRoute(tunnelConn); err != nil {
+		tunnelConn.Close()
+		return nil, fmt.Errorf("DialPool: %w", err)
+	}
+	return tunnelConn, nil
+}
+
+func (c *Common) TunnelRelay() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("TunnelRelay: %w", err)
+	}
+	go func() {
+		<-c.Ctx.Done()
+		listener.Close()
+	}()
+	if !relayPeerCheck {
+		c.Logger.Warn("TunnelRelay: cannot tell own connections apart on %v, other local processes can reach %v through %v", runtime.GOOS, c.TunnelAddr, listener.Addr())
+	}
+
+	go func() {
+		for {
+			localConn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+
+			go func() {
+				defer localConn.Close()
+				if !ownConn(localConn) {
+					c.Logger.Warn("TunnelRelay: refused %v, not opened by this process", localConn.RemoteAddr())
+					return
+				}
+				tunnelConn, err := c.DialPool()
+				if err != nil {
+					c.Logger.Debug("TunnelRelay: %v", err)
+					return
+				}
+				defer tunnelConn.Close()
+
+				buffer1 := c.GetTCPBuffer()
+				buffer2 := c.GetTCPBuffer()
+				defer func() {
+					c.PutTCPBuffer(buffer1)
+					c.PutTCPBuffer(buffer2)
+				}()
+				conn.DataExchange(localConn, tunnelConn, 0, buffer1, buffer2)
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), nil
+}
@@ -0,0 +1,66 @@
+//go:build linux
+
+package common
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const relayPeerCheck = true
+
+func ownConn(localConn net.Conn) bool {
+	peerAddr, ok1 := localConn.RemoteAddr().(*net.TCPAddr)
+	relayAddr, ok2 := localConn.LocalAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return false
+	}
+
+	inode := socketInode(peerAddr.Port, relayAddr.Port)
+	if inode == "" {
+		return false
+	}
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return false
+	}
+	for _, entry := range entries {
+		if link, err := os.Readlink("/proc/self/fd/" + entry.Name()); err == nil && link == "socket:["+inode+"]" {
+			return true
+		}
+	}
+	return false
+}
+
+func socketInode(localPort, remotePort int) string {
+	for _, table := range []string{"/proc/self/net/tcp", "/proc/self/net/tcp6"} {
+		data, err := os.ReadFile(table)
+		if err != nil {
+			continue
+		}
+		for line := range strings.Lines(string(data)) {
+			fields := strings.Fields(line)
+			if len(fields) < 10 {
+				continue
+			}
+			if hexPort(fields[1]) == localPort && hexPort(fields[2]) == remotePort {
+				return fields[9]
+			}
+		}
+	}
+	return ""
+}
+
+func hexPort(addr string) int {
+	_, port, found := strings.Cut(addr, ":")
+	if !found {
+		return -1
+	}
+	value, err := strconv.ParseUint(port, 16, 16)
+	if err != nil {
+		return -1
+	}
+	return int(value)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package common
+
+import "net"
+
+const relayPeerCheck = false
+
+func ownConn(net.Conn) bool {
+	return true
+}
@@ -0,0 +1,158 @@
+package common
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func listenTestTCP(t *testing.T, serve func(serverConn net.Conn)) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			serverConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer serverConn.Close()
+				serve(serverConn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func echo(r io.Reader, w io.Writer) {
+	buffer := make([]byte, 64)
+	if n, err := r.Read(buffer); err == nil {
+		w.Write(buffer[:n])
+	}
+}
+
+func assertEcho(t *testing.T, tunnelConn net.Conn) {
+	t.Helper()
+	tunnelConn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := tunnelConn.Write([]byte("ping")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buffer := make([]byte, 4)
+	if _, err := io.ReadFull(tunnelConn, buffer); err != nil || string(buffer) != "ping" {
+		t.Fatalf("echo = %q, %v", buffer, err)
+	}
+}
+
+func newRelayCommon(t *testing.T) *Common {
+	t.Helper()
+	tunnelListener := listenTestTCP(t, func(serverConn net.Conn) {
+		echo(serverConn, serverConn)
+	})
+
+	c := newTestCommon(t)
+	c.TunnelAddr = tunnelListener.Addr().String()
+	return c
+}
+
+func TestTunnelRelay(t *testing.T) {
+	c := newRelayCommon(t)
+	relayAddr, err := c.TunnelRelay()
+	if err != nil {
+		t.Fatalf("TunnelRelay: %v", err)
+	}
+
+	localConn, err := net.Dial("tcp", relayAddr)
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	defer localConn.Close()
+	assertEcho(t, localConn)
+}
+
+func TestTunnelRelayRefusesOtherProcess(t *testing.T) {
+	if !relayPeerCheck {
+		t.Skip("relay peer check not supported on this platform")
+	}
+
+	c := newRelayCommon(t)
+	relayAddr, err := c.TunnelRelay()
+	if err != nil {
+		t.Fatalf("TunnelRelay: %v", err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRelayHelperProcess$")
+	cmd.Env = append(os.Environ(), "NP_TEST_RELAY_ADDR="+relayAddr)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("helper process: %v: %s", err, output)
+	}
+}
+
+func TestRelayHelperProcess(t *testing.T) {
+	relayAddr := os.Getenv("NP_TEST_RELAY_ADDR")
+	if relayAddr == "" {
+		t.Skip("helper for TestTunnelRelayRefusesOtherProcess")
+	}
+
+	localConn, err := net.Dial("tcp", relayAddr)
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	defer localConn.Close()
+	localConn.SetDeadline(time.Now().Add(2 * time.Second))
+	localConn.Write([]byte("ping"))
+	if n, _ := localConn.Read(make([]byte, 4)); n > 0 {
+		t.Fatal("relay forwarded a connection from another process")
+	}
+}
+
+func TestDialPoolRoute(t *testing.T) {
+	headers := make(chan []byte, 1)
+	tunnelListener := listenTestTCP(t, func(serverConn net.Conn) {
+		header := make([]byte, len(RouteMagic)+RouteIDSize)
+		io.ReadFull(serverConn, header)
+		headers <- header
+		echo(serverConn, serverConn)
+	})
+
+	tests := []struct {
+		name    string
+		routeID string
+		want    string
+		wantErr bool
+	}{
+		{"no route", "", "ping", false},
+		{"route", "0102030405060708", RouteMagic + "\x01\x02\x03\x04\x05\x06\x07\x08", false},
+		{"invalid route", "zz", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCommon(t)
+			c.TunnelAddr = tunnelListener.Addr().String()
+			c.RouteID = tt.routeID
+			tunnelConn, err := c.DialPool()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DialPool error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			defer tunnelConn.Close()
+
+			if tt.routeID == "" {
+				tunnelConn.Write([]byte("ping" + "\x00\x00\x00\x00\x00\x00\x00\x00"))
+			}
+			if got := string(<-headers); got[:len(tt.want)] != tt.want {
+				t.Fatalf("first bytes = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,13 @@
 package common
 
-import "sync/atomic"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
 
 func (c *Common) GetTCPBuffer() []byte {
 	buf := c.TCPBufferPool.Get().(*[]byte)
@@ -25,37 +32,113 @@ func (c *Common) PutUDPBuffer(buf []byte) {
 }
 
 func (c *Common) TryAcquireSlot(isUDP bool) bool {
-	if c.SlotLimit == 0 {
-		return true
+	if c.IsDraining() || !c.reserveSlot(isUDP) {
+		return false
 	}
+	atomic.AddInt32(&c.ActiveSlot, 1)
+	return true
+}
 
-	currentTotal := atomic.LoadInt32(&c.TCPSlot) + atomic.LoadInt32(&c.UDPSlot)
-	if currentTotal >= c.SlotLimit {
-		return false
+func (c *Common) reserveSlot(isUDP bool) bool {
+	slotLimit := c.Limits().SlotLimit
+	if c.UDPLimit > 0 {
+		if isUDP {
+			return acquireSlot(&c.UDPSlot, c.UDPLimit)
+		}
+		return acquireSlot(&c.TCPSlot, slotLimit)
 	}
 
+	counter, other := &c.TCPSlot, &c.UDPSlot
 	if isUDP {
-		atomic.AddInt32(&c.UDPSlot, 1)
-	} else {
-		atomic.AddInt32(&c.TCPSlot, 1)
+		counter, other = other, counter
+	}
+	if atomic.AddInt32(counter, 1)+atomic.LoadInt32(other) > slotLimit && slotLimit > 0 {
+		releaseSlot(counter)
+		return false
 	}
 	return true
 }
 
-func (c *Common) ReleaseSlot(isUDP bool) {
-	if c.SlotLimit == 0 {
-		return
+func acquireSlot(counter *int32, limit int32) bool {
+	for {
+		current := atomic.LoadInt32(counter)
+		if limit > 0 && current >= limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(counter, current, current+1) {
+			return true
+		}
+	}
+}
+
+func releaseSlot(counter *int32) {
+	for {
+		current := atomic.LoadInt32(counter)
+		if current <= 0 || atomic.CompareAndSwapInt32(counter, current, current-1) {
+			return
+		}
 	}
+}
 
+func (c *Common) ReleaseSlot(isUDP bool) {
+	releaseSlot(&c.ActiveSlot)
 	if isUDP {
-		if current := atomic.LoadInt32(&c.UDPSlot); current > 0 {
-			atomic.AddInt32(&c.UDPSlot, -1)
-		}
+		releaseSlot(&c.UDPSlot)
 	} else {
-		if current := atomic.LoadInt32(&c.TCPSlot); current > 0 {
-			atomic.AddInt32(&c.TCPSlot, -1)
+		releaseSlot(&c.TCPSlot)
+	}
+}
+
+func (c *Common) SlotRefusal(isUDP bool) string {
+	switch {
+	case c.IsDraining():
+		return "draining, new session refused"
+	case isUDP:
+		return fmt.Sprintf("UDP slot limit reached: %v/%v", atomic.LoadInt32(&c.UDPSlot), c.UDPSlotLimit())
+	default:
+		return fmt.Sprintf("TCP slot limit reached: %v/%v", atomic.LoadInt32(&c.TCPSlot), c.Limits().SlotLimit)
+	}
+}
+
+func (c *Common) UDPSlotLimit() int32 {
+	if c.UDPLimit > 0 {
+		return c.UDPLimit
+	}
+	return c.Limits().SlotLimit
+}
+
+func (c *Common) UDPSessionTimeout(start time.Time) time.Duration {
+	timeout := c.UDPIdleTimeout
+	if c.UDPLifeTimeout > 0 {
+		remain := max(c.UDPLifeTimeout-time.Since(start), time.Millisecond)
+		if timeout == 0 || remain < timeout {
+			timeout = remain
+		}
+	}
+	return timeout
+}
+
+func (c *Common) EvictUDPSession(key string, start time.Time, err error) string {
+	reason := "closed"
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		if c.UDPLifeTimeout > 0 && time.Since(start) >= c.UDPLifeTimeout {
+			reason = "lifetime"
+			atomic.AddUint64(&c.UDPEvictLife, 1)
+		} else {
+			reason = "idle"
+			atomic.AddUint64(&c.UDPEvictIdle, 1)
 		}
+	} else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF && !errors.Is(err, net.ErrClosed) && c.Ctx.Err() == nil {
+		reason = "error"
+		atomic.AddUint64(&c.UDPEvictError, 1)
+	}
+
+	if reason == "closed" {
+		c.Logger.Debug("UDP session evicted: %v after %v (%v)", key, time.Since(start).Round(time.Millisecond), reason)
+	} else {
+		c.Logger.Info("UDP session evicted: %v after %v (%v)", key, time.Since(start).Round(time.Millisecond), reason)
 	}
+	return reason
 }
 
 func (c *Common) GetTCPRX() *uint64  { return &c.TCPRX }
@@ -71,3 +154,80 @@ func (c *Common) LoadTCPRX() uint64  { return atomic.LoadUint64(&c.TCPRX) }
 func (c *Common) LoadTCPTX() uint64  { return atomic.LoadUint64(&c.TCPTX) }
 func (c *Common) LoadUDPRX() uint64  { return atomic.LoadUint64(&c.UDPRX) }
 func (c *Common) LoadUDPTX() uint64  { return atomic.LoadUint64(&c.UDPTX) }
+
+type Stats struct {
+	TCPSlot       int32
+	UDPSlot       int32
+	ActiveSlot    int32
+	TCPRX         uint64
+	TCPTX         uint64
+	UDPRX         uint64
+	UDPTX         uint64
+	UDPEvictIdle  uint64
+	UDPEvictLife  uint64
+	UDPEvictError uint64
+	UDPDrop       uint64
+	TCPEndIdle    uint64
+	TCPEndLife    uint64
+	TCPEndBytes   uint64
+}
+
+func (s *Stats) Add(o Stats) {
+	s.TCPSlot += o.TCPSlot
+	s.UDPSlot += o.UDPSlot
+	s.ActiveSlot += o.ActiveSlot
+	s.TCPRX += o.TCPRX
+	s.TCPTX += o.TCPTX
+	s.UDPRX += o.UDPRX
+	s.UDPTX += o.UDPTX
+	s.UDPEvictIdle += o.UDPEvictIdle
+	s.UDPEvictLife += o.UDPEvictLife
+	s.UDPEvictError += o.UDPEvictError
+	s.UDPDrop += o.UDPDrop
+	s.TCPEndIdle += o.TCPEndIdle
+	s.TCPEndLife += o.TCPEndLife
+	s.TCPEndBytes += o.TCPEndBytes
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("TCPS=%v|UDPS=%v|TCPRX=%v|TCPTX=%v|UDPRX=%v|UDPTX=%v|UIDLE=%v|ULIFE=%v|UERR=%v|UDROP=%v|TIDLE=%v|TLIFE=%v|TMAX=%v",
+		s.TCPSlot, s.UDPSlot, s.TCPRX, s.TCPTX, s.UDPRX, s.UDPTX,
+		s.UDPEvictIdle, s.UDPEvictLife, s.UDPEvictError, s.UDPDrop, s.TCPEndIdle, s.TCPEndLife, s.TCPEndBytes)
+}
+
+func (c *Common) LoadStats() Stats {
+	return Stats{
+		TCPSlot:       atomic.LoadInt32(&c.TCPSlot),
+		UDPSlot:       atomic.LoadInt32(&c.UDPSlot),
+		ActiveSlot:    atomic.LoadInt32(&c.ActiveSlot),
+		TCPRX:         atomic.LoadUint64(&c.TCPRX),
+		TCPTX:         atomic.LoadUint64(&c.TCPTX),
+		UDPRX:         atomic.LoadUint64(&c.UDPRX),
+		UDPTX:         atomic.LoadUint64(&c.UDPTX),
+		UDPEvictIdle:  atomic.LoadUint64(&c.UDPEvictIdle),
+		UDPEvictLife:  atomic.LoadUint64(&c.UDPEvictLife),
+		UDPEvictError: atomic.LoadUint64(&c.UDPEvictError),
+		UDPDrop:       atomic.LoadUint64(&c.UDPDrop),
+		TCPEndIdle:    atomic.LoadUint64(&c.TCPEndIdle),
+		TCPEndLife:    atomic.LoadUint64(&c.TCPEndLife),
+		TCPEndBytes:   atomic.LoadUint64(&c.TCPEndBytes),
+	}
+}
+
+func (c *Common) MergeStats(s Stats) {
+	atomic.AddUint64(&c.TCPRX, s.TCPRX)
+	atomic.AddUint64(&c.TCPTX, s.TCPTX)
+	atomic.AddUint64(&c.UDPRX, s.UDPRX)
+	atomic.AddUint64(&c.UDPTX, s.UDPTX)
+	atomic.AddUint64(&c.UDPEvictIdle, s.UDPEvictIdle)
+	atomic.AddUint64(&c.UDPEvictLife, s.UDPEvictLife)
+	atomic.AddUint64(&c.UDPEvictError, s.UDPEvictError)
+	atomic.AddUint64(&c.UDPDrop, s.UDPDrop)
+	atomic.AddUint64(&c.TCPEndIdle, s.TCPEndIdle)
+	atomic.AddUint64(&c.TCPEndLife, s.TCPEndLife)
+	atomic.AddUint64(&c.TCPEndBytes, s.TCPEndBytes)
+}
+
+func (c *Common) CheckPointStats() string {
+	return c.LoadStats().String()
+}
@@ -0,0 +1,139 @@
+package common
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTryAcquireSlot(t *testing.T) {
+	tests := []struct {
+		name      string
+		slotLimit int32
+		udpLimit  int32
+		tcpSlot   int32
+		udpSlot   int32
+		isUDP     bool
+		want      bool
+	}{
+		{"unlimited", 0, 0, 100, 100, true, true},
+		{"shared below limit", 4, 0, 2, 1, true, true},
+		{"shared at limit udp", 4, 0, 2, 2, true, false},
+		{"shared at limit tcp", 4, 0, 3, 1, false, false},
+		{"udp cap below limit", 4, 2, 4, 1, true, true},
+		{"udp cap at limit", 4, 2, 0, 2, true, false},
+		{"udp cap leaves tcp on slot", 4, 2, 3, 2, false, true},
+		{"udp cap tcp at slot", 4, 2, 4, 0, false, false},
+		{"udp cap tcp unlimited", 0, 2, 1000, 2, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Common{SlotLimit: tt.slotLimit, UDPLimit: tt.udpLimit, TCPSlot: tt.tcpSlot, UDPSlot: tt.udpSlot}
+			if got := c.TryAcquireSlot(tt.isUDP); got != tt.want {
+				t.Fatalf("TryAcquireSlot(%v) = %v, want %v", tt.isUDP, got, tt.want)
+			}
+			if !tt.want && (c.TCPSlot != tt.tcpSlot || c.UDPSlot != tt.udpSlot) {
+				t.Fatalf("refused acquire changed counters: tcp %v udp %v", c.TCPSlot, c.UDPSlot)
+			}
+		})
+	}
+}
+
+func TestTryAcquireSlotConcurrent(t *testing.T) {
+	tests := []struct {
+		name      string
+		slotLimit int32
+		udpLimit  int32
+		limit     int32
+	}{
+		{"udp cap", 0, 8, 8},
+		{"shared slot", 8, 0, 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Common{SlotLimit: tt.slotLimit, UDPLimit: tt.udpLimit}
+
+			var acquired, peak int32
+			var wg sync.WaitGroup
+			for i := range 64 {
+				wg.Add(1)
+				go func(isUDP bool) {
+					defer wg.Done()
+					for range 200 {
+						if !c.TryAcquireSlot(isUDP) {
+							continue
+						}
+						current := atomic.AddInt32(&acquired, 1)
+						for {
+							old := atomic.LoadInt32(&peak)
+							if current <= old || atomic.CompareAndSwapInt32(&peak, old, current) {
+								break
+							}
+						}
+						atomic.AddInt32(&acquired, -1)
+						c.ReleaseSlot(isUDP)
+					}
+				}(tt.udpLimit > 0 || i%2 == 0)
+			}
+			wg.Wait()
+
+			if peak > tt.limit {
+				t.Fatalf("peak concurrent sessions %v exceeded limit %v", peak, tt.limit)
+			}
+			if c.TCPSlot != 0 || c.UDPSlot != 0 {
+				t.Fatalf("counters not released: tcp %v udp %v", c.TCPSlot, c.UDPSlot)
+			}
+		})
+	}
+}
+
+func TestReleaseSlotNeverNegative(t *testing.T) {
+	c := &Common{SlotLimit: 4}
+	c.ReleaseSlot(true)
+	c.ReleaseSlot(false)
+	if c.TCPSlot != 0 || c.UDPSlot != 0 {
+		t.Fatalf("counters went negative: tcp %v udp %v", c.TCPSlot, c.UDPSlot)
+	}
+}
+
+func TestActiveSessions(t *testing.T) {
+	tests := []struct {
+		name      string
+		slotLimit int32
+		udpLimit  int32
+	}{
+		{"unlimited", 0, 0},
+		{"shared slot", 8, 0},
+		{"udp cap", 0, 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Common{SlotLimit: tt.slotLimit, UDPLimit: tt.udpLimit}
+			c.TryAcquireSlot(false)
+			c.TryAcquireSlot(true)
+			if got := c.ActiveSessions(); got != 2 {
+				t.Fatalf("ActiveSessions = %v after two acquires, want 2", got)
+			}
+			c.ReleaseSlot(false)
+			c.ReleaseSlot(true)
+			c.ReleaseSlot(true)
+			if got := c.ActiveSessions(); got != 0 {
+				t.Fatalf("ActiveSessions = %v after release, want 0", got)
+			}
+		})
+	}
+}
+
+func TestActiveSessionsDraining(t *testing.T) {
+	c := &Common{}
+	c.DrainStart.Store(1)
+	if c.TryAcquireSlot(false) {
+		t.Fatal("TryAcquireSlot accepted a session while draining")
+	}
+	if got := c.ActiveSessions(); got != 0 {
+		t.Fatalf("ActiveSessions = %v after a refused acquire, want 0", got)
+	}
+}
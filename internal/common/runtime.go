@@ -4,13 +4,14 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/NodePassProject/conn"
 )
 
 func (c *Common) InitRateLimiter() {
 	if c.RateLimit > 0 {
-		c.RateLimiter = conn.NewRateLimiter(int64(c.RateLimit), int64(c.RateLimit))
+		c.RateLimiter.Store(conn.NewRateLimiter(int64(c.RateLimit), int64(c.RateLimit)))
 	}
 }
 
@@ -19,6 +20,7 @@ func (c *Common) InitContext() {
 		c.Cancel()
 	}
 	c.Ctx, c.Cancel = context.WithCancel(context.Background())
+	c.PeerBye = ""
 }
 
 func (c *Common) InitTunnelListener() error {
@@ -27,7 +29,7 @@ func (c *Common) InitTunnelListener() error {
 	}
 
 	if c.TunnelTCPAddr != nil && (c.DisableTCP != "1" || c.CoreType != "client") {
-		tunnelListener, err := net.ListenTCP("tcp", c.TunnelTCPAddr)
+		tunnelListener, err := HoldTCP(&c.TunnelHold, c.TunnelTCPAddr)
 		if err != nil {
 			return fmt.Errorf("InitTunnelListener: listenTCP failed: %w", err)
 		}
@@ -35,11 +37,17 @@ func (c *Common) InitTunnelListener() error {
 	}
 
 	if c.TunnelUDPAddr != nil && (c.DisableUDP != "1" || c.CoreType != "client") {
-		tunnelUDPConn, err := net.ListenUDP("udp", c.TunnelUDPAddr)
+		var tunnelUDPConn *net.UDPConn
+		var err error
+		if c.CoreType == "client" {
+			tunnelUDPConn, err = HoldUDP(&c.TunnelUDPHold, c.TunnelUDPAddr)
+		} else {
+			tunnelUDPConn, err = net.ListenUDP("udp", c.TunnelUDPAddr)
+		}
 		if err != nil {
 			return fmt.Errorf("InitTunnelListener: listenUDP failed: %w", err)
 		}
-		c.TunnelUDPConn = &conn.StatConn{Conn: tunnelUDPConn, RX: &c.UDPRX, TX: &c.UDPTX, Rate: c.RateLimiter}
+		c.TunnelUDPConn = &conn.StatConn{Conn: tunnelUDPConn, RX: &c.UDPRX, TX: &c.UDPTX, Rate: c.RateLimiter.Load()}
 	}
 
 	return nil
@@ -51,7 +59,7 @@ func (c *Common) InitTargetListener() error {
 	}
 
 	if len(c.TargetTCPAddrs) > 0 && c.DisableTCP != "1" {
-		targetListener, err := net.ListenTCP("tcp", c.TargetTCPAddrs[0])
+		targetListener, err := HoldTCP(&c.TargetHold, c.TargetTCPAddrs[0])
 		if err != nil {
 			return fmt.Errorf("InitTargetListener: listenTCP failed: %w", err)
 		}
@@ -59,11 +67,11 @@ func (c *Common) InitTargetListener() error {
 	}
 
 	if len(c.TargetUDPAddrs) > 0 && c.DisableUDP != "1" {
-		targetUDPConn, err := net.ListenUDP("udp", c.TargetUDPAddrs[0])
+		targetUDPConn, err := HoldUDP(&c.TargetUDPHold, c.TargetUDPAddrs[0])
 		if err != nil {
 			return fmt.Errorf("InitTargetListener: listenUDP failed: %w", err)
 		}
-		c.TargetUDPConn = &conn.StatConn{Conn: targetUDPConn, RX: &c.UDPRX, TX: &c.UDPTX, Rate: c.RateLimiter}
+		c.TargetUDPConn = &conn.StatConn{Conn: targetUDPConn, RX: &c.UDPRX, TX: &c.UDPTX, Rate: c.RateLimiter.Load()}
 	}
 
 	return nil
@@ -80,6 +88,36 @@ func (c *Common) Stop() {
 		c.Logger.Debug("Tunnel connection closed: pool active %v", active)
 	}
 
+	if quicConn := c.DatagramConn.Swap(nil); quicConn != nil {
+		quicConn.CloseWithError(0, "stopped")
+		c.Logger.Debug("Datagram connection closed: %v", quicConn.RemoteAddr())
+	}
+
+	if c.DatagramListener != nil {
+		c.DatagramListener.Close()
+		c.Logger.Debug("Datagram listener closed: %v", c.DatagramListener.Addr())
+		c.DatagramListener = nil
+	}
+
+	c.DatagramSessions.Range(func(key, value any) bool {
+		c.CloseDatagramSession(value.(*DatagramSession))
+		return true
+	})
+
+	c.MuxLock.Lock()
+	for _, channel := range c.MuxChannels {
+		if channel != nil {
+			channel.Close()
+		}
+	}
+	c.MuxChannels = nil
+	c.MuxLock.Unlock()
+
+	c.MuxSessions.Range(func(key, value any) bool {
+		c.closeMuxSession(value.(*MuxSession), false)
+		return true
+	})
+
 	c.TargetUDPSession.Range(func(key, value any) bool {
 		if conn, ok := value.(*net.UDPConn); ok {
 			conn.Close()
@@ -88,20 +126,32 @@ func (c *Common) Stop() {
 		return true
 	})
 
-	if c.TargetUDPConn != nil {
+	if c.TargetUDPHold != nil {
+		c.TargetUDPHold.SetReadDeadline(time.Now())
+		c.Logger.Debug("Target connection held: %v", c.TargetUDPHold.LocalAddr())
+	} else if c.TargetUDPConn != nil {
 		c.TargetUDPConn.Close()
 		c.Logger.Debug("Target connection closed: %v", c.TargetUDPConn.LocalAddr())
 	}
 
-	if c.TunnelUDPConn != nil {
+	if c.TunnelUDPHold != nil {
+		c.TunnelUDPHold.SetReadDeadline(time.Now())
+		c.Logger.Debug("Tunnel connection held: %v", c.TunnelUDPHold.LocalAddr())
+	} else if c.TunnelUDPConn != nil {
 		c.TunnelUDPConn.Close()
 		c.Logger.Debug("Tunnel connection closed: %v", c.TunnelUDPConn.LocalAddr())
 	}
 
+	c.ControlLock.Lock()
 	if c.ControlConn != nil {
 		c.ControlConn.Close()
 		c.Logger.Debug("Control connection closed: %v", c.ControlConn.LocalAddr())
 	}
+	if c.StandbyConn != nil {
+		c.StandbyConn.Close()
+		c.StandbyConn = nil
+	}
+	c.ControlLock.Unlock()
 
 	if c.TargetListener != nil {
 		c.TargetListener.Close()
@@ -117,8 +167,8 @@ func (c *Common) Stop() {
 	Drain(c.WriteChan)
 	Drain(c.VerifyChan)
 
-	if c.RateLimiter != nil {
-		c.RateLimiter.Reset()
+	if rateLimiter := c.RateLimiter.Load(); rateLimiter != nil {
+		rateLimiter.Reset()
 	}
 
 	c.ClearCache()
@@ -1,9 +1,9 @@
 package common
 
 import (
+	"errors"
 	"fmt"
 	"net"
-	"sync/atomic"
 	"time"
 
 	"github.com/NodePassProject/conn"
@@ -14,10 +14,7 @@ func (c *Common) SingleEventLoop() error {
 	defer ticker.Stop()
 
 	for c.Ctx.Err() == nil {
-		c.Logger.Event("CHECK_POINT|MODE=%v|PING=%vms|POOL=0|TCPS=%v|UDPS=%v|TCPRX=%v|TCPTX=%v|UDPRX=%v|UDPTX=%v", c.RunMode, c.ProbeBestTarget(),
-			atomic.LoadInt32(&c.TCPSlot), atomic.LoadInt32(&c.UDPSlot),
-			atomic.LoadUint64(&c.TCPRX), atomic.LoadUint64(&c.TCPTX),
-			atomic.LoadUint64(&c.UDPRX), atomic.LoadUint64(&c.UDPTX))
+		c.Logger.Event("CHECK_POINT|MODE=%v|PING=%vms|POOL=0|%v%v%v", c.RunMode, c.ProbeBestTarget(), c.CheckPointStats(), c.DrainPoint(), c.BackoffPoint())
 
 		select {
 		case <-c.Ctx.Done():
@@ -46,7 +43,7 @@ func (c *Common) SingleTCPLoop() error {
 			continue
 		}
 
-		tunnelConn = &conn.StatConn{Conn: tunnelConn, RX: &c.TCPRX, TX: &c.TCPTX, Rate: c.RateLimiter}
+		tunnelConn = &conn.StatConn{Conn: tunnelConn, RX: &c.TCPRX, TX: &c.TCPTX, Rate: c.RateLimiter.Load()}
 		c.Logger.Debug("Tunnel connection: %v <-> %v", tunnelConn.LocalAddr(), tunnelConn.RemoteAddr())
 
 		go func(tunnelConn net.Conn) {
@@ -57,7 +54,7 @@ func (c *Common) SingleTCPLoop() error {
 			}()
 
 			if !c.TryAcquireSlot(false) {
-				c.Logger.Error("SingleTCPLoop: TCP slot limit reached: %v/%v", c.TCPSlot, c.SlotLimit)
+				c.Logger.Error("SingleTCPLoop: %v", c.SlotRefusal(false))
 				return
 			}
 
@@ -97,7 +94,8 @@ func (c *Common) SingleTCPLoop() error {
 			}()
 
 			c.Logger.Info("Starting exchange: %v <-> %v", tunnelConn.RemoteAddr(), targetConn.RemoteAddr())
-			c.Logger.Info("Exchange complete: %v", conn.DataExchange(tunnelConn, targetConn, c.ReadTimeout, buffer1, buffer2))
+			reason, err := c.ExchangeData(tunnelConn, targetConn, buffer1, buffer2)
+			c.Logger.Info("Exchange complete: %v (%v)", err, reason)
 		}(tunnelConn)
 	}
 
@@ -105,112 +103,120 @@ func (c *Common) SingleTCPLoop() error {
 }
 
 func (c *Common) SingleUDPLoop() error {
+	batch, err := c.NewUDPBatch(c.TunnelUDPConn, c.singleUDPPacket)
+	if err != nil {
+		return fmt.Errorf("SingleUDPLoop: %w", err)
+	}
+	c.TunnelUDPBatch = batch
+
 	for c.Ctx.Err() == nil {
-		buffer := c.GetUDPBuffer()
+		select {
+		case err := <-batch.Errors:
+			return err
+		default:
+		}
 
-		x, clientAddr, err := c.TunnelUDPConn.ReadFromUDP(buffer)
-		if err != nil {
-			if c.Ctx.Err() != nil || err == net.ErrClosed {
-				c.PutUDPBuffer(buffer)
+		if err := batch.Dispatch(); err != nil {
+			if c.Ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
 				return fmt.Errorf("SingleUDPLoop: context error: %w", c.Ctx.Err())
 			}
-			c.Logger.Error("SingleUDPLoop: ReadFromUDP failed: %v", err)
+			c.Logger.Error("SingleUDPLoop: readBatch failed: %v", err)
 
-			c.PutUDPBuffer(buffer)
 			select {
 			case <-c.Ctx.Done():
 				return fmt.Errorf("SingleUDPLoop: context error: %w", c.Ctx.Err())
 			case <-time.After(ContextCheckInterval):
 			}
-			continue
 		}
+	}
 
-		c.Logger.Debug("Tunnel connection: %v <-> %v", c.TunnelUDPConn.LocalAddr(), clientAddr)
+	return fmt.Errorf("SingleUDPLoop: context error: %w", c.Ctx.Err())
+}
 
-		var targetConn net.Conn
-		sessionKey := clientAddr.String()
+func (c *Common) singleUDPPacket(buffer []byte, x int, clientAddr *net.UDPAddr) error {
+	defer c.PutUDPBuffer(buffer)
 
-		if session, ok := c.TargetUDPSession.Load(sessionKey); ok {
-			targetConn = session.(net.Conn)
-			c.Logger.Debug("Using UDP session: %v <-> %v", targetConn.LocalAddr(), targetConn.RemoteAddr())
-		} else {
-			if !c.TryAcquireSlot(true) {
-				c.Logger.Error("SingleUDPLoop: UDP slot limit reached: %v/%v", c.UDPSlot, c.SlotLimit)
-				c.PutUDPBuffer(buffer)
-				continue
-			}
+	c.Logger.Debug("Tunnel connection: %v <-> %v", c.TunnelUDPConn.LocalAddr(), clientAddr)
 
-			newSession, err := c.DialWithRotation("udp", UDPDialTimeout)
-			if err != nil {
-				c.Logger.Error("SingleUDPLoop: dialWithRotation failed: %v", err)
+	var targetConn net.Conn
+	sessionKey := clientAddr.String()
+
+	if session, ok := c.TargetUDPSession.Load(sessionKey); ok {
+		targetConn = session.(net.Conn)
+		c.Logger.Debug("Using UDP session: %v <-> %v", targetConn.LocalAddr(), targetConn.RemoteAddr())
+	} else {
+		if !c.TryAcquireSlot(true) {
+			c.Logger.Error("SingleUDPLoop: %v", c.SlotRefusal(true))
+			return nil
+		}
+
+		newSession, err := c.DialWithRotation("udp", UDPDialTimeout)
+		if err != nil {
+			c.Logger.Error("SingleUDPLoop: dialWithRotation failed: %v", err)
+			c.ReleaseSlot(true)
+			return nil
+		}
+		targetConn = newSession
+		c.TargetUDPSession.Store(sessionKey, newSession)
+		c.Logger.Debug("Target connection: %v <-> %v", targetConn.LocalAddr(), targetConn.RemoteAddr())
+
+		go func(targetConn net.Conn, clientAddr *net.UDPAddr, sessionKey string) {
+			defer func() {
+				if targetConn != nil {
+					targetConn.Close()
+				}
 				c.ReleaseSlot(true)
-				c.PutUDPBuffer(buffer)
-				continue
-			}
-			targetConn = newSession
-			c.TargetUDPSession.Store(sessionKey, newSession)
-			c.Logger.Debug("Target connection: %v <-> %v", targetConn.LocalAddr(), targetConn.RemoteAddr())
+			}()
+
+			buffer := c.GetUDPBuffer()
+			defer c.PutUDPBuffer(buffer)
+			start := time.Now()
 
-			go func(targetConn net.Conn, clientAddr *net.UDPAddr, sessionKey string) {
-				defer func() {
+			for c.Ctx.Err() == nil {
+				if timeout := c.UDPSessionTimeout(start); timeout > 0 {
+					targetConn.SetReadDeadline(time.Now().Add(timeout))
+				}
+				x, err := targetConn.Read(buffer)
+				if err != nil {
+					if c.EvictUDPSession(sessionKey, start, err) == "error" {
+						c.Logger.Error("SingleUDPLoop: read from target failed: %v", err)
+					}
+					c.TargetUDPSession.Delete(sessionKey)
 					if targetConn != nil {
 						targetConn.Close()
 					}
-					c.ReleaseSlot(true)
-				}()
-
-				buffer := c.GetUDPBuffer()
-				defer c.PutUDPBuffer(buffer)
-				reader := &conn.TimeoutReader{Conn: targetConn, Timeout: UDPReadTimeout}
-
-				for c.Ctx.Err() == nil {
-					x, err := reader.Read(buffer)
-					if err != nil {
-						if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-							c.Logger.Debug("UDP session abort: %v", err)
-						} else if err.Error() != "EOF" {
-							c.Logger.Error("SingleUDPLoop: read from target failed: %v", err)
-						}
-						c.TargetUDPSession.Delete(sessionKey)
-						if targetConn != nil {
-							targetConn.Close()
-						}
-						return
-					}
+					return
+				}
 
-					_, err = c.TunnelUDPConn.WriteToUDP(buffer[:x], clientAddr)
-					if err != nil {
-						if err.Error() != "EOF" {
-							c.Logger.Error("SingleUDPLoop: writeToUDP failed: %v", err)
-						}
-						c.TargetUDPSession.Delete(sessionKey)
-						if targetConn != nil {
-							targetConn.Close()
-						}
-						return
+				_, err = c.TunnelUDPBatch.WriteToUDP(buffer[:x], clientAddr)
+				if err != nil {
+					if err.Error() != "EOF" {
+						c.Logger.Error("SingleUDPLoop: writeToUDP failed: %v", err)
 					}
-					c.Logger.Debug("Transfer complete: %v <-> %v", c.TunnelUDPConn.LocalAddr(), targetConn.LocalAddr())
+					c.TargetUDPSession.Delete(sessionKey)
+					if targetConn != nil {
+						targetConn.Close()
+					}
+					return
 				}
-			}(targetConn, clientAddr, sessionKey)
-		}
-
-		c.Logger.Debug("Starting transfer: %v <-> %v", targetConn.LocalAddr(), c.TunnelUDPConn.LocalAddr())
-		_, err = targetConn.Write(buffer[:x])
-		if err != nil {
-			if err.Error() != "EOF" {
-				c.Logger.Error("SingleUDPLoop: write to target failed: %v", err)
-			}
-			c.TargetUDPSession.Delete(sessionKey)
-			if targetConn != nil {
-				targetConn.Close()
+				c.Logger.Debug("Transfer complete: %v <-> %v", c.TunnelUDPConn.LocalAddr(), targetConn.LocalAddr())
 			}
-			c.PutUDPBuffer(buffer)
-			return fmt.Errorf("SingleUDPLoop: write to target failed: %w", err)
-		}
+		}(targetConn, clientAddr, sessionKey)
+	}
 
-		c.Logger.Debug("Transfer complete: %v <-> %v", targetConn.LocalAddr(), c.TunnelUDPConn.LocalAddr())
-		c.PutUDPBuffer(buffer)
+	c.Logger.Debug("Starting transfer: %v <-> %v", targetConn.LocalAddr(), c.TunnelUDPConn.LocalAddr())
+	_, err := targetConn.Write(buffer[:x])
+	if err != nil {
+		if err.Error() != "EOF" {
+			c.Logger.Error("SingleUDPLoop: write to target failed: %v", err)
+		}
+		c.TargetUDPSession.Delete(sessionKey)
+		if targetConn != nil {
+			targetConn.Close()
+		}
+		return fmt.Errorf("SingleUDPLoop: write to target failed: %w", err)
 	}
 
-	return fmt.Errorf("SingleUDPLoop: context error: %w", c.Ctx.Err())
+	c.Logger.Debug("Transfer complete: %v <-> %v", targetConn.LocalAddr(), c.TunnelUDPConn.LocalAddr())
+	return nil
 }
@@ -2,6 +2,7 @@ package common
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -25,7 +26,7 @@ func (c *Common) TunnelLoop() {
 			if c.TargetListener != nil || c.DisableTCP != "1" {
 				go c.TunnelTCPLoop()
 			}
-			if c.TargetUDPConn != nil || c.DisableUDP != "1" {
+			if c.Parent == nil && (c.TargetUDPConn != nil || c.DisableUDP != "1") {
 				go c.TunnelUDPLoop()
 			}
 			return
@@ -56,7 +57,7 @@ func (c *Common) TunnelTCPLoop() {
 			continue
 		}
 
-		targetConn = &conn.StatConn{Conn: targetConn, RX: &c.TCPRX, TX: &c.TCPTX, Rate: c.RateLimiter}
+		targetConn = &conn.StatConn{Conn: targetConn, RX: &c.TCPRX, TX: &c.TCPTX, Rate: c.RateLimiter.Load()}
 		c.Logger.Debug("Target connection: %v <-> %v", targetConn.LocalAddr(), targetConn.RemoteAddr())
 
 		go func(targetConn net.Conn) {
@@ -67,7 +68,7 @@ func (c *Common) TunnelTCPLoop() {
 			}()
 
 			if !c.TryAcquireSlot(false) {
-				c.Logger.Error("TunnelTCPLoop: TCP slot limit reached: %v/%v", c.TCPSlot, c.SlotLimit)
+				c.Logger.Error("TunnelTCPLoop: %v", c.SlotRefusal(false))
 				return
 			}
 			defer c.ReleaseSlot(false)
@@ -102,7 +103,9 @@ func (c *Common) TunnelTCPLoop() {
 					RemoteAddr: targetConn.RemoteAddr().String(),
 					PoolConnID: id,
 				})
-				c.WriteChan <- c.Encode(signalData)
+				if err := c.QueueSignal(signalData); err != nil {
+					c.Logger.Error("TunnelTCPLoop: %v", err)
+				}
 			}
 
 			c.Logger.Debug("TCP launch signal: cid %v -> %v", id, c.ControlConn.RemoteAddr())
@@ -115,121 +118,140 @@ func (c *Common) TunnelTCPLoop() {
 			}()
 
 			c.Logger.Info("Starting exchange: %v <-> %v", targetConn.RemoteAddr(), remoteConn.RemoteAddr())
-			c.Logger.Info("Exchange complete: %v", conn.DataExchange(targetConn, remoteConn, c.ReadTimeout, buffer1, buffer2))
+			reason, err := c.ExchangeData(targetConn, remoteConn, buffer1, buffer2)
+			c.Logger.Info("Exchange complete: %v (%v)", err, reason)
 		}(targetConn)
 	}
 }
 
 func (c *Common) TunnelUDPLoop() {
-	for c.Ctx.Err() == nil {
-		buffer := c.GetUDPBuffer()
+	if c.UDPMux > 0 {
+		c.MuxLock.Lock()
+		c.MuxChannels = make([]*MuxChannel, c.UDPMux)
+		c.MuxLock.Unlock()
+	}
 
-		x, clientAddr, err := c.TargetUDPConn.ReadFromUDP(buffer)
-		if err != nil {
-			if c.Ctx.Err() != nil || err == net.ErrClosed {
-				c.PutUDPBuffer(buffer)
+	batch, err := c.NewUDPBatch(c.TargetUDPConn, c.TunnelUDPPacket)
+	if err != nil {
+		c.Logger.Error("TunnelUDPLoop: %v", err)
+		return
+	}
+	c.TargetUDPBatch = batch
+
+	for c.Ctx.Err() == nil {
+		if err := batch.Dispatch(); err != nil {
+			if c.Ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
 				return
 			}
-			c.Logger.Error("TunnelUDPLoop: readFromUDP failed: %v", err)
-			c.PutUDPBuffer(buffer)
+			c.Logger.Error("TunnelUDPLoop: readBatch failed: %v", err)
 
 			select {
 			case <-c.Ctx.Done():
 				return
 			case <-time.After(ContextCheckInterval):
 			}
-			continue
 		}
+	}
+}
 
-		c.Logger.Debug("Target connection: %v <-> %v", c.TargetUDPConn.LocalAddr(), clientAddr)
+func (c *Common) TunnelUDPPacket(buffer []byte, x int, clientAddr *net.UDPAddr) error {
+	defer c.PutUDPBuffer(buffer)
 
-		var id string
-		var remoteConn net.Conn
-		sessionKey := clientAddr.String()
+	c.Logger.Debug("Target connection: %v <-> %v", c.TargetUDPConn.LocalAddr(), clientAddr)
 
-		if session, ok := c.TargetUDPSession.Load(sessionKey); ok {
-			remoteConn = session.(net.Conn)
-			c.Logger.Debug("Using UDP session: %v <-> %v", remoteConn.LocalAddr(), remoteConn.RemoteAddr())
-		} else {
-			if !c.TryAcquireSlot(true) {
-				c.Logger.Error("TunnelUDPLoop: UDP slot limit reached: %v/%v", c.UDPSlot, c.SlotLimit)
-				c.PutUDPBuffer(buffer)
-				continue
-			}
+	if c.UDPMux > 0 {
+		c.TunnelMuxPacket(clientAddr, buffer[:x])
+		return nil
+	}
 
-			id, remoteConn, err = c.TunnelPool.IncomingGet(PoolGetTimeout)
-			if err != nil {
-				c.Logger.Warn("TunnelUDPLoop: request timeout: %v", err)
+	var id string
+	var remoteConn net.Conn
+	sessionKey := clientAddr.String()
+
+	if session, ok := c.TargetUDPSession.Load(sessionKey); ok {
+		remoteConn = session.(net.Conn)
+		c.Logger.Debug("Using UDP session: %v <-> %v", remoteConn.LocalAddr(), remoteConn.RemoteAddr())
+	} else {
+		if !c.TryAcquireSlot(true) {
+			c.Logger.Error("TunnelUDPLoop: %v", c.SlotRefusal(true))
+			return nil
+		}
+
+		var err error
+		id, remoteConn, err = c.TunnelPool.IncomingGet(PoolGetTimeout)
+		if err != nil {
+			c.Logger.Warn("TunnelUDPLoop: request timeout: %v", err)
+			c.ReleaseSlot(true)
+			return nil
+		}
+		session := c.NewDatagramSession(id, remoteConn)
+		remoteConn = &SessionConn{Conn: remoteConn, Session: session}
+		c.TargetUDPSession.Store(sessionKey, remoteConn)
+		c.Logger.Debug("Tunnel connection: get %v <- pool active %v", id, c.TunnelPool.Active())
+		c.Logger.Debug("Tunnel connection: %v <-> %v", remoteConn.LocalAddr(), remoteConn.RemoteAddr())
+
+		go func(remoteConn net.Conn, session *DatagramSession, clientAddr *net.UDPAddr, sessionKey, id string) {
+			defer func() {
+				c.TargetUDPSession.Delete(sessionKey)
+				c.CloseDatagramSession(session)
 				c.ReleaseSlot(true)
-				c.PutUDPBuffer(buffer)
-				continue
-			}
-			c.TargetUDPSession.Store(sessionKey, remoteConn)
-			c.Logger.Debug("Tunnel connection: get %v <- pool active %v", id, c.TunnelPool.Active())
-			c.Logger.Debug("Tunnel connection: %v <-> %v", remoteConn.LocalAddr(), remoteConn.RemoteAddr())
 
-			go func(remoteConn net.Conn, clientAddr *net.UDPAddr, sessionKey, id string) {
-				defer func() {
-					c.TargetUDPSession.Delete(sessionKey)
-					c.ReleaseSlot(true)
+				if remoteConn != nil {
+					remoteConn.Close()
+					c.Logger.Debug("Tunnel connection: closed %v", id)
+				}
+			}()
 
-					if remoteConn != nil {
-						remoteConn.Close()
-						c.Logger.Debug("Tunnel connection: closed %v", id)
-					}
-				}()
+			buffer := c.GetUDPBuffer()
+			defer c.PutUDPBuffer(buffer)
+			start := time.Now()
 
-				buffer := c.GetUDPBuffer()
-				defer c.PutUDPBuffer(buffer)
-
-				for c.Ctx.Err() == nil {
-					x, err := readUDPFrame(remoteConn, buffer, UDPReadTimeout)
-					if err != nil {
-						if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-							c.Logger.Debug("UDP session abort: %v", err)
-						} else if err != io.EOF && err != io.ErrUnexpectedEOF {
-							c.Logger.Error("TunnelUDPLoop: read from tunnel failed: %v", err)
-						}
-						return
+			for c.Ctx.Err() == nil {
+				x, err := c.readUDPPacket(session, remoteConn, buffer, c.UDPSessionTimeout(start))
+				if err != nil {
+					if c.EvictUDPSession(sessionKey, start, err) == "error" {
+						c.Logger.Error("TunnelUDPLoop: read from tunnel failed: %v", err)
 					}
+					return
+				}
 
-					_, err = c.TargetUDPConn.WriteToUDP(buffer[:x], clientAddr)
-					if err != nil {
-						if err != io.EOF {
-							c.Logger.Error("TunnelUDPLoop: writeToUDP failed: %v", err)
-						}
-						return
+				_, err = c.TargetUDPBatch.WriteToUDP(buffer[:x], clientAddr)
+				if err != nil {
+					if err != io.EOF {
+						c.Logger.Error("TunnelUDPLoop: writeToUDP failed: %v", err)
 					}
-					c.Logger.Debug("Transfer complete: %v <-> %v", remoteConn.LocalAddr(), c.TargetUDPConn.LocalAddr())
+					return
 				}
-			}(remoteConn, clientAddr, sessionKey, id)
-
-			if c.Ctx.Err() == nil && c.ControlConn != nil {
-				signalData, _ := json.Marshal(Signal{
-					ActionType: "udp",
-					RemoteAddr: clientAddr.String(),
-					PoolConnID: id,
-				})
-				c.WriteChan <- c.Encode(signalData)
+				c.Logger.Debug("Transfer complete: %v <-> %v", remoteConn.LocalAddr(), c.TargetUDPConn.LocalAddr())
 			}
-
-			c.Logger.Debug("UDP launch signal: cid %v -> %v", id, c.ControlConn.RemoteAddr())
-			c.Logger.Debug("Starting transfer: %v <-> %v", remoteConn.LocalAddr(), c.TargetUDPConn.LocalAddr())
-		}
-
-		if err = writeUDPFrame(remoteConn, buffer[:x]); err != nil {
-			if err != io.EOF {
-				c.Logger.Error("TunnelUDPLoop: write to tunnel failed: %v", err)
+		}(remoteConn, session, clientAddr, sessionKey, id)
+
+		if c.Ctx.Err() == nil && c.ControlConn != nil {
+			signalData, _ := json.Marshal(Signal{
+				ActionType: "udp",
+				RemoteAddr: clientAddr.String(),
+				PoolConnID: id,
+			})
+			if err := c.QueueSignal(signalData); err != nil {
+				c.Logger.Error("TunnelUDPPacket: %v", err)
 			}
-			c.TargetUDPSession.Delete(sessionKey)
-			remoteConn.Close()
-			c.PutUDPBuffer(buffer)
-			continue
 		}
 
-		c.Logger.Debug("Transfer complete: %v <-> %v", remoteConn.LocalAddr(), c.TargetUDPConn.LocalAddr())
-		c.PutUDPBuffer(buffer)
+		c.Logger.Debug("UDP launch signal: cid %v -> %v", id, c.ControlConn.RemoteAddr())
+		c.Logger.Debug("Starting transfer: %v <-> %v", remoteConn.LocalAddr(), c.TargetUDPConn.LocalAddr())
+	}
+
+	if err := c.writeUDPPacket(SessionOf(remoteConn), remoteConn, buffer[:x]); err != nil {
+		if err != io.EOF {
+			c.Logger.Error("TunnelUDPLoop: write to tunnel failed: %v", err)
+		}
+		c.TargetUDPSession.Delete(sessionKey)
+		remoteConn.Close()
+		return nil
 	}
+
+	c.Logger.Debug("Transfer complete: %v <-> %v", remoteConn.LocalAddr(), c.TargetUDPConn.LocalAddr())
+	return nil
 }
 
 func (c *Common) CommonOnce() error {
@@ -260,6 +282,12 @@ func (c *Common) CommonOnce() error {
 				if c.DisableUDP != "1" {
 					go c.TunnelUDPOnce(signal)
 				}
+			case "umux":
+				if c.DisableUDP != "1" {
+					go c.MuxAccept(signal)
+				}
+			case "uclose":
+				c.CloseMuxSession(signal)
 			case "flush":
 				go func() {
 					c.TunnelPool.Flush()
@@ -273,18 +301,35 @@ func (c *Common) CommonOnce() error {
 
 					c.Logger.Debug("Tunnel pool flushed: %v active connections", c.TunnelPool.Active())
 				}()
+			case "standby":
+				go c.AcceptStandby(signal)
+			case "policy":
+				if c.CoreType == "client" {
+					c.ApplyPolicy(signal.Policy)
+				}
+			case "rekey":
+				if c.CoreType == "client" {
+					c.ApplyRekey(signal.Key)
+				}
 			case "ping":
 				if c.Ctx.Err() == nil && c.ControlConn != nil {
 					signalData, _ := json.Marshal(Signal{ActionType: "pong"})
-					c.WriteChan <- c.Encode(signalData)
+					if err := c.QueueSignal(signalData); err != nil {
+						c.Logger.Error("CommonOnce: %v", err)
+					}
 				}
 			case "pong":
-				c.Logger.Event("CHECK_POINT|MODE=%v|PING=%vms|POOL=%v|TCPS=%v|UDPS=%v|TCPRX=%v|TCPTX=%v|UDPRX=%v|UDPTX=%v",
-					c.RunMode, time.Since(c.CheckPoint).Milliseconds(), c.TunnelPool.Active(),
-					atomic.LoadInt32(&c.TCPSlot), atomic.LoadInt32(&c.UDPSlot),
-					atomic.LoadUint64(&c.TCPRX), atomic.LoadUint64(&c.TCPTX),
-					atomic.LoadUint64(&c.UDPRX), atomic.LoadUint64(&c.UDPTX))
+				ping := time.Since(c.CheckPoint).Milliseconds()
+				atomic.StoreInt64(&c.LastPing, ping)
+				if c.Parent != nil {
+					c.Logger.Event("CLIENT_POINT|CLIENT=%v|PING=%vms|POOL=%v|%v",
+						c.ClientIP, ping, c.TunnelPool.Active(), c.CheckPointStats())
+				} else {
+					c.Logger.Event("CHECK_POINT|MODE=%v|PING=%vms|POOL=%v|%v%v%v",
+						c.RunMode, ping, c.TunnelPool.Active(), c.CheckPointStats(), c.DrainPoint(), c.BackoffPoint())
+				}
 			default:
+				c.Logger.Warn("CommonOnce: unsupported signal: %v", signal.ActionType)
 			}
 		}
 	}
@@ -315,7 +360,7 @@ func (c *Common) TunnelTCPOnce(signal Signal) {
 	c.Logger.Debug("Tunnel connection: %v <-> %v", remoteConn.LocalAddr(), remoteConn.RemoteAddr())
 
 	if !c.TryAcquireSlot(false) {
-		c.Logger.Error("TunnelTCPOnce: TCP slot limit reached: %v/%v", c.TCPSlot, c.SlotLimit)
+		c.Logger.Error("TunnelTCPOnce: %v", c.SlotRefusal(false))
 		return
 	}
 
@@ -333,7 +378,7 @@ func (c *Common) TunnelTCPOnce(signal Signal) {
 		}
 	}()
 
-	targetConn = &conn.StatConn{Conn: targetConn, RX: &c.TCPRX, TX: &c.TCPTX, Rate: c.RateLimiter}
+	targetConn = &conn.StatConn{Conn: targetConn, RX: &c.TCPRX, TX: &c.TCPTX, Rate: c.RateLimiter.Load()}
 	c.Logger.Debug("Target connection: %v <-> %v", targetConn.LocalAddr(), targetConn.RemoteAddr())
 
 	if err := c.SendProxyV1Header(signal.RemoteAddr, targetConn); err != nil {
@@ -349,7 +394,8 @@ func (c *Common) TunnelTCPOnce(signal Signal) {
 	}()
 
 	c.Logger.Info("Starting exchange: %v <-> %v", remoteConn.RemoteAddr(), targetConn.RemoteAddr())
-	c.Logger.Info("Exchange complete: %v", conn.DataExchange(remoteConn, targetConn, c.ReadTimeout, buffer1, buffer2))
+	reason, err := c.ExchangeData(remoteConn, targetConn, buffer1, buffer2)
+	c.Logger.Info("Exchange complete: %v (%v)", err, reason)
 }
 
 func (c *Common) TunnelUDPOnce(signal Signal) {
@@ -384,7 +430,7 @@ func (c *Common) TunnelUDPOnce(signal Signal) {
 		isNewSession = true
 
 		if !c.TryAcquireSlot(true) {
-			c.Logger.Error("TunnelUDPOnce: UDP slot limit reached: %v/%v", c.UDPSlot, c.SlotLimit)
+			c.Logger.Error("TunnelUDPOnce: %v", c.SlotRefusal(true))
 			return
 		}
 
@@ -394,7 +440,7 @@ func (c *Common) TunnelUDPOnce(signal Signal) {
 			c.ReleaseSlot(true)
 			return
 		}
-		targetConn = &conn.StatConn{Conn: newSession, RX: &c.UDPRX, TX: &c.UDPTX, Rate: c.RateLimiter}
+		targetConn = &conn.StatConn{Conn: newSession, RX: &c.UDPRX, TX: &c.UDPTX, Rate: c.RateLimiter.Load()}
 		c.TargetUDPSession.Store(sessionKey, targetConn)
 		c.Logger.Debug("Target connection: %v <-> %v", targetConn.LocalAddr(), targetConn.RemoteAddr())
 	}
@@ -409,9 +455,13 @@ func (c *Common) TunnelUDPOnce(signal Signal) {
 		}()
 	}
 
+	session := c.NewDatagramSession(id, remoteConn)
+	defer c.CloseDatagramSession(session)
+
 	c.Logger.Debug("Starting transfer: %v <-> %v", remoteConn.LocalAddr(), targetConn.LocalAddr())
 
 	done := make(chan struct{}, 2)
+	start := time.Now()
 
 	go func() {
 		defer func() { done <- struct{}{} }()
@@ -420,11 +470,9 @@ func (c *Common) TunnelUDPOnce(signal Signal) {
 		defer c.PutUDPBuffer(buffer)
 
 		for c.Ctx.Err() == nil {
-			x, err := readUDPFrame(remoteConn, buffer, UDPReadTimeout)
+			x, err := c.readUDPPacket(session, remoteConn, buffer, c.UDPSessionTimeout(start))
 			if err != nil {
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					c.Logger.Debug("UDP session abort: %v", err)
-				} else if err != io.EOF && err != io.ErrUnexpectedEOF {
+				if c.EvictUDPSession(sessionKey, start, err) == "error" {
 					c.Logger.Error("TunnelUDPOnce: read from tunnel failed: %v", err)
 				}
 				return
@@ -449,20 +497,18 @@ func (c *Common) TunnelUDPOnce(signal Signal) {
 		defer c.PutUDPBuffer(buffer)
 
 		for c.Ctx.Err() == nil {
-			if UDPReadTimeout > 0 {
-				targetConn.SetReadDeadline(time.Now().Add(UDPReadTimeout))
+			if timeout := c.UDPSessionTimeout(start); timeout > 0 {
+				targetConn.SetReadDeadline(time.Now().Add(timeout))
 			}
 			x, err := targetConn.Read(buffer)
 			if err != nil {
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					c.Logger.Debug("UDP session abort: %v", err)
-				} else if err != io.EOF {
+				if c.EvictUDPSession(sessionKey, start, err) == "error" {
 					c.Logger.Error("TunnelUDPOnce: read from target failed: %v", err)
 				}
 				return
 			}
 
-			if err = writeUDPFrame(remoteConn, buffer[:x]); err != nil {
+			if err = c.writeUDPPacket(session, remoteConn, buffer[:x]); err != nil {
 				if err != io.EOF {
 					c.Logger.Error("TunnelUDPOnce: write to tunnel failed: %v", err)
 				}
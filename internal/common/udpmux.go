@@ -0,0 +1,444 @@
+package common
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NodePassProject/conn"
+)
+
+type MuxChannel struct {
+	ID     string
+	Conn   net.Conn
+	mu     sync.Mutex
+	closed atomic.Bool
+}
+
+type MuxSession struct {
+	ID         string
+	RawID      []byte
+	Index      int
+	ClientAddr *net.UDPAddr
+	TargetConn net.Conn
+	Channel    atomic.Pointer[MuxChannel]
+	Start      time.Time
+	mu         sync.Mutex
+	ready      bool
+	pending    [][]byte
+	closed     atomic.Bool
+}
+
+type MuxFrame struct {
+	ID     string
+	Open   bool
+	Length int
+}
+
+var errMuxFrameTooLarge = errors.New("mux frame too large")
+
+func encodeMuxFrame(rawID []byte, length int, data []byte) []byte {
+	frame := make([]byte, 2+MuxHeaderSize+len(data))
+	frame[0], frame[1] = byte(length>>8), byte(length)
+	copy(frame[2:], rawID)
+	copy(frame[2+MuxHeaderSize:], data)
+	return frame
+}
+
+func readMuxFrame(r io.Reader, buffer []byte) (MuxFrame, error) {
+	var header [2 + MuxHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return MuxFrame{}, err
+	}
+
+	frame := MuxFrame{
+		ID:     hex.EncodeToString(header[2:]),
+		Length: int(header[0])<<8 | int(header[1]),
+	}
+	if frame.Length == MuxOpenLength {
+		frame.Open, frame.Length = true, 0
+		return frame, nil
+	}
+	if frame.Length > len(buffer) {
+		if _, err := io.CopyN(io.Discard, r, int64(frame.Length)); err != nil {
+			return frame, err
+		}
+		return frame, fmt.Errorf("readMuxFrame: %w: %d > buffer %d", errMuxFrameTooLarge, frame.Length, len(buffer))
+	}
+	if _, err := io.ReadFull(r, buffer[:frame.Length]); err != nil {
+		return frame, err
+	}
+	return frame, nil
+}
+
+func (mc *MuxChannel) write(frame []byte) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	_, err := mc.Conn.Write(frame)
+	return err
+}
+
+func (mc *MuxChannel) WriteFrame(rawID, data []byte) error {
+	if len(data) >= MuxOpenLength {
+		return fmt.Errorf("WriteFrame: datagram too large: %d", len(data))
+	}
+	return mc.write(encodeMuxFrame(rawID, len(data), data))
+}
+
+func (mc *MuxChannel) WriteOpen(rawID []byte) error {
+	return mc.write(encodeMuxFrame(rawID, MuxOpenLength, nil))
+}
+
+func (mc *MuxChannel) Close() {
+	if mc.closed.CompareAndSwap(false, true) {
+		mc.Conn.Close()
+	}
+}
+
+func (c *Common) loadMuxChannel(idx int) *MuxChannel {
+	c.MuxLock.Lock()
+	defer c.MuxLock.Unlock()
+
+	if idx < len(c.MuxChannels) {
+		if channel := c.MuxChannels[idx]; channel != nil && !channel.closed.Load() {
+			return channel
+		}
+	}
+	return nil
+}
+
+func (c *Common) muxChannel(idx int) (*MuxChannel, error) {
+	if channel := c.loadMuxChannel(idx); channel != nil {
+		return channel, nil
+	}
+
+	id, remoteConn, err := c.TunnelPool.IncomingGet(PoolGetTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("muxChannel: request timeout: %w", err)
+	}
+
+	channel := &MuxChannel{ID: id, Conn: remoteConn}
+	c.MuxLock.Lock()
+	if idx >= len(c.MuxChannels) {
+		c.MuxLock.Unlock()
+		remoteConn.Close()
+		return nil, fmt.Errorf("muxChannel: mux channels closed")
+	}
+	if current := c.MuxChannels[idx]; current != nil && !current.closed.Load() {
+		c.MuxLock.Unlock()
+		remoteConn.Close()
+		return current, nil
+	}
+	c.MuxChannels[idx] = channel
+	c.MuxLock.Unlock()
+	c.Logger.Debug("UDP mux channel: get %v <- pool active %v", id, c.TunnelPool.Active())
+
+	if c.Ctx.Err() == nil && c.ControlConn != nil {
+		signalData, _ := json.Marshal(Signal{ActionType: "umux", PoolConnID: id})
+		if err := c.QueueSignal(signalData); err != nil {
+			c.Logger.Error("muxChannel: %v", err)
+		}
+	}
+
+	go c.MuxReadLoop(channel, true)
+	return channel, nil
+}
+
+func (c *Common) MuxAccept(signal Signal) {
+	id := signal.PoolConnID
+	c.Logger.Debug("UDP mux signal: cid %v <- %v", id, c.ControlConn.RemoteAddr())
+
+	remoteConn, err := c.TunnelPool.OutgoingGet(id, PoolGetTimeout)
+	if err != nil {
+		c.Logger.Error("MuxAccept: request timeout: %v", err)
+		c.TunnelPool.AddError()
+		return
+	}
+
+	c.Logger.Debug("UDP mux channel: get %v <- pool active %v", id, c.TunnelPool.Active())
+	c.MuxReadLoop(&MuxChannel{ID: id, Conn: remoteConn}, false)
+}
+
+func (c *Common) MuxReadLoop(channel *MuxChannel, isInitiator bool) {
+	defer func() {
+		channel.Close()
+		c.Logger.Debug("UDP mux channel: closed %v", channel.ID)
+	}()
+
+	buffer := c.GetUDPBuffer()
+	defer c.PutUDPBuffer(buffer)
+
+	for c.Ctx.Err() == nil {
+		frame, err := readMuxFrame(channel.Conn, buffer)
+		if errors.Is(err, errMuxFrameTooLarge) {
+			c.Logger.Warn("MuxReadLoop: session %v frame skipped: %v", frame.ID, err)
+			continue
+		}
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF && c.Ctx.Err() == nil && !channel.closed.Load() {
+				c.Logger.Error("MuxReadLoop: read from tunnel failed: %v", err)
+			}
+			return
+		}
+
+		if isInitiator {
+			value, ok := c.MuxSessions.Load(frame.ID)
+			if !ok || frame.Open {
+				continue
+			}
+			session := value.(*MuxSession)
+			if _, err := c.TargetUDPBatch.WriteToUDP(buffer[:frame.Length], session.ClientAddr); err != nil {
+				c.Logger.Error("MuxReadLoop: writeToUDP failed: %v", err)
+				continue
+			}
+			c.Logger.Debug("Transfer complete: %v <-> %v", channel.Conn.LocalAddr(), c.TargetUDPConn.LocalAddr())
+			continue
+		}
+
+		if frame.Open {
+			session, err := c.acceptMuxSession(frame.ID)
+			if err != nil {
+				c.Logger.Error("MuxReadLoop: %v", err)
+				continue
+			}
+			session.Channel.Store(channel)
+			continue
+		}
+
+		value, ok := c.MuxSessions.Load(frame.ID)
+		if !ok {
+			c.Logger.Debug("MuxReadLoop: unknown session %v, frame dropped", frame.ID)
+			continue
+		}
+		session := value.(*MuxSession)
+		session.Channel.Store(channel)
+
+		session.mu.Lock()
+		if !session.ready {
+			if len(session.pending) < MuxQueueSize {
+				session.pending = append(session.pending, append([]byte(nil), buffer[:frame.Length]...))
+			} else {
+				c.Logger.Debug("MuxReadLoop: session %v queue full, frame dropped", session.ID)
+			}
+			session.mu.Unlock()
+			continue
+		}
+		session.mu.Unlock()
+		c.writeMuxTarget(session, buffer[:frame.Length])
+	}
+}
+
+func (c *Common) writeMuxTarget(session *MuxSession, data []byte) {
+	if session.closed.Load() || session.TargetConn == nil {
+		return
+	}
+	if _, err := session.TargetConn.Write(data); err != nil {
+		c.Logger.Error("MuxReadLoop: write to target failed: %v", err)
+		return
+	}
+	if channel := session.Channel.Load(); channel != nil {
+		c.Logger.Debug("Transfer complete: %v <-> %v", channel.Conn.LocalAddr(), session.TargetConn.LocalAddr())
+	}
+}
+
+func (c *Common) TunnelMuxPacket(clientAddr *net.UDPAddr, data []byte) {
+	var session *MuxSession
+	if value, ok := c.TargetUDPSession.Load(clientAddr.String()); ok {
+		session = value.(*MuxSession)
+		if c.UDPLifeTimeout > 0 && time.Since(session.Start) >= c.UDPLifeTimeout {
+			c.EvictUDPSession(session.ID, session.Start, os.ErrDeadlineExceeded)
+			c.closeMuxSession(session, true)
+			session = nil
+		}
+	}
+	if session == nil {
+		newSession, err := c.openMuxSession(clientAddr)
+		if err != nil {
+			c.Logger.Error("TunnelMuxPacket: %v", err)
+			return
+		}
+		session = newSession
+	}
+
+	if err := c.writeMuxPacket(session, data); err != nil {
+		c.Logger.Error("TunnelMuxPacket: write to tunnel failed: %v", err)
+		c.closeMuxSession(session, true)
+		return
+	}
+	c.Logger.Debug("Transfer complete: %v <-> %v", clientAddr, c.TargetUDPConn.LocalAddr())
+}
+
+func (c *Common) openMuxSession(clientAddr *net.UDPAddr) (*MuxSession, error) {
+	if !c.TryAcquireSlot(true) {
+		return nil, fmt.Errorf("openMuxSession: %v", c.SlotRefusal(true))
+	}
+
+	var session *MuxSession
+	for {
+		idx := atomic.AddUint64(&c.MuxIdx, 1)
+		rawID := make([]byte, MuxHeaderSize)
+		binary.BigEndian.PutUint32(rawID, uint32(idx))
+
+		session = &MuxSession{
+			ID:         hex.EncodeToString(rawID),
+			RawID:      rawID,
+			Index:      int(idx % uint64(c.UDPMux)),
+			ClientAddr: clientAddr,
+			Start:      time.Now(),
+			ready:      true,
+		}
+		if _, loaded := c.MuxSessions.LoadOrStore(session.ID, session); !loaded {
+			break
+		}
+	}
+	c.TargetUDPSession.Store(clientAddr.String(), session)
+
+	c.Logger.Debug("UDP mux session opened: %v <-> %v", session.ID, clientAddr)
+	return session, nil
+}
+
+func (c *Common) acceptMuxSession(id string) (*MuxSession, error) {
+	c.MuxLock.Lock()
+	if value, ok := c.MuxSessions.Load(id); ok {
+		c.MuxLock.Unlock()
+		return value.(*MuxSession), nil
+	}
+
+	rawID, err := hex.DecodeString(id)
+	if err != nil || len(rawID) != MuxHeaderSize {
+		c.MuxLock.Unlock()
+		return nil, fmt.Errorf("acceptMuxSession: invalid session id %v", id)
+	}
+
+	if !c.TryAcquireSlot(true) {
+		c.MuxLock.Unlock()
+		return nil, fmt.Errorf("acceptMuxSession: %v", c.SlotRefusal(true))
+	}
+
+	session := &MuxSession{
+		ID:    id,
+		RawID: rawID,
+		Start: time.Now(),
+	}
+	c.MuxSessions.Store(id, session)
+	c.MuxLock.Unlock()
+
+	go func() {
+		targetConn, err := c.DialWithRotation("udp", UDPDialTimeout)
+		if err != nil {
+			c.Logger.Error("acceptMuxSession: dialWithRotation failed: %v", err)
+			c.closeMuxSession(session, true)
+			return
+		}
+
+		session.mu.Lock()
+		if session.closed.Load() {
+			session.mu.Unlock()
+			targetConn.Close()
+			return
+		}
+		session.TargetConn = &conn.StatConn{Conn: targetConn, RX: &c.UDPRX, TX: &c.UDPTX, Rate: c.RateLimiter.Load()}
+		for _, packet := range session.pending {
+			c.writeMuxTarget(session, packet)
+		}
+		session.pending = nil
+		session.ready = true
+		session.mu.Unlock()
+
+		c.Logger.Debug("UDP mux session opened: %v <-> %v", id, session.TargetConn.RemoteAddr())
+		go c.muxTargetLoop(session)
+	}()
+	return session, nil
+}
+
+func (c *Common) muxTargetLoop(session *MuxSession) {
+	defer c.closeMuxSession(session, true)
+
+	buffer := c.GetUDPBuffer()
+	defer c.PutUDPBuffer(buffer)
+
+	for c.Ctx.Err() == nil {
+		if timeout := c.UDPSessionTimeout(session.Start); timeout > 0 {
+			session.TargetConn.SetReadDeadline(time.Now().Add(timeout))
+		}
+		x, err := session.TargetConn.Read(buffer)
+		if err != nil {
+			if session.closed.Load() {
+				return
+			}
+			if c.EvictUDPSession(session.ID, session.Start, err) == "error" {
+				c.Logger.Error("muxTargetLoop: read from target failed: %v", err)
+			}
+			return
+		}
+
+		channel := session.Channel.Load()
+		if channel == nil || channel.closed.Load() {
+			continue
+		}
+		if err := channel.WriteFrame(session.RawID, buffer[:x]); err != nil {
+			c.Logger.Error("muxTargetLoop: write to tunnel failed: %v", err)
+			continue
+		}
+		c.Logger.Debug("Transfer complete: %v <-> %v", session.TargetConn.LocalAddr(), channel.Conn.LocalAddr())
+	}
+}
+
+func (c *Common) writeMuxPacket(session *MuxSession, data []byte) error {
+	channel, err := c.muxChannel(session.Index)
+	if err != nil {
+		return err
+	}
+	if session.Channel.Swap(channel) != channel {
+		if err := channel.WriteOpen(session.RawID); err != nil {
+			channel.Close()
+			return fmt.Errorf("writeMuxPacket: %w", err)
+		}
+	}
+	if err := channel.WriteFrame(session.RawID, data); err != nil {
+		channel.Close()
+		return fmt.Errorf("writeMuxPacket: %w", err)
+	}
+	return nil
+}
+
+func (c *Common) closeMuxSession(session *MuxSession, notify bool) {
+	if !session.closed.CompareAndSwap(false, true) {
+		return
+	}
+
+	c.MuxSessions.Delete(session.ID)
+	if session.ClientAddr != nil {
+		c.TargetUDPSession.Delete(session.ClientAddr.String())
+	}
+	session.mu.Lock()
+	if session.TargetConn != nil {
+		session.TargetConn.Close()
+	}
+	session.pending = nil
+	session.mu.Unlock()
+	c.ReleaseSlot(true)
+
+	if notify && c.Ctx.Err() == nil && c.ControlConn != nil {
+		signalData, _ := json.Marshal(Signal{ActionType: "uclose", PoolConnID: session.ID})
+		if err := c.QueueSignal(signalData); err != nil {
+			c.Logger.Error("closeMuxSession: %v", err)
+		}
+	}
+
+	c.Logger.Debug("UDP mux session closed: %v", session.ID)
+}
+
+func (c *Common) CloseMuxSession(signal Signal) {
+	if value, ok := c.MuxSessions.Load(signal.PoolConnID); ok {
+		c.closeMuxSession(value.(*MuxSession), false)
+	}
+}
@@ -0,0 +1,136 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestReadMuxFrame(t *testing.T) {
+	rawID := []byte{0xde, 0xad, 0xbe, 0xef}
+	large := bytes.Repeat([]byte{0x55}, 32)
+
+	tests := []struct {
+		name    string
+		input   []byte
+		bufSize int
+		want    MuxFrame
+		payload []byte
+		wantErr error
+	}{
+		{
+			name:    "data",
+			input:   encodeMuxFrame(rawID, 3, []byte("abc")),
+			bufSize: 16,
+			want:    MuxFrame{ID: "deadbeef", Length: 3},
+			payload: []byte("abc"),
+		},
+		{
+			name:    "empty payload",
+			input:   encodeMuxFrame(rawID, 0, nil),
+			bufSize: 16,
+			want:    MuxFrame{ID: "deadbeef"},
+			payload: []byte{},
+		},
+		{
+			name:    "open",
+			input:   encodeMuxFrame(rawID, MuxOpenLength, nil),
+			bufSize: 16,
+			want:    MuxFrame{ID: "deadbeef", Open: true},
+		},
+		{
+			name:    "too large",
+			input:   encodeMuxFrame(rawID, len(large), large),
+			bufSize: 16,
+			want:    MuxFrame{ID: "deadbeef", Length: len(large)},
+			wantErr: errMuxFrameTooLarge,
+		},
+		{
+			name:    "short header",
+			input:   []byte{0x00, 0x03, 0xde},
+			bufSize: 16,
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "short payload",
+			input:   encodeMuxFrame(rawID, 8, []byte("abc")),
+			bufSize: 16,
+			want:    MuxFrame{ID: "deadbeef", Length: 8},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "eof",
+			bufSize: 16,
+			wantErr: io.EOF,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffer := make([]byte, tt.bufSize)
+			got, err := readMuxFrame(bytes.NewReader(tt.input), buffer)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("frame = %+v, want %+v", got, tt.want)
+			}
+			if tt.payload != nil && !bytes.Equal(buffer[:got.Length], tt.payload) {
+				t.Fatalf("payload = %q, want %q", buffer[:got.Length], tt.payload)
+			}
+		})
+	}
+}
+
+func TestReadMuxFrameSkipsOversize(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(encodeMuxFrame([]byte{1, 1, 1, 1}, 64, bytes.Repeat([]byte{0xff}, 64)))
+	stream.Write(encodeMuxFrame([]byte{2, 2, 2, 2}, 2, []byte("ok")))
+
+	buffer := make([]byte, 16)
+	if _, err := readMuxFrame(&stream, buffer); !errors.Is(err, errMuxFrameTooLarge) {
+		t.Fatalf("first frame err = %v, want %v", err, errMuxFrameTooLarge)
+	}
+
+	frame, err := readMuxFrame(&stream, buffer)
+	if err != nil {
+		t.Fatalf("second frame err = %v", err)
+	}
+	if frame.ID != "02020202" || string(buffer[:frame.Length]) != "ok" {
+		t.Fatalf("second frame = %+v %q", frame, buffer[:frame.Length])
+	}
+}
+
+func TestWriteFrameRejectsOpenLength(t *testing.T) {
+	channel := &MuxChannel{}
+	if err := channel.WriteFrame([]byte{0, 0, 0, 0}, make([]byte, MuxOpenLength)); err == nil {
+		t.Fatal("WriteFrame accepted a payload colliding with the open marker")
+	}
+}
+
+func TestOpenMuxSessionUniqueID(t *testing.T) {
+	c := newTestCommon(t)
+	c.UDPMux = 4
+	live := &MuxSession{ID: "00000001"}
+	c.MuxSessions.Store(live.ID, live)
+
+	seen := map[string]bool{live.ID: true}
+	for port := range 1000 {
+		session, err := c.openMuxSession(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1024 + port})
+		if err != nil {
+			t.Fatalf("openMuxSession: %v", err)
+		}
+		if seen[session.ID] {
+			t.Fatalf("session id %v reused", session.ID)
+		}
+		seen[session.ID] = true
+		if session.Index < 0 || session.Index >= c.UDPMux {
+			t.Fatalf("session index = %v, out of range", session.Index)
+		}
+	}
+	if value, _ := c.MuxSessions.Load(live.ID); value != live {
+		t.Fatal("live session was replaced")
+	}
+}
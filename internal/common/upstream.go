@@ -0,0 +1,96 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+type byteReader struct{ net.Conn }
+
+func (b byteReader) Read(p []byte) (int, error) {
+	return b.Conn.Read(p[:min(len(p), 1)])
+}
+
+func (c *Common) UpstreamString() string {
+	if c.Upstream == nil {
+		return ""
+	}
+	return c.Upstream.Redacted()
+}
+
+func (c *Common) DialTunnel(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: TCPDialTimeout}
+	if c.Upstream == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	upstreamConn, err := dialer.DialContext(ctx, "tcp", c.Upstream.Host)
+	if err != nil {
+		return nil, fmt.Errorf("DialTunnel: %w", err)
+	}
+	upstreamConn.SetDeadline(time.Now().Add(TCPDialTimeout))
+
+	if c.Upstream.Scheme == "socks5" {
+		err = c.socksConnect(ctx, upstreamConn, addr)
+	} else {
+		err = c.httpConnect(upstreamConn, addr)
+	}
+	if err != nil {
+		upstreamConn.Close()
+		return nil, fmt.Errorf("DialTunnel: %w", err)
+	}
+
+	upstreamConn.SetDeadline(time.Time{})
+	return upstreamConn, nil
+}
+
+func (c *Common) socksConnect(ctx context.Context, upstreamConn net.Conn, addr string) error {
+	dialer, err := proxy.FromURL(c.Upstream, proxy.Direct)
+	if err != nil {
+		return fmt.Errorf("socksConnect: %w", err)
+	}
+	socks, ok := dialer.(interface {
+		DialWithConn(ctx context.Context, c net.Conn, network, address string) (net.Addr, error)
+	})
+	if !ok {
+		return fmt.Errorf("socksConnect: unsupported dialer")
+	}
+	if _, err := socks.DialWithConn(ctx, upstreamConn, "tcp", addr); err != nil {
+		return fmt.Errorf("socksConnect: %w", err)
+	}
+	return nil
+}
+
+func (c *Common) httpConnect(upstreamConn net.Conn, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := c.Upstream.User; user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err := req.Write(upstreamConn); err != nil {
+		return fmt.Errorf("httpConnect: %w", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(byteReader{upstreamConn}), req)
+	if err != nil {
+		return fmt.Errorf("httpConnect: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("httpConnect: upstream refused %v: %v", addr, resp.Status)
+	}
+	return nil
+}
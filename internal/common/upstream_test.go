@@ -0,0 +1,177 @@
+package common
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestDialTunnelHTTPConnect(t *testing.T) {
+	const target = "tunnel.example.com:10101"
+
+	tests := []struct {
+		name    string
+		user    *url.Userinfo
+		status  int
+		wantErr bool
+	}{
+		{"accepted", nil, http.StatusOK, false},
+		{"accepted with credentials", url.UserPassword("alice", "s3cret"), http.StatusOK, false},
+		{"proxy auth required", nil, http.StatusProxyAuthRequired, true},
+		{"forbidden", url.UserPassword("alice", "wrong"), http.StatusForbidden, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(chan *http.Request, 1)
+			proxyListener := listenTestTCP(t, func(serverConn net.Conn) {
+				reader := bufio.NewReader(serverConn)
+				req, err := http.ReadRequest(reader)
+				if err != nil {
+					return
+				}
+				requests <- req
+				fmt.Fprintf(serverConn, "HTTP/1.1 %d %s\r\n\r\n", tt.status, http.StatusText(tt.status))
+				if tt.status == http.StatusOK {
+					echo(reader, serverConn)
+				}
+			})
+
+			c := newTestCommon(t)
+			c.Upstream = &url.URL{Scheme: "http", Host: proxyListener.Addr().String(), User: tt.user}
+			tunnelConn, err := c.DialTunnel(c.Ctx, target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DialTunnel error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			req := <-requests
+			if req.Method != http.MethodConnect || req.Host != target {
+				t.Fatalf("request = %v %v, want CONNECT %v", req.Method, req.Host, target)
+			}
+			wantAuth := ""
+			if tt.user != nil {
+				password, _ := tt.user.Password()
+				wantAuth = "Basic " + base64.StdEncoding.EncodeToString([]byte(tt.user.Username()+":"+password))
+			}
+			if got := req.Header.Get("Proxy-Authorization"); got != wantAuth {
+				t.Fatalf("Proxy-Authorization = %q, want %q", got, wantAuth)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			defer tunnelConn.Close()
+			assertEcho(t, tunnelConn)
+		})
+	}
+}
+
+func serveSOCKS5(serverConn net.Conn, user *url.Userinfo, reply byte, targets chan<- string) {
+	reader := bufio.NewReader(serverConn)
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil || header[0] != 5 {
+		return
+	}
+	if _, err := io.ReadFull(reader, make([]byte, header[1])); err != nil {
+		return
+	}
+
+	if user == nil {
+		serverConn.Write([]byte{5, 0})
+	} else {
+		serverConn.Write([]byte{5, 2})
+		readField := func() string {
+			length, _ := reader.ReadByte()
+			field := make([]byte, length)
+			io.ReadFull(reader, field)
+			return string(field)
+		}
+		reader.ReadByte()
+		name, password := readField(), readField()
+		if want, _ := user.Password(); name != user.Username() || password != want {
+			serverConn.Write([]byte{1, 1})
+			return
+		}
+		serverConn.Write([]byte{1, 0})
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil || request[1] != 1 {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(reader, ip)
+		host = net.IP(ip).String()
+	case 3:
+		length, _ := reader.ReadByte()
+		name := make([]byte, length)
+		io.ReadFull(reader, name)
+		host = string(name)
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	io.ReadFull(reader, port)
+	targets <- net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	serverConn.Write([]byte{5, reply, 0, 1, 0, 0, 0, 0, 0, 0})
+	if reply == 0 {
+		echo(reader, serverConn)
+	}
+}
+
+func TestDialTunnelSOCKS5(t *testing.T) {
+	const target = "tunnel.example.com:10101"
+
+	tests := []struct {
+		name     string
+		user     *url.Userinfo
+		proxied  *url.Userinfo
+		reply    byte
+		wantErr  bool
+		reachReq bool
+	}{
+		{"no auth", nil, nil, 0, false, true},
+		{"user and password", url.UserPassword("alice", "s3cret"), url.UserPassword("alice", "s3cret"), 0, false, true},
+		{"wrong password", url.UserPassword("alice", "s3cret"), url.UserPassword("alice", "wrong"), 0, true, false},
+		{"connection refused", nil, nil, 5, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets := make(chan string, 1)
+			proxyListener := listenTestTCP(t, func(serverConn net.Conn) {
+				serveSOCKS5(serverConn, tt.user, tt.reply, targets)
+			})
+
+			c := newTestCommon(t)
+			c.Upstream = &url.URL{Scheme: "socks5", Host: proxyListener.Addr().String(), User: tt.proxied}
+			tunnelConn, err := c.DialTunnel(c.Ctx, target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DialTunnel error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.reachReq {
+				if got := <-targets; got != target {
+					t.Fatalf("SOCKS target = %q, want %q", got, target)
+				}
+			}
+			if tt.wantErr {
+				return
+			}
+
+			defer tunnelConn.Close()
+			assertEcho(t, tunnelConn)
+		})
+	}
+}
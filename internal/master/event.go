@@ -21,6 +21,9 @@ func NewInstanceLogWriter(instanceID string, instance *Instance, target io.Write
 		Target:     target,
 		Master:     master,
 		CheckPoint: regexp.MustCompile(`CHECK_POINT\|MODE=(\d+)\|PING=(\d+)ms\|POOL=(\d+)\|TCPS=(\d+)\|UDPS=(\d+)\|TCPRX=(\d+)\|TCPTX=(\d+)\|UDPRX=(\d+)\|UDPTX=(\d+)`),
+		PeerCert:   regexp.MustCompile(`PEER_CERT\|SUBJECT=(.+)$`),
+		AuthFail:   regexp.MustCompile(`AUTH_FAIL\|IP=([^|]+)\|KIND=(\w+)\|FAILS=(\d+)\|BAN=(\d+)s`),
+		KeyRotated: regexp.MustCompile(`KEY_ROTATED\|SERVER=([^|]+)\|FP=(\w+)`),
 	}
 }
 
@@ -63,7 +66,9 @@ func (w *InstanceLogWriter) Write(p []byte) (n int, err error) {
 
 			w.Instance.lastCheckPoint = time.Now()
 
-			if w.Instance.Status == "error" {
+			if strings.Contains(line, "|DRAIN=") {
+				w.Instance.Status = "draining"
+			} else if w.Instance.Status == "error" {
 				w.Instance.Status = "running"
 			}
 
@@ -74,6 +79,22 @@ func (w *InstanceLogWriter) Write(p []byte) (n int, err error) {
 			continue
 		}
 
+		if matches := w.PeerCert.FindStringSubmatch(line); len(matches) == 2 {
+			w.Instance.PeerCert = matches[1]
+			if !w.Instance.deleted {
+				w.Master.Instances.Store(w.InstanceID, w.Instance)
+				w.Master.SendSSEEvent("update", w.Instance)
+			}
+		}
+
+		if matches := w.KeyRotated.FindStringSubmatch(line); len(matches) == 3 && !w.Instance.deleted {
+			w.Master.ApplyRotatedKey(w.Instance, matches[1], matches[2])
+		}
+
+		if w.AuthFail.MatchString(line) && !w.Instance.deleted {
+			w.Master.SendSSEEvent("security", w.Instance, line)
+		}
+
 		if w.Instance.Status != "error" && !w.Instance.deleted &&
 			(strings.Contains(line, "Server error:") || strings.Contains(line, "Client error:")) {
 			w.Instance.Status = "error"
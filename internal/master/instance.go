@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -47,6 +48,7 @@ func (m *Master) StartInstance(instance *Instance) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	cmd := exec.CommandContext(ctx, execPath, instance.URL)
+	cmd.Env = append(os.Environ(), "NP_REKEY_DIR="+m.RekeyDir(instance.ID))
 	instance.cancelFunc = cancel
 
 	writer := NewInstanceLogWriter(instance.ID, instance, os.Stdout, m)
@@ -87,7 +89,7 @@ func (m *Master) MonitorInstance(instance *Instance, cmd *exec.Cmd) {
 		case err := <-done:
 			if value, exists := m.Instances.Load(instance.ID); exists {
 				instance = value.(*Instance)
-				if instance.Status == "running" {
+				if instance.Status == "running" || instance.Status == "draining" {
 					if err != nil {
 						m.Logger.Error("MonitorInstance: instance error: %v [%v]", err, instance.ID)
 						instance.Status = "error"
@@ -110,6 +112,16 @@ func (m *Master) MonitorInstance(instance *Instance, cmd *exec.Cmd) {
 }
 
 func (m *Master) StopInstance(instance *Instance) {
+	m.stopInstance(instance, nil)
+}
+
+func (m *Master) RestartInstance(instance *Instance, sig os.Signal) {
+	m.stopInstance(instance, sig)
+	time.Sleep(BaseDuration)
+	m.StartInstance(instance)
+}
+
+func (m *Master) stopInstance(instance *Instance, sig os.Signal) {
 	if instance.Status == "stopped" {
 		return
 	}
@@ -128,11 +140,13 @@ func (m *Master) StopInstance(instance *Instance) {
 	}
 
 	process := instance.cmd.Process
-	if runtime.GOOS == "windows" {
-		process.Signal(os.Interrupt)
-	} else {
-		process.Signal(syscall.SIGTERM)
+	if sig == nil {
+		sig = syscall.SIGTERM
+		if runtime.GOOS == "windows" {
+			sig = os.Interrupt
+		}
 	}
+	process.Signal(sig)
 
 	if instance.cancelFunc != nil {
 		instance.cancelFunc()
@@ -160,6 +174,7 @@ func (m *Master) StopInstance(instance *Instance) {
 	instance.Pool = 0
 	instance.TCPS = 0
 	instance.UDPS = 0
+	instance.PeerCert = ""
 	m.Instances.Store(instance.ID, instance)
 
 	go m.SaveState()
@@ -178,12 +193,111 @@ func (m *Master) ProcessInstanceAction(instance *Instance, action string) {
 			go m.StopInstance(instance)
 		}
 	case "restart":
-		go func() {
-			m.StopInstance(instance)
-			time.Sleep(BaseDuration)
-			m.StartInstance(instance)
-		}()
+		go m.RestartInstance(instance, common.RestartSignal)
+	case "drain":
+		if instance.Status == "running" {
+			go m.DrainInstance(instance)
+		}
+	case "rotate":
+		go m.RotateInstanceKey(instance)
+	}
+}
+
+func (m *Master) RotateInstanceKey(instance *Instance) {
+	parsedURL, err := url.Parse(instance.URL)
+	if err != nil || instance.Type != "server" {
+		m.Logger.Warn("RotateInstanceKey: not a server instance [%v]", instance.ID)
+		return
+	}
+	keyFile := parsedURL.Query().Get("keys")
+	if keyFile == "" {
+		m.Logger.Warn("RotateInstanceKey: no keys file set [%v]", instance.ID)
+		return
+	}
+
+	keys := &common.TunnelKeys{Current: common.BaseTunnelKey(parsedURL), Previous: make(map[string]time.Time)}
+	if data, err := os.ReadFile(keyFile); err == nil {
+		if keys, err = common.ParseKeys(string(data)); err != nil {
+			m.Logger.Error("RotateInstanceKey: %v [%v]", err, instance.ID)
+			return
+		}
+	} else if !os.IsNotExist(err) {
+		m.Logger.Error("RotateInstanceKey: %v [%v]", err, instance.ID)
+		return
+	}
+
+	now := time.Now()
+	for key, expiry := range keys.Previous {
+		if now.After(expiry) {
+			delete(keys.Previous, key)
+		}
+	}
+	keys.Previous[keys.Current] = now.Add(KeyRotateGrace)
+	keys.Current = GenerateAPIKey()
+
+	if err := common.SaveKeys(keyFile, keys); err != nil {
+		m.Logger.Error("RotateInstanceKey: %v [%v]", err, instance.ID)
+		return
+	}
+
+	parsedURL.User = url.User(keys.Current)
+	instance.URL = parsedURL.String()
+	instance.Config = m.GenerateConfigURL(instance)
+	m.Instances.Store(instance.ID, instance)
+	go m.SaveState()
+	m.Logger.Info("Tunnel key rotated: %v previous [%v]", len(keys.Previous), instance.ID)
+
+	m.SendSSEEvent("update", instance)
+}
+
+func (m *Master) RekeyDir(id string) string {
+	return filepath.Join(filepath.Dir(m.StatePath), RekeyFilePath, id)
+}
+
+func (m *Master) ApplyRotatedKey(instance *Instance, server, fingerprint string) {
+	key, err := common.FindRotatedKey(m.RekeyDir(instance.ID), server, fingerprint)
+	if err != nil {
+		m.Logger.Error("ApplyRotatedKey: %v [%v]", err, instance.ID)
+		return
+	}
+	if key == "" {
+		m.Logger.Warn("ApplyRotatedKey: no rotated key for %v with fingerprint %v [%v]", server, fingerprint, instance.ID)
+		return
 	}
+
+	parsedURL, err := url.Parse(instance.URL)
+	if err != nil || parsedURL.User.Username() == key {
+		return
+	}
+	parsedURL.User = url.User(key)
+	instance.URL = parsedURL.String()
+	instance.Config = m.GenerateConfigURL(instance)
+	m.Instances.Store(instance.ID, instance)
+	go m.SaveState()
+	m.Logger.Info("Tunnel key updated: %v [%v]", fingerprint, instance.ID)
+
+	m.SendSSEEvent("update", instance)
+}
+
+func (m *Master) DrainInstance(instance *Instance) {
+	if common.DrainSignal == nil {
+		m.Logger.Warn("DrainInstance: drain is not supported on %v [%v]", runtime.GOOS, instance.ID)
+		return
+	}
+	if instance.cmd == nil || instance.cmd.Process == nil {
+		return
+	}
+
+	if err := instance.cmd.Process.Signal(common.DrainSignal); err != nil {
+		m.Logger.Error("DrainInstance: signal failed: %v [%v]", err, instance.ID)
+		return
+	}
+
+	instance.Status = "draining"
+	m.Instances.Store(instance.ID, instance)
+	m.Logger.Info("Instance draining [%v]", instance.ID)
+
+	m.SendSSEEvent("update", instance)
 }
 
 func (m *Master) ReGenerateAPIKey(instance *Instance) {
@@ -277,6 +391,24 @@ func (m *Master) GenerateConfigURL(instance *Instance) string {
 		if query.Get("read") == "" {
 			query.Set("read", common.DefaultReadTimeout.String())
 		}
+		if query.Get("tidle") == "" {
+			query.Set("tidle", common.DefaultTCPIdle.String())
+		}
+		if query.Get("tlife") == "" {
+			query.Set("tlife", common.DefaultTCPLife.String())
+		}
+		if query.Get("tmax") == "" {
+			query.Set("tmax", strconv.Itoa(common.DefaultTCPMaxBytes))
+		}
+		if query.Get("uidle") == "" {
+			query.Set("uidle", common.UDPReadTimeout.String())
+		}
+		if query.Get("ulife") == "" {
+			query.Set("ulife", common.DefaultUDPLife.String())
+		}
+		if query.Get("umax") == "" {
+			query.Set("umax", strconv.Itoa(common.DefaultUDPLimit))
+		}
 		if query.Get("rate") == "" {
 			query.Set("rate", strconv.Itoa(common.DefaultRateLimit))
 		}
@@ -317,6 +449,24 @@ func (m *Master) GenerateConfigURL(instance *Instance) string {
 		if query.Get("read") == "" {
 			query.Set("read", common.DefaultReadTimeout.String())
 		}
+		if query.Get("tidle") == "" {
+			query.Set("tidle", common.DefaultTCPIdle.String())
+		}
+		if query.Get("tlife") == "" {
+			query.Set("tlife", common.DefaultTCPLife.String())
+		}
+		if query.Get("tmax") == "" {
+			query.Set("tmax", strconv.Itoa(common.DefaultTCPMaxBytes))
+		}
+		if query.Get("uidle") == "" {
+			query.Set("uidle", common.UDPReadTimeout.String())
+		}
+		if query.Get("ulife") == "" {
+			query.Set("ulife", common.DefaultUDPLife.String())
+		}
+		if query.Get("umax") == "" {
+			query.Set("umax", strconv.Itoa(common.DefaultUDPLimit))
+		}
 		if query.Get("rate") == "" {
 			query.Set("rate", strconv.Itoa(common.DefaultRateLimit))
 		}
@@ -335,6 +485,18 @@ func (m *Master) GenerateConfigURL(instance *Instance) string {
 		if query.Get("noudp") == "" {
 			query.Set("noudp", common.DefaultUDPStrategy)
 		}
+		if query.Get("dgram") == "" {
+			query.Set("dgram", common.DefaultDatagramPort)
+		}
+		if query.Get("umux") == "" {
+			query.Set("umux", strconv.Itoa(common.DefaultUDPMux))
+		}
+		if query.Get("insecure") == "" {
+			query.Set("insecure", common.DefaultInsecure)
+		}
+		if query.Get("clients") == "" {
+			query.Set("clients", strconv.Itoa(common.DefaultClientLimit))
+		}
 	}
 
 	parsedURL.RawQuery = query.Encode()
@@ -396,7 +558,7 @@ func (m *Master) SetInstanceURL(instance *Instance, updates map[string]string) e
 	}
 
 	if instance.Status != "stopped" {
-		m.StopInstance(instance)
+		m.stopInstance(instance, common.ConfigSignal)
 		time.Sleep(BaseDuration)
 	}
 
@@ -26,6 +26,7 @@ const (
 	MCPVersion      = "2025-11-25"
 	StateFilePath   = "gob"
 	StateFileName   = "nodepass.gob"
+	RekeyFilePath   = "rekey"
 	ExportFileName  = "nodepass.json"
 	SSERetryTime    = 3000
 	APIKeyID        = "********"
@@ -33,6 +34,7 @@ const (
 	BaseDuration    = 100 * time.Millisecond
 	GracefulTimeout = 5 * time.Second
 	MaxValueLen     = 256
+	KeyRotateGrace  = 24 * time.Hour
 )
 
 func NewMaster(parsedURL *url.URL, tlsCode string, tlsConfig *tls.Config, logger *logs.Logger, version string) (*Master, error) {
@@ -7,8 +7,11 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"time"
+
+	"github.com/NodePassProject/nodepass/internal/common"
 )
 
 func (m *Master) HandleMCP(w http.ResponseWriter, r *http.Request) {
@@ -274,7 +277,7 @@ func (m *Master) HandleMCPToolsList(w http.ResponseWriter, req MCPRequest) {
 		},
 		{
 			"name":        "control_instance",
-			"description": "Control instance state (start, stop, restart, reset)",
+			"description": "Control instance state (start, stop, restart, reset, drain, rotate)",
 			"inputSchema": map[string]any{
 				"type": "object",
 				"properties": map[string]any{
@@ -282,7 +285,7 @@ func (m *Master) HandleMCPToolsList(w http.ResponseWriter, req MCPRequest) {
 					"action": map[string]any{
 						"type":        "string",
 						"description": "Control action",
-						"enum":        []string{"start", "stop", "restart", "reset"},
+						"enum":        []string{"start", "stop", "restart", "reset", "drain", "rotate"},
 					},
 				},
 				"required": []string{"id", "action"},
@@ -690,11 +693,15 @@ func (m *Master) HandleMCPToolsCall(w http.ResponseWriter, req MCPRequest) {
 			return
 		}
 
-		validActions := map[string]bool{"start": true, "stop": true, "restart": true, "reset": true}
+		validActions := map[string]bool{"start": true, "stop": true, "restart": true, "reset": true, "drain": true, "rotate": true}
 		if !validActions[action] {
 			m.WriteMCPError(w, req.ID, -32602, "Invalid params", "invalid action")
 			return
 		}
+		if action == "drain" && common.DrainSignal == nil {
+			m.WriteMCPError(w, req.ID, -32602, "Invalid params", fmt.Sprintf("drain is not supported on %s", runtime.GOOS))
+			return
+		}
 
 		if action == "reset" {
 			instance.tcpRXReset = instance.TCPRX - instance.tcpRXBase
@@ -1117,6 +1124,7 @@ func (m *Master) HandleMCPToolsCall(w http.ResponseWriter, req MCPRequest) {
 			m.StopInstance(instance)
 		}
 		m.Instances.Delete(id)
+		os.RemoveAll(m.RekeyDir(id))
 		go m.SaveState()
 		m.SendSSEEvent("delete", instance)
 
@@ -195,7 +195,7 @@ func (m *Master) GenerateOpenAPISpec() string {
 	  "id": {"type": "string", "description": "Unique identifier"},
 	  "alias": {"type": "string", "description": "Instance alias"},
 	  "type": {"type": "string", "enum": ["client", "server"], "description": "Type of instance"},
-	  "status": {"type": "string", "enum": ["running", "stopped", "error"], "description": "Instance status"},
+	  "status": {"type": "string", "enum": ["running", "draining", "stopped", "error"], "description": "Instance status"},
 	  "url": {"type": "string", "description": "Command string or API Key"},
 	  "config": {"type": "string", "description": "Instance configuration URL"},
 	  "restart": {"type": "boolean", "description": "Restart policy"},
@@ -223,7 +223,7 @@ func (m *Master) GenerateOpenAPISpec() string {
 		"type": "object",
 		"properties": {
 		  "alias": {"type": "string", "description": "Instance alias"},
-		  "action": {"type": "string", "enum": ["start", "stop", "restart", "reset"], "description": "Action for the instance"},
+		  "action": {"type": "string", "enum": ["start", "stop", "restart", "reset", "drain", "rotate"], "description": "Action for the instance"},
 		  "restart": {"type": "boolean", "description": "Instance restart policy"},
 		  "meta": {"$ref": "#/components/schemas/Meta"}
 		}
@@ -2,6 +2,7 @@ package master
 
 import (
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/NodePassProject/nodepass/internal/common"
@@ -64,6 +65,7 @@ func (m *Master) PerformPeriodicCleanup() {
 				m.StopInstance(inst)
 			}
 			m.Instances.Delete(inst.ID)
+			os.RemoveAll(m.RekeyDir(inst.ID))
 		}
 	}
 }
@@ -81,8 +83,6 @@ func (m *Master) PerformPeriodicRestart() {
 	})
 
 	for _, instance := range errorInstances {
-		m.StopInstance(instance)
-		time.Sleep(BaseDuration)
-		m.StartInstance(instance)
+		m.RestartInstance(instance, common.RestartSignal)
 	}
 }
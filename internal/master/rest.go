@@ -6,6 +6,8 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"runtime"
 	"strings"
 	"time"
 
@@ -146,11 +148,17 @@ func (m *Master) HandlePatchInstance(w http.ResponseWriter, r *http.Request, id
 					"stop":    true,
 					"restart": true,
 					"reset":   true,
+					"drain":   true,
+					"rotate":  true,
 				}
 				if !validActions[reqData.Action] {
 					HTTPError(w, fmt.Sprintf("Invalid action: %s", reqData.Action), http.StatusBadRequest)
 					return
 				}
+				if reqData.Action == "drain" && common.DrainSignal == nil {
+					HTTPError(w, fmt.Sprintf("Drain is not supported on %s", runtime.GOOS), http.StatusNotImplemented)
+					return
+				}
 
 				if reqData.Action == "reset" {
 					instance.tcpRXReset = instance.TCPRX - instance.tcpRXBase
@@ -266,7 +274,7 @@ func (m *Master) HandlePutInstance(w http.ResponseWriter, r *http.Request, id st
 	}
 
 	if instance.Status != "stopped" {
-		m.StopInstance(instance)
+		m.stopInstance(instance, common.ConfigSignal)
 		time.Sleep(BaseDuration)
 	}
 
@@ -301,6 +309,7 @@ func (m *Master) HandleDeleteInstance(w http.ResponseWriter, id string, instance
 		m.StopInstance(instance)
 	}
 	m.Instances.Delete(id)
+	os.RemoveAll(m.RekeyDir(id))
 	go m.SaveState()
 	w.WriteHeader(http.StatusNoContent)
 	m.SendSSEEvent("delete", instance)
@@ -56,6 +56,7 @@ type Instance struct {
 	TCPTX          uint64 `json:"tcptx"`
 	UDPRX          uint64 `json:"udprx"`
 	UDPTX          uint64 `json:"udptx"`
+	PeerCert       string `json:"peercert"`
 	tcpRXBase      uint64
 	tcpTXBase      uint64
 	udpRXBase      uint64
@@ -88,6 +89,9 @@ type InstanceLogWriter struct {
 	Target     io.Writer
 	Master     *Master
 	CheckPoint *regexp.Regexp
+	PeerCert   *regexp.Regexp
+	AuthFail   *regexp.Regexp
+	KeyRotated *regexp.Regexp
 }
 
 type InstanceEvent struct {
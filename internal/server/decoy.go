@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/NodePassProject/conn"
+	"github.com/NodePassProject/nodepass/internal/common"
+)
+
+type decoyListener struct {
+	net.Listener
+	queue *common.QueueListener
+}
+
+func (l *decoyListener) Accept() (net.Conn, error) {
+	return l.queue.Accept()
+}
+
+func (l *decoyListener) Close() error {
+	l.queue.Close()
+	return l.Listener.Close()
+}
+
+func (s *Server) decoyListener(listener net.Listener) net.Listener {
+	if s.Decoy == "" || !common.PeekSupported {
+		return listener
+	}
+
+	decoy := &decoyListener{Listener: listener, queue: common.NewQueueListener(listener.Addr())}
+	go func() {
+		defer decoy.queue.Close()
+		for {
+			tunnelConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if !common.IsTunnelHello(common.PeekClientHello(tunnelConn, common.PeekTimeout)) {
+					s.spliceDecoy(tunnelConn)
+					return
+				}
+				if !decoy.queue.Push(tunnelConn) {
+					tunnelConn.Close()
+				}
+			}()
+		}
+	}()
+	return decoy
+}
+
+func (s *Server) spliceDecoy(clientConn net.Conn) {
+	defer clientConn.Close()
+	target, _ := url.Parse(s.Decoy)
+
+	decoyConn, err := net.DialTimeout("tcp", target.Host, common.TCPDialTimeout)
+	if err != nil {
+		s.Logger.Debug("Decoy: dial %v for %v failed: %v", target.Host, clientConn.RemoteAddr(), err)
+		return
+	}
+	defer decoyConn.Close()
+	s.Logger.Debug("Decoy: splicing %v <-> %v", clientConn.RemoteAddr(), target.Host)
+
+	buffer1 := s.GetTCPBuffer()
+	buffer2 := s.GetTCPBuffer()
+	defer func() {
+		s.PutTCPBuffer(buffer1)
+		s.PutTCPBuffer(buffer2)
+	}()
+	conn.DataExchange(clientConn, decoyConn, 0, buffer1, buffer2)
+}
+
+func (s *Server) decoyProxy() http.Handler {
+	if s.Decoy == "" {
+		return nil
+	}
+	target, _ := url.Parse(s.Decoy)
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = &http.Transport{
+		DialContext:     (&net.Dialer{Timeout: common.TCPDialTimeout}).DialContext,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	proxy.ErrorLog = s.Logger.StdLogger()
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		s.Logger.Debug("Decoy: %v %v from %v failed: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return proxy
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NodePassProject/logs"
+	"github.com/NodePassProject/nodepass/internal/common"
+)
+
+func TestDecoyListener(t *testing.T) {
+	if !common.PeekSupported {
+		t.Skip("connection peeking not supported on this platform")
+	}
+
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen backend: %v", err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	spliced := make(chan struct{}, 8)
+	go func() {
+		for {
+			backendConn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			spliced <- struct{}{}
+			backendConn.Close()
+		}
+	}()
+
+	s := &Server{Common: common.Common{
+		Logger: logs.NewLogger(logs.None, false),
+		Decoy:  "https://" + backend.Addr().String(),
+		TCPBufferPool: &sync.Pool{
+			New: func() any {
+				buf := make([]byte, common.TCPDataBufSize)
+				return &buf
+			},
+		},
+	}}
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	listener := s.decoyListener(raw)
+	t.Cleanup(func() { listener.Close() })
+	accepted := make(chan net.Conn, 8)
+	go func() {
+		for {
+			tunnelConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- tunnelConn
+		}
+	}()
+
+	tests := []struct {
+		name   string
+		send   func(clientConn net.Conn)
+		tunnel bool
+	}{
+		{"plain http", func(clientConn net.Conn) { clientConn.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n")) }, false},
+		{"silent client", func(net.Conn) {}, false},
+		{"browser hello", func(clientConn net.Conn) {
+			go tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2", common.HandshakeALPN}}).Handshake()
+		}, false},
+		{"hello without alpn", func(clientConn net.Conn) {
+			go tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+		}, false},
+		{"tunnel hello", func(clientConn net.Conn) {
+			go tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{common.HandshakeALPN}}).Handshake()
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, err := net.Dial("tcp", raw.Addr().String())
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer clientConn.Close()
+			tt.send(clientConn)
+
+			select {
+			case tunnelConn := <-accepted:
+				tunnelConn.Close()
+				if !tt.tunnel {
+					t.Fatal("connection reached the handshake server, want decoy")
+				}
+			case <-spliced:
+				if tt.tunnel {
+					t.Fatal("connection was spliced to the decoy, want handshake server")
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("connection was neither accepted nor spliced")
+			}
+		})
+	}
+}
+
+func TestHandshakeVersionDecoy(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "decoy")
+	}))
+	t.Cleanup(backend.Close)
+
+	ts, attached := newHandshakeTest(t, backend.URL)
+	resp := handshakeRequest(t, ts, "key", map[string]string{"Version": strconv.Itoa(common.MinProtocolVersion - 1)})
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "decoy" {
+		t.Fatalf("got %v %q, want the decoy page", resp.StatusCode, body)
+	}
+	if got := attached.Load(); got != 0 {
+		t.Fatalf("attached %v times, want 0", got)
+	}
+}
@@ -6,95 +6,262 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/NodePassProject/nodepass/internal/common"
 )
 
 func (s *Server) TunnelHandshake() error {
 	var clientIP string
+	var claimed atomic.Bool
 	done := make(chan struct{})
 
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	handler := s.handshakeHandler(func(_ *Server, ip string) (*common.Common, func(bool), error) {
+		if !claimed.CompareAndSwap(false, true) {
+			return nil, nil, fmt.Errorf("tunnel already claimed by another handshake")
+		}
+		return &s.Common, func(ok bool) {
+			if !ok {
+				claimed.Store(false)
+				return
+			}
+			clientIP = ip
+			close(done)
+		}, nil
+	})
+
+	server := &http.Server{
+		Handler:   handler,
+		TLSConfig: s.handshakeTLSConfig(),
+		ErrorLog:  s.Logger.StdLogger(),
+	}
+	go server.ServeTLS(s.decoyListener(s.TunnelListener), "", "")
+
+	select {
+	case <-done:
+		server.Close()
+		s.ClientIP = clientIP
+		if s.TLSCode == "1" && s.StateDir == "" {
+			if newTLSConfig, err := common.NewTLSConfig(); err == nil {
+				newTLSConfig.MinVersion = tls.VersionTLS13
+				s.TLSConfig = newTLSConfig
+				s.Logger.Info("TLS code-1: RAM cert regenerated with TLS 1.3")
+			} else {
+				s.Logger.Warn("Failed to regenerate RAM cert: %v", err)
+			}
+		}
+
+		tunnelListener, err := common.HoldTCP(&s.TunnelHold, s.TunnelTCPAddr)
+		if err != nil {
+			return fmt.Errorf("TunnelHandshake: %w", err)
+		}
+		s.TunnelListener = tunnelListener
+		return nil
+	case <-s.Ctx.Done():
+		server.Close()
+		return fmt.Errorf("TunnelHandshake: context canceled")
+	}
+}
+
+func (s *Server) handshakeHandler(attach func(tenant *Server, clientIP string) (*common.Common, func(ok bool), error)) http.Handler {
+	challenges := common.NewChallengeStore()
+	decoy := s.decoyProxy()
+	refuse := func(w http.ResponseWriter, r *http.Request, status int) {
+		if decoy != nil {
+			w.Header().Del("Connection")
+			decoy.ServeHTTP(w, r)
+			return
+		}
+		http.Error(w, http.StatusText(status), status)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(clientIP); err == nil {
+			clientIP = host
+		}
+		if ban := s.AuthGuard.Banned(clientIP); ban > 0 {
+			s.Logger.Debug("TunnelHandshake: client %v banned for another %v", clientIP, ban.Round(time.Second))
+			refuse(w, r, http.StatusForbidden)
+			return
+		}
+		if !s.AuthGuard.Throttle() {
+			s.Logger.Debug("TunnelHandshake: attempt limit reached, refusing %v", clientIP)
+			refuse(w, r, http.StatusTooManyRequests)
+			return
+		}
+
 		switch r.Method {
 		case http.MethodGet:
 			w.Header().Set("Connection", "close")
-			if r.URL.Path != "/" {
-				http.Error(w, "Not Found", http.StatusNotFound)
+			if r.URL.Path != "/" || (decoy != nil && r.Header.Get("Nonce") == "") {
+				refuse(w, r, http.StatusNotFound)
 				return
 			}
 
+			clientNonce := r.Header.Get("Nonce")
 			auth := r.Header.Get("Authorization")
-			if !strings.HasPrefix(auth, "Bearer ") || !s.VerifyAuthToken(strings.TrimPrefix(auth, "Bearer ")) {
+			if !strings.HasPrefix(auth, "Bearer ") {
+				serverNonce, ok := challenges.Issue()
+				if !ok {
+					s.Logger.Debug("TunnelHandshake: challenge limit reached, refusing %v", clientIP)
+					refuse(w, r, http.StatusServiceUnavailable)
+					return
+				}
+				w.Header().Set("Challenge", serverNonce)
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
-			clientIP = r.RemoteAddr
-			if host, _, err := net.SplitHostPort(clientIP); err == nil {
-				clientIP = host
+			serverNonce := r.Header.Get("Challenge")
+			if !challenges.Take(serverNonce) {
+				refuse(w, r, http.StatusUnauthorized)
+				return
+			}
+
+			timestamp, _ := strconv.ParseInt(r.Header.Get("Timestamp"), 10, 64)
+			tenant, key := s.matchTenant(strings.TrimPrefix(auth, "Bearer "), clientNonce, serverNonce, timestamp)
+			if tenant == nil {
+				s.authFailed(clientIP, "tunnel")
+				refuse(w, r, http.StatusUnauthorized)
+				return
+			}
+			s.AuthGuard.Success(clientIP)
+
+			version := common.MinProtocolVersion
+			if header := r.Header.Get("Version"); header == "" {
+				s.Logger.Warn("TunnelHandshake: client %v sent no protocol version, assuming %v; this is deprecated", clientIP, version)
+			} else if version, _ = strconv.Atoi(header); version < common.MinProtocolVersion {
+				s.Logger.Warn("TunnelHandshake: client %v protocol version %v unsupported, need >= %v", clientIP, version, common.MinProtocolVersion)
+				if decoy != nil {
+					refuse(w, r, http.StatusUpgradeRequired)
+					return
+				}
+				http.Error(w, fmt.Sprintf("protocol version %v unsupported, need >= %v", version, common.MinProtocolVersion), http.StatusUpgradeRequired)
+				return
+			}
+
+			if r.Header.Get("Probe") == "1" {
+				s.Logger.Debug("TunnelHandshake: probe from %v answered", clientIP)
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]any{
+					"version": common.ProtocolVersion,
+					"probe":   true,
+					"proof":   common.AuthToken(key, "server", clientNonce, serverNonce, timestamp),
+				})
+				return
+			}
+
+			target, commit, err := attach(tenant, clientIP)
+			if err != nil {
+				s.Logger.Warn("TunnelHandshake: client %v rejected: %v", clientIP, err)
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+
+			target.StoreSessionKey(key)
+			if err := target.InitControlCipher(clientNonce, serverNonce, r.TLS); err != nil {
+				commit(false)
+				s.Logger.Warn("TunnelHandshake: client %v rejected: %v", clientIP, err)
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+
+			if r.TLS != nil {
+				s.ReportPeerCert(r.TLS.PeerCertificates)
+			}
+
+			target.Capabilities = common.NegotiateCapabilities(r.Header.Get("Capabilities"))
+			if !target.HasCapability("umux") {
+				target.UDPMux = 0
+			}
+			policy := tenant.Policy.Load()
+			target.Policy.Store(policy)
+			if policy != nil && !target.HasCapability("policy") {
+				commit(false)
+				s.Logger.Warn("TunnelHandshake: client %v rejected: client does not support server policy", clientIP)
+				http.Error(w, "server policy requires protocol capability: policy", http.StatusUpgradeRequired)
+				return
+			}
+			dgram := target.DatagramListenPort()
+			if !target.HasCapability("dgram") {
+				dgram = 0
 			}
 
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]any{
-				"flow": s.DataFlow,
-				"max":  s.MaxPoolCapacity,
-				"tls":  s.TLSCode,
-				"type": s.PoolType,
+				"version": common.ProtocolVersion,
+				"caps":    target.Capabilities,
+				"flow":    target.DataFlow,
+				"max":     target.MaxPoolCapacity,
+				"tls":     target.TLSCode,
+				"type":    target.PoolType,
+				"dgram":   dgram,
+				"umux":    target.UDPMux,
+				"route":   target.RouteID,
+				"policy":  policy,
+				"proof":   target.GenerateAuthToken("server", clientNonce, serverNonce, timestamp),
 			})
 
-			s.Logger.Info("Sending tunnel config: FLOW=%v|MAX=%v|TLS=%v|TYPE=%v",
-				s.DataFlow, s.MaxPoolCapacity, s.TLSCode, s.PoolType)
+			s.Logger.Info("Sending tunnel config: VER=%v|CAPS=%v|FLOW=%v|MAX=%v|TLS=%v|TYPE=%v|DGRAM=%v|UMUX=%v",
+				common.ProtocolVersion, strings.Join(target.Capabilities, ","), target.DataFlow, target.MaxPoolCapacity, target.TLSCode, target.PoolType, dgram, target.UDPMux)
+			if policy != nil {
+				s.Logger.Info("Sending tunnel policy: %v", policy)
+			}
 
-			close(done)
+			commit(true)
 		case http.MethodConnect:
-			if !s.VerifyPreAuth(r) {
+			if len(s.ConnectACL) == 0 {
+				refuse(w, r, http.StatusMethodNotAllowed)
+				return
+			}
+			if tenant, _ := s.matchKey(func(key string) bool { return common.VerifyPreAuth(r, key) }); tenant == nil {
+				if r.Header.Get("Proxy-Authorization") != "" {
+					s.authFailed(clientIP, "connect")
+				}
+				if decoy != nil {
+					decoy.ServeHTTP(w, r)
+					return
+				}
 				w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
+			s.AuthGuard.Success(clientIP)
+			if !s.AuthGuard.Connect(clientIP) {
+				s.Logger.Warn("TunnelHandshake: connect limit reached, refusing %v", clientIP)
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
 			s.HandlePreAuth(w, r)
 		default:
-			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
-			return
+			refuse(w, r, http.StatusMethodNotAllowed)
 		}
 	})
+}
+
+func (s *Server) authFailed(clientIP, kind string) {
+	fails, ban := s.AuthGuard.Fail(clientIP)
+	s.Logger.Warn("TunnelHandshake: %v authentication failed from %v (%v/%v)", kind, clientIP, fails, common.AuthMaxFails)
+	s.Logger.Event("AUTH_FAIL|IP=%v|KIND=%v|FAILS=%v|BAN=%vs", clientIP, kind, fails, int(ban.Seconds()))
+	if ban > 0 {
+		s.Logger.Warn("TunnelHandshake: client %v banned for %v", clientIP, ban)
+	}
+}
 
+func (s *Server) handshakeTLSConfig() *tls.Config {
 	tlsConfig := s.TLSConfig
 	if tlsConfig == nil {
 		tlsConfig, _ = common.NewTLSConfig()
 	}
+	tlsConfig = s.PeerAuthTLSConfig(tlsConfig)
 
 	if len(tlsConfig.Certificates) > 0 && len(tlsConfig.Certificates[0].Certificate) > 0 {
 		fingerprint := s.FormatCertFingerprint(tlsConfig.Certificates[0].Certificate[0])
 		s.Logger.Info("TLS cert fingerprint for authorization: %v", fingerprint)
 	}
-
-	server := &http.Server{
-		Handler:   handler,
-		TLSConfig: tlsConfig,
-		ErrorLog:  s.Logger.StdLogger(),
-	}
-	go server.ServeTLS(s.TunnelListener, "", "")
-
-	select {
-	case <-done:
-		server.Close()
-		s.ClientIP = clientIP
-		if s.TLSCode == "1" {
-			if newTLSConfig, err := common.NewTLSConfig(); err == nil {
-				newTLSConfig.MinVersion = tls.VersionTLS13
-				s.TLSConfig = newTLSConfig
-				s.Logger.Info("TLS code-1: RAM cert regenerated with TLS 1.3")
-			} else {
-				s.Logger.Warn("Failed to regenerate RAM cert: %v", err)
-			}
-		}
-
-		s.TunnelListener, _ = net.ListenTCP("tcp", s.TunnelTCPAddr)
-		return nil
-	case <-s.Ctx.Done():
-		server.Close()
-		return fmt.Errorf("TunnelHandshake: context canceled")
-	}
+	return tlsConfig
 }
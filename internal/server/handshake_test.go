@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NodePassProject/logs"
+	"github.com/NodePassProject/nodepass/internal/common"
+)
+
+func newHandshakeTest(t *testing.T, decoy string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	s := &Server{Common: common.Common{
+		Logger:    logs.NewLogger(logs.None, false),
+		TunnelKey: "key",
+		AuthGuard: common.NewAuthGuard(),
+		Decoy:     decoy,
+	}}
+
+	var attached atomic.Int32
+	handler := s.handshakeHandler(func(_ *Server, _ string) (*common.Common, func(bool), error) {
+		attached.Add(1)
+		target := &common.Common{Logger: s.Logger, CoreType: "server"}
+		return target, func(bool) {}, nil
+	})
+	ts := httptest.NewTLSServer(handler)
+	t.Cleanup(ts.Close)
+	return ts, &attached
+}
+
+func handshakeRequest(t *testing.T, ts *httptest.Server, key string, headers map[string]string) *http.Response {
+	t.Helper()
+	clientNonce := common.NewControlNonce()
+	newRequest := func() *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+		req.Header.Set("Nonce", clientNonce)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		return req
+	}
+
+	resp, err := ts.Client().Do(newRequest())
+	if err != nil {
+		t.Fatalf("challenge request: %v", err)
+	}
+	resp.Body.Close()
+	serverNonce := resp.Header.Get("Challenge")
+	if resp.StatusCode != http.StatusUnauthorized || serverNonce == "" {
+		t.Fatalf("challenge: status %v, challenge %q", resp.StatusCode, serverNonce)
+	}
+
+	timestamp := time.Now().Unix()
+	req := newRequest()
+	req.Header.Set("Challenge", serverNonce)
+	req.Header.Set("Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("Authorization", "Bearer "+common.AuthToken(key, "client", clientNonce, serverNonce, timestamp))
+	resp, err = ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("auth request: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestHandshakeVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		version string
+		want    int
+	}{
+		{"current", "key", strconv.Itoa(common.ProtocolVersion), http.StatusOK},
+		{"missing assumes baseline", "key", "", http.StatusOK},
+		{"too old", "key", strconv.Itoa(common.MinProtocolVersion - 1), http.StatusUpgradeRequired},
+		{"too old with wrong key", "wrong", strconv.Itoa(common.MinProtocolVersion - 1), http.StatusUnauthorized},
+		{"garbage", "key", "x", http.StatusUpgradeRequired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, attached := newHandshakeTest(t, "")
+			headers := map[string]string{}
+			if tt.version != "" {
+				headers["Version"] = tt.version
+			}
+			resp := handshakeRequest(t, ts, tt.key, headers)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %v, want %v", resp.StatusCode, tt.want)
+			}
+			want := int32(0)
+			if tt.want == http.StatusOK {
+				want = 1
+			}
+			if got := attached.Load(); got != want {
+				t.Fatalf("attached %v times, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestHandshakeProbe(t *testing.T) {
+	ts, attached := newHandshakeTest(t, "")
+	resp := handshakeRequest(t, ts, "key", map[string]string{"Version": "1", "Probe": "1"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %v, want 200", resp.StatusCode)
+	}
+
+	var reply struct {
+		Probe bool   `json:"probe"`
+		Proof string `json:"proof"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !reply.Probe || reply.Proof == "" {
+		t.Fatalf("probe reply = %+v", reply)
+	}
+	if got := attached.Load(); got != 0 {
+		t.Fatalf("probe attached %v times", got)
+	}
+}
+
+func TestHandshakeSessionKey(t *testing.T) {
+	s := &Server{Common: common.Common{
+		Logger:    logs.NewLogger(logs.None, false),
+		TunnelKey: "key",
+		AuthGuard: common.NewAuthGuard(),
+	}}
+	s.Keys.Store(&common.TunnelKeys{Current: "key", Previous: map[string]time.Time{"old": time.Now().Add(time.Hour)}})
+
+	var target *common.Common
+	ts := httptest.NewTLSServer(s.handshakeHandler(func(_ *Server, _ string) (*common.Common, func(bool), error) {
+		target = &common.Common{Logger: s.Logger, CoreType: "server"}
+		return target, func(bool) {}, nil
+	}))
+	t.Cleanup(ts.Close)
+
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{"current key", "key"},
+		{"previous key", "old"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := handshakeRequest(t, ts, tt.key, map[string]string{"Version": "1"})
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %v, want 200", resp.StatusCode)
+			}
+			if got := target.LoadSessionKey(); got != tt.key {
+				t.Fatalf("session key = %q, want %q", got, tt.key)
+			}
+			if got := s.LoadTunnelKey(); got != "key" {
+				t.Fatalf("server key = %q, changed by the handshake", got)
+			}
+		})
+	}
+}
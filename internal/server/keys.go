@@ -0,0 +1,64 @@
+package server
+
+import (
+	"time"
+
+	"github.com/NodePassProject/nodepass/internal/common"
+)
+
+func (s *Server) currentKey() string {
+	keys := s.Keys.Load()
+	if keys == nil {
+		return ""
+	}
+	return keys.Current
+}
+
+func (s *Server) reloadKeys() (bool, error) {
+	keys, modTime, err := s.ReadKeys()
+	if err != nil || keys == nil {
+		return false, err
+	}
+	if err := s.checkTenantKeys(keys); err != nil {
+		return false, err
+	}
+	s.Keys.Store(keys)
+	s.KeyTime = modTime
+	return true, nil
+}
+
+func (s *Server) keyLoop() {
+	if s.KeyFile == "" {
+		return
+	}
+
+	ticker := time.NewTicker(common.ReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.Ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := s.reloadKeys()
+		if err != nil {
+			s.Logger.Warn("keyLoop: keeping current keys: %v", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		s.Logger.Info("Tunnel keys reloaded: %v previous", len(s.Keys.Load().Previous))
+		if s.ClientLimit == 0 {
+			s.SendRekey(s.currentKey())
+			continue
+		}
+		s.Clients.Range(func(_, value any) bool {
+			value.(*Server).SendRekey(s.currentKey())
+			return true
+		})
+	}
+}
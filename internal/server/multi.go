@@ -0,0 +1,319 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/NodePassProject/nodepass/internal/common"
+)
+
+func (s *Server) MultiStart() error {
+	s.ClientMux = common.NewClientMux(s.TunnelListener)
+
+	if err := s.startDispatch(); err != nil {
+		return fmt.Errorf("MultiStart: %w", err)
+	}
+	if err := s.startTenants(); err != nil {
+		return fmt.Errorf("MultiStart: %w", err)
+	}
+
+	server := &http.Server{
+		Handler:   s.handshakeHandler((*Server).attachClient),
+		TLSConfig: s.handshakeTLSConfig(),
+		ErrorLog:  s.Logger.StdLogger(),
+	}
+	go server.ServeTLS(s.decoyListener(s.ClientMux.Fallback()), "", "")
+	defer server.Close()
+
+	s.Logger.Info("Accepting up to %v clients...", s.ClientLimit)
+
+	errChan := make(chan error, 1)
+	go func() { errChan <- s.ClientMux.Serve() }()
+
+	select {
+	case <-s.Ctx.Done():
+		return fmt.Errorf("MultiStart: context error: %w", s.Ctx.Err())
+	case err := <-errChan:
+		return fmt.Errorf("MultiStart: accept failed: %w", err)
+	}
+}
+
+func (s *Server) startDispatch() error {
+	if s.DataFlow == "-" {
+		if s.TargetUDPConn != nil {
+			batch, err := s.NewUDPBatch(s.TargetUDPConn, s.dispatchUDPPacket)
+			if err != nil {
+				return err
+			}
+			s.TargetUDPBatch = batch
+			go s.dispatchUDPLoop()
+		}
+		if s.TargetListener != nil {
+			go s.dispatchTCPLoop()
+		}
+	}
+	go s.clientCheckPoint()
+	return nil
+}
+
+func (s *Server) attachClient(clientIP string) (*common.Common, func(ok bool), error) {
+	if s.IsDraining() {
+		return nil, nil, fmt.Errorf("server is draining")
+	}
+	if atomic.AddInt32(&s.ClientCount, 1) > s.ClientLimit {
+		atomic.AddInt32(&s.ClientCount, -1)
+		return nil, nil, fmt.Errorf("client limit reached: %v", s.ClientLimit)
+	}
+
+	routeID, listener := s.ClientMux.Register()
+	peer := &Server{}
+	s.InitPeer(&peer.Common, clientIP)
+	peer.RouteID = routeID
+	peer.TunnelListener = listener
+	peer.ClientMux = s.ClientMux
+
+	return &peer.Common, func(ok bool) {
+		if !ok {
+			s.detachClient(peer)
+			return
+		}
+		go s.runClient(peer)
+	}, nil
+}
+
+func (s *Server) runClient(peer *Server) {
+	defer s.detachClient(peer)
+
+	s.Logger.Info("Client attached: %v route %v (%v/%v)", peer.ClientIP, peer.RouteID, atomic.LoadInt32(&s.ClientCount), s.ClientLimit)
+
+	if err := peer.InitTunnelPool(); err != nil {
+		s.Logger.Warn("Client detached: %v: initTunnelPool failed: %v", peer.ClientIP, err)
+		return
+	}
+
+	if err := peer.SetControlConn(); err != nil {
+		s.Logger.Warn("Client detached: %v: setControlConn failed: %v", peer.ClientIP, err)
+		return
+	}
+	s.Clients.Store(peer.RouteID, peer)
+	go peer.ReserveStandby()
+	go peer.SendRekey(s.currentKey())
+
+	if peer.DataFlow == "-" {
+		go peer.TunnelLoop()
+	}
+
+	if err := peer.CommonControl(); errors.Is(err, common.ErrPeerBye) {
+		s.Logger.Info("Client detached: %v: reason=%v", peer.ClientIP, peer.PeerBye)
+	} else if err != nil {
+		s.Logger.Warn("Client detached: %v: %v", peer.ClientIP, err)
+	}
+}
+
+func (s *Server) detachClient(peer *Server) {
+	if !peer.ClientMux.Unregister(peer.RouteID, peer.TunnelListener.(*common.QueueListener)) {
+		return
+	}
+	s.Clients.CompareAndDelete(peer.RouteID, peer)
+
+	peer.Stop()
+	s.MergeStats(peer.LoadStats())
+	atomic.AddInt32(&s.ClientCount, -1)
+}
+
+func (s *Server) pickClient() *Server {
+	var peers []*Server
+	s.Clients.Range(func(_, value any) bool {
+		if peer := value.(*Server); peer.Ctx.Err() == nil {
+			peers = append(peers, peer)
+		}
+		return true
+	})
+	if len(peers) == 0 {
+		return nil
+	}
+
+	var picked *Server
+	var load int32
+	start := int(atomic.AddUint64(&s.ClientIdx, 1) % uint64(len(peers)))
+	for i := range peers {
+		peer := peers[(start+i)%len(peers)]
+		if current := peer.Common.ActiveSessions(); picked == nil || current < load {
+			picked, load = peer, current
+		}
+	}
+	return picked
+}
+
+func (s *Server) dispatchTCPLoop() {
+	for s.Ctx.Err() == nil {
+		targetConn, err := s.TargetListener.Accept()
+		if err != nil {
+			if s.Ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.Logger.Error("dispatchTCPLoop: accept failed: %v", err)
+
+			select {
+			case <-s.Ctx.Done():
+				return
+			case <-time.After(common.ContextCheckInterval):
+			}
+			continue
+		}
+
+		peer := s.pickClient()
+		if peer == nil {
+			s.Logger.Warn("dispatchTCPLoop: no client attached for %v", targetConn.RemoteAddr())
+			targetConn.Close()
+			continue
+		}
+		if !peer.TargetListener.(*common.QueueListener).Push(targetConn) {
+			s.Logger.Warn("dispatchTCPLoop: client %v queue full", peer.ClientIP)
+			targetConn.Close()
+		}
+	}
+}
+
+func (s *Server) dispatchUDPLoop() {
+	for s.Ctx.Err() == nil {
+		if err := s.TargetUDPBatch.Dispatch(); err != nil {
+			if s.Ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.Logger.Error("dispatchUDPLoop: readBatch failed: %v", err)
+
+			select {
+			case <-s.Ctx.Done():
+				return
+			case <-time.After(common.ContextCheckInterval):
+			}
+		}
+	}
+}
+
+func (s *Server) dispatchUDPPacket(buffer []byte, x int, clientAddr *net.UDPAddr) error {
+	var picked *Server
+	sessionKey := clientAddr.String()
+	s.Clients.Range(func(_, value any) bool {
+		if peer := value.(*Server); peer.Ctx.Err() == nil && peer.HasUDPSession(sessionKey) {
+			picked = peer
+			return false
+		}
+		return true
+	})
+
+	if picked == nil {
+		if picked = s.pickClient(); picked == nil {
+			s.Logger.Warn("dispatchUDPPacket: no client attached for %v", clientAddr)
+			s.PutUDPBuffer(buffer)
+			return nil
+		}
+	}
+	atomic.AddUint64(&s.UDPRX, ^uint64(x-1))
+	atomic.AddUint64(&picked.UDPRX, uint64(x))
+	return picked.TunnelUDPPacket(buffer, x, clientAddr)
+}
+
+func (s *Server) clientCheckPoint() {
+	ticker := time.NewTicker(common.ReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.Ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		stats, ping, pool, count := s.clientStats()
+		if s.TenantName != "" {
+			s.Logger.Event("TENANT_POINT|TENANT=%v|PING=%vms|POOL=%v|%v|CLIENTS=%v", s.TenantName, ping, pool, stats, count)
+			continue
+		}
+
+		s.Tenants.Range(func(_, value any) bool {
+			tenantStats, tenantPing, tenantPool, tenantCount := value.(*Server).clientStats()
+			stats.Add(tenantStats)
+			ping += tenantPing * tenantCount
+			pool += tenantPool
+			count += tenantCount
+			return true
+		})
+		if count > 0 {
+			ping /= count
+		}
+		s.Logger.Event("CHECK_POINT|MODE=%v|PING=%vms|POOL=%v|%v|CLIENTS=%v%v%v", s.RunMode, ping, pool, stats, count, s.DrainPoint(), s.BackoffPoint())
+	}
+}
+
+func (s *Server) clientStats() (common.Stats, int64, int64, int64) {
+	var ping, pool, count int64
+	stats := s.LoadStats()
+	s.Clients.Range(func(_, value any) bool {
+		peer := value.(*Server)
+		stats.Add(peer.LoadStats())
+		ping += atomic.LoadInt64(&peer.LastPing)
+		pool += int64(peer.TunnelPool.Active())
+		count++
+		return true
+	})
+	if count > 0 {
+		ping /= count
+	}
+	return stats, ping, pool, count
+}
+
+func (s *Server) Stop() {
+	s.Tenants.Range(func(_, value any) bool {
+		value.(*Server).Stop()
+		return true
+	})
+	s.Clients.Range(func(_, value any) bool {
+		s.detachClient(value.(*Server))
+		return true
+	})
+	s.Common.Stop()
+}
+
+func (s *Server) SendBye(reason string) {
+	s.Tenants.Range(func(_, value any) bool {
+		value.(*Server).SendBye(reason)
+		return true
+	})
+	s.Clients.Range(func(_, value any) bool {
+		value.(*Server).SendBye(reason)
+		return true
+	})
+	s.Common.SendBye(reason)
+}
+
+func (s *Server) ReleaseListeners() {
+	s.Tenants.Range(func(_, value any) bool {
+		value.(*Server).ReleaseListeners()
+		return true
+	})
+	s.Common.ReleaseListeners()
+}
+
+func (s *Server) StartDrain() {
+	s.Tenants.Range(func(_, value any) bool {
+		value.(*Server).CloseIngress()
+		return true
+	})
+	s.Common.StartDrain()
+}
+
+func (s *Server) ActiveSessions() int32 {
+	stats, _, _, _ := s.clientStats()
+	s.Tenants.Range(func(_, value any) bool {
+		tenantStats, _, _, _ := value.(*Server).clientStats()
+		stats.Add(tenantStats)
+		return true
+	})
+	return stats.ActiveSlot
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/NodePassProject/nodepass/internal/common"
+)
+
+func TestAttachClientSameAddress(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := newTestServer(t, "", nil)
+	s.Ctx, s.Cancel = context.WithCancel(context.Background())
+	t.Cleanup(s.Cancel)
+	s.ClientLimit = 2
+	s.ClientMux = common.NewClientMux(listener)
+
+	first, commitFirst, err := s.attachClient("203.0.113.7")
+	if err != nil {
+		t.Fatalf("attachClient: %v", err)
+	}
+	second, commitSecond, err := s.attachClient("203.0.113.7")
+	if err != nil {
+		t.Fatalf("second attachClient from the same address: %v", err)
+	}
+	if first.RouteID == "" || first.RouteID == second.RouteID {
+		t.Fatalf("route ids %q and %q, want two distinct ids", first.RouteID, second.RouteID)
+	}
+	if _, _, err := s.attachClient("198.51.100.1"); err == nil {
+		t.Fatal("attachClient beyond the client limit succeeded")
+	}
+
+	commitFirst(false)
+	commitSecond(false)
+	if got := s.ClientCount; got != 0 {
+		t.Fatalf("ClientCount = %v after both handshakes failed, want 0", got)
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"time"
+
+	"github.com/NodePassProject/nodepass/internal/common"
+)
+
+func (s *Server) policyLoop() {
+	if s.PolicyFile == "" {
+		return
+	}
+
+	ticker := time.NewTicker(common.ReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.Ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		changed, err := s.LoadPolicy()
+		if err != nil {
+			s.Logger.Warn("policyLoop: keeping current policy: %v", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		s.Logger.Info("Policy reloaded: %v", s.Policy.Load())
+		if s.ClientLimit == 0 {
+			s.SendPolicy()
+			continue
+		}
+		s.Clients.Range(func(_, value any) bool {
+			peer := value.(*Server)
+			peer.Policy.Store(s.Policy.Load())
+			peer.SendPolicy()
+			return true
+		})
+	}
+}
@@ -3,13 +3,12 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
-	"os"
-	"os/signal"
+	"runtime"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/NodePassProject/logs"
@@ -45,30 +44,65 @@ func NewServer(parsedURL *url.URL, tlsCode string, tlsConfig *tls.Config, logger
 	if err := server.InitConfig(); err != nil {
 		return nil, fmt.Errorf("NewServer: initConfig failed: %w", err)
 	}
+	if parsedURL.User.Username() == "" && server.Insecure != "1" {
+		return nil, fmt.Errorf("NewServer: no password set, refusing the default tunnel key without insecure=1")
+	}
+	if server.Decoy != "" && !common.PeekSupported {
+		logger.Warn("NewServer: decoy gets only failed HTTP requests on %v, connections cannot be forwarded before TLS", runtime.GOOS)
+	}
+	if _, err := server.LoadPolicy(); err != nil {
+		return nil, fmt.Errorf("NewServer: %w", err)
+	}
+	if _, err := server.LoadKeys(); err != nil {
+		return nil, fmt.Errorf("NewServer: %w", err)
+	}
+	if err := server.LoadTenants(); err != nil {
+		return nil, fmt.Errorf("NewServer: %w", err)
+	}
+	if server.ClientLimit > 0 && server.PoolType == "1" {
+		return nil, fmt.Errorf("NewServer: clients=%v is not supported with type=1", server.ClientLimit)
+	}
+	server.AuthGuard = common.NewAuthGuard()
 	server.InitRateLimiter()
 	return server, nil
 }
 
 func (s *Server) Run() {
 	logInfo := func(prefix string) {
-		s.Logger.Info("%v: server://%v@%v/%v?dns=%v&lbs=%v&max=%v&mode=%v&type=%v&dial=%v&read=%v&rate=%v&slot=%v&proxy=%v&block=%v&notcp=%v&noudp=%v",
+		s.Logger.Info("%v: server://%v@%v/%v?dns=%v&lbs=%v&max=%v&mode=%v&type=%v&dial=%v&read=%v&tidle=%v&tlife=%v&tmax=%v&uidle=%v&ulife=%v&umax=%v&rate=%v&slot=%v&proxy=%v&block=%v&notcp=%v&noudp=%v&dgram=%v&umux=%v&insecure=%v&clients=%v&tenants=%v&policy=%v&keys=%v&decoy=%v&connect=%v",
 			prefix, s.TunnelKey, s.TunnelTCPAddr, s.GetTargetAddrsString(), s.DNSCacheTTL, s.LBStrategy, s.MaxPoolCapacity,
-			s.RunMode, s.PoolType, s.DialerIP, s.ReadTimeout, s.RateLimit/125000, s.SlotLimit,
-			s.ProxyProtocol, s.BlockProtocol, s.DisableTCP, s.DisableUDP)
+			s.RunMode, s.PoolType, s.DialerIP, s.ReadTimeout, s.TCPIdleTimeout, s.TCPLifeTimeout, s.TCPMaxBytes, s.UDPIdleTimeout, s.UDPLifeTimeout, s.UDPLimit, s.RateLimit/125000, s.SlotLimit,
+			s.ProxyProtocol, s.BlockProtocol, s.DisableTCP, s.DisableUDP, s.DatagramPort, s.UDPMux, s.Insecure, s.ClientLimit, s.TenantFile, s.PolicyFile, s.KeyFile, s.Decoy, s.ConnectACLString())
 	}
 	logInfo("Server started")
 
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx, stop := s.ShutdownContext()
+	go s.DrainLoop(ctx, stop, s.StartDrain, s.ActiveSessions)
 
 	go func() {
 		for ctx.Err() == nil {
+			s.MarkAttempt()
 			if err := s.Start(); err != nil && err != io.EOF {
-				s.Logger.Error("Server error: %v", err)
+				if ctx.Err() != nil {
+					return
+				}
+				cooldown, planned := s.RestartCooldown(err)
+				if errors.Is(err, common.ErrPeerBye) {
+					s.Logger.Warn("Client closed tunnel: reason=%v", s.PeerBye)
+					if planned {
+						s.ResetBackoff()
+					}
+				} else {
+					s.Logger.Error("Server error: %v", err)
+					s.SendBye(common.ByeRestart)
+				}
 				s.Stop()
+				delay, attempt := s.NextBackoff(cooldown)
+				s.Logger.Info("Restart backoff: %v (attempt %v)", delay.Round(time.Millisecond), attempt)
 				select {
 				case <-ctx.Done():
 					return
-				case <-time.After(common.ServiceCooldown):
+				case <-time.After(delay):
 				}
 				logInfo("Server restart")
 			}
@@ -80,7 +114,11 @@ func (s *Server) Run() {
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), common.ShutdownTimeout)
 	defer cancel()
-	if err := s.CommonShutdown(shutdownCtx, s.Stop); err != nil {
+	if err := s.CommonShutdown(shutdownCtx, func() {
+		s.SendBye(s.ByeReason)
+		s.Stop()
+		s.ReleaseListeners()
+	}); err != nil {
 		s.Logger.Error("Server shutdown error: %v", err)
 	} else {
 		s.Logger.Info("Server shutdown complete")
@@ -89,6 +127,9 @@ func (s *Server) Run() {
 
 func (s *Server) Start() error {
 	s.InitContext()
+	s.GetUDPMux()
+	go s.policyLoop()
+	go s.keyLoop()
 
 	if err := s.InitTunnelListener(); err != nil {
 		return fmt.Errorf("Start: initTunnelListener failed: %w", err)
@@ -98,22 +139,16 @@ func (s *Server) Start() error {
 		s.TunnelUDPConn.Close()
 	}
 
-	switch s.RunMode {
-	case "1":
-		if err := s.InitTargetListener(); err != nil {
-			return fmt.Errorf("Start: initTargetListener failed: %w", err)
-		}
-		s.DataFlow = "-"
-	case "2":
-		s.DataFlow = "+"
-	default:
-		if err := s.InitTargetListener(); err == nil {
-			s.RunMode = "1"
-			s.DataFlow = "-"
-		} else {
-			s.RunMode = "2"
-			s.DataFlow = "+"
-		}
+	if err := s.initRunMode(); err != nil {
+		return fmt.Errorf("Start: %w", err)
+	}
+
+	if err := s.InitDatagramListener(); err != nil {
+		s.Logger.Warn("Start: initDatagramListener failed: %v", err)
+	}
+
+	if s.ClientLimit > 0 {
+		return s.MultiStart()
 	}
 
 	s.Logger.Info("Pending tunnel handshake...")
@@ -122,6 +157,8 @@ func (s *Server) Start() error {
 		return fmt.Errorf("Start: tunnelHandshake failed: %w", err)
 	}
 
+	go s.AcceptDatagramConn()
+
 	if err := s.InitTunnelPool(); err != nil {
 		return fmt.Errorf("Start: initTunnelPool failed: %w", err)
 	}
@@ -130,6 +167,8 @@ func (s *Server) Start() error {
 	if err := s.SetControlConn(); err != nil {
 		return fmt.Errorf("Start: setControlConn failed: %w", err)
 	}
+	go s.ReserveStandby()
+	go s.SendRekey(s.currentKey())
 
 	if s.DataFlow == "-" {
 		go s.TunnelLoop()
@@ -140,3 +179,24 @@ func (s *Server) Start() error {
 	}
 	return nil
 }
+
+func (s *Server) initRunMode() error {
+	switch s.RunMode {
+	case "1":
+		if err := s.InitTargetListener(); err != nil {
+			return fmt.Errorf("initTargetListener failed: %w", err)
+		}
+		s.DataFlow = "-"
+	case "2":
+		s.DataFlow = "+"
+	default:
+		if err := s.InitTargetListener(); err == nil {
+			s.RunMode = "1"
+			s.DataFlow = "-"
+		} else {
+			s.RunMode = "2"
+			s.DataFlow = "+"
+		}
+	}
+	return nil
+}
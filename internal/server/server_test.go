@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/NodePassProject/logs"
+)
+
+func TestNewServerInsecure(t *testing.T) {
+	tests := []struct {
+		name    string
+		rawURL  string
+		wantErr bool
+	}{
+		{"password", "server://secret@127.0.0.1:10101/127.0.0.1:8080", false},
+		{"no password", "server://127.0.0.1:10101/127.0.0.1:8080", true},
+		{"no password insecure=0", "server://127.0.0.1:10101/127.0.0.1:8080?insecure=0", true},
+		{"no password insecure=1", "server://127.0.0.1:10101/127.0.0.1:8080?insecure=1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsedURL, err := url.Parse(tt.rawURL)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			_, err = NewServer(parsedURL, "0", nil, logs.NewLogger(logs.None, false))
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "no password set") {
+					t.Fatalf("NewServer error = %v, want refusal without a password", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewServer: %v", err)
+			}
+		})
+	}
+}
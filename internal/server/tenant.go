@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/NodePassProject/nodepass/internal/common"
+)
+
+func (s *Server) LoadTenants() error {
+	if s.TenantFile == "" {
+		return nil
+	}
+
+	file, err := os.Open(s.TenantFile)
+	if err != nil {
+		return fmt.Errorf("LoadTenants: %w", err)
+	}
+	defer file.Close()
+
+	keys := map[string]string{s.TunnelKey: "default"}
+	if tunnelKeys := s.Keys.Load(); tunnelKeys != nil {
+		keys[tunnelKeys.Current] = "default"
+		for key := range tunnelKeys.Previous {
+			keys[key] = "keys file"
+		}
+	}
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		tenant, err := s.newTenant(line)
+		if err != nil {
+			return fmt.Errorf("LoadTenants: line %v: %w", lineNum, err)
+		}
+		if tenant.TenantName == "" {
+			tenant.TenantName = fmt.Sprintf("tenant%v", lineNum)
+		}
+		if name, ok := keys[tenant.TunnelKey]; ok {
+			return fmt.Errorf("LoadTenants: line %v: key already used by %v", lineNum, name)
+		}
+		if _, loaded := s.Tenants.LoadOrStore(tenant.TenantName, tenant); loaded {
+			return fmt.Errorf("LoadTenants: line %v: duplicate tenant name %v", lineNum, tenant.TenantName)
+		}
+		keys[tenant.TunnelKey] = tenant.TenantName
+
+		s.Logger.Info("Tenant loaded: %v -> %v (mode=%v, clients=%v)",
+			tenant.TenantName, tenant.GetTargetAddrsString(), tenant.RunMode, tenant.ClientLimit)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("LoadTenants: %w", err)
+	}
+
+	if s.ClientLimit == 0 {
+		s.ClientLimit = 1
+	}
+	return nil
+}
+
+func (s *Server) newTenant(line string) (*Server, error) {
+	parsedURL, err := url.Parse(line)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+	if parsedURL.Scheme != "server" {
+		return nil, fmt.Errorf("unsupported scheme: %v", parsedURL.Scheme)
+	}
+	if parsedURL.User.Username() == "" {
+		return nil, fmt.Errorf("no tenant key set")
+	}
+	parsedURL.Host = s.ParsedURL.Host
+
+	tenant := &Server{
+		Common: common.Common{
+			ParsedURL:     parsedURL,
+			TLSCode:       s.TLSCode,
+			TLSConfig:     s.TLSConfig,
+			Logger:        s.Logger,
+			TCPBufferPool: s.TCPBufferPool,
+			UDPBufferPool: s.UDPBufferPool,
+		},
+	}
+	if err := tenant.InitConfig(); err != nil {
+		return nil, err
+	}
+	if tenant.PoolType == "1" {
+		return nil, fmt.Errorf("type=1 is not supported for tenants")
+	}
+	if tenant.ClientLimit == 0 {
+		tenant.ClientLimit = 1
+	}
+	if _, err := tenant.LoadPolicy(); err != nil {
+		return nil, err
+	}
+	tenant.TenantName = parsedURL.Fragment
+	tenant.Parent = &s.Common
+	tenant.InitRateLimiter()
+	return tenant, nil
+}
+
+func (s *Server) checkTenantKeys(keys *common.TunnelKeys) error {
+	if keys == nil {
+		return nil
+	}
+	var err error
+	s.Tenants.Range(func(_, value any) bool {
+		tenant := value.(*Server)
+		_, previous := keys.Previous[tenant.TunnelKey]
+		if tenant.TunnelKey == keys.Current || previous {
+			err = fmt.Errorf("checkTenantKeys: key already used by %v", tenant.TenantName)
+		}
+		return err == nil
+	})
+	return err
+}
+
+func (s *Server) startTenants() error {
+	var err error
+	s.Tenants.Range(func(_, value any) bool {
+		tenant := value.(*Server)
+		tenant.Ctx, tenant.Cancel = context.WithCancel(s.Ctx)
+		tenant.ClientMux = s.ClientMux
+		if err = tenant.initRunMode(); err != nil {
+			err = fmt.Errorf("tenant %v: %w", tenant.TenantName, err)
+			return false
+		}
+		if err = tenant.startDispatch(); err != nil {
+			err = fmt.Errorf("tenant %v: %w", tenant.TenantName, err)
+			return false
+		}
+		go tenant.policyLoop()
+		return true
+	})
+	return err
+}
+
+func (s *Server) matchTenant(token, clientNonce, serverNonce string, timestamp int64) (*Server, string) {
+	return s.matchKey(func(key string) bool {
+		return common.VerifyAuthKey(key, token, "client", clientNonce, serverNonce, timestamp)
+	})
+}
+
+func (s *Server) matchKey(verify func(key string) bool) (*Server, string) {
+	if keys := s.Keys.Load(); keys != nil {
+		if key, ok := keys.Match(verify); ok {
+			return s, key
+		}
+	} else if verify(s.TunnelKey) {
+		return s, s.TunnelKey
+	}
+
+	var matched *Server
+	s.Tenants.Range(func(_, value any) bool {
+		if tenant := value.(*Server); verify(tenant.TunnelKey) {
+			matched = tenant
+			return false
+		}
+		return true
+	})
+	if matched == nil {
+		return nil, ""
+	}
+	return matched, matched.TunnelKey
+}
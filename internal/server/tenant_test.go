@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NodePassProject/logs"
+	"github.com/NodePassProject/nodepass/internal/common"
+)
+
+func newTestServer(t *testing.T, tenants string, keys *common.TunnelKeys) *Server {
+	t.Helper()
+	tenantFile := filepath.Join(t.TempDir(), "tenants")
+	if err := os.WriteFile(tenantFile, []byte(tenants), 0600); err != nil {
+		t.Fatalf("write tenants: %v", err)
+	}
+	parsedURL, _ := url.Parse("server://main@127.0.0.1:10101/127.0.0.1:8080")
+	s := &Server{Common: common.Common{
+		ParsedURL:     parsedURL,
+		Logger:        logs.NewLogger(logs.None, false),
+		TunnelKey:     "main",
+		TenantFile:    tenantFile,
+		TCPBufferPool: &sync.Pool{},
+		UDPBufferPool: &sync.Pool{},
+	}}
+	s.Keys.Store(keys)
+	return s
+}
+
+func TestLoadTenantsKeyConflicts(t *testing.T) {
+	keys := &common.TunnelKeys{
+		Current:  "rotated",
+		Previous: map[string]time.Time{"old": time.Now().Add(time.Hour)},
+	}
+
+	tests := []struct {
+		name    string
+		tenants string
+		keys    *common.TunnelKeys
+		wantErr string
+	}{
+		{"distinct keys", "server://alice@/127.0.0.1:22#alice\n", keys, ""},
+		{"url key", "server://main@/127.0.0.1:22#alice\n", nil, "key already used by default"},
+		{"current rotated key", "server://rotated@/127.0.0.1:22#alice\n", keys, "key already used by default"},
+		{"previous rotated key", "server://old@/127.0.0.1:22#alice\n", keys, "key already used by keys file"},
+		{"duplicate tenant key", "server://alice@/127.0.0.1:22#alice\nserver://alice@/127.0.0.1:23#bob\n", nil, "key already used by alice"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newTestServer(t, tt.tenants, tt.keys).LoadTenants()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("LoadTenants: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("LoadTenants error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckTenantKeys(t *testing.T) {
+	s := newTestServer(t, "server://alice@/127.0.0.1:22#alice\n", nil)
+	if err := s.LoadTenants(); err != nil {
+		t.Fatalf("LoadTenants: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		keys    *common.TunnelKeys
+		wantErr bool
+	}{
+		{"no keys", nil, false},
+		{"distinct", &common.TunnelKeys{Current: "next", Previous: map[string]time.Time{"main": time.Now()}}, false},
+		{"current reuses tenant key", &common.TunnelKeys{Current: "alice"}, true},
+		{"previous reuses tenant key", &common.TunnelKeys{Current: "next", Previous: map[string]time.Time{"alice": time.Now()}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.checkTenantKeys(tt.keys); (err != nil) != tt.wantErr {
+				t.Fatalf("checkTenantKeys error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReloadKeysRejected(t *testing.T) {
+	s := newTestServer(t, "server://alice@/127.0.0.1:22#alice\n", nil)
+	if err := s.LoadTenants(); err != nil {
+		t.Fatalf("LoadTenants: %v", err)
+	}
+	s.KeyFile = filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(s.KeyFile, []byte("alice\n"), 0600); err != nil {
+		t.Fatalf("write keys: %v", err)
+	}
+
+	if changed, err := s.reloadKeys(); changed || err == nil {
+		t.Fatalf("reloadKeys = %v, %v, want a tenant key conflict", changed, err)
+	}
+	if s.Keys.Load() != nil || !s.KeyTime.IsZero() {
+		t.Fatal("rejected keys file was applied")
+	}
+
+	s.Tenants.Delete("alice")
+	if changed, err := s.reloadKeys(); !changed || err != nil {
+		t.Fatalf("reloadKeys = %v, %v, want the same file to be retried", changed, err)
+	}
+	if got := s.currentKey(); got != "alice" {
+		t.Fatalf("currentKey = %q, want %q", got, "alice")
+	}
+	if changed, _ := s.reloadKeys(); changed {
+		t.Fatal("unchanged keys file reloaded twice")
+	}
+}
+
+func TestMatchKeyPreAuth(t *testing.T) {
+	s := newTestServer(t, "server://alice@/127.0.0.1:22#alice\n", &common.TunnelKeys{
+		Current:  "new",
+		Previous: map[string]time.Time{"old": time.Now().Add(time.Hour), "stale": time.Now().Add(-time.Hour)},
+	})
+	if err := s.LoadTenants(); err != nil {
+		t.Fatalf("LoadTenants: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		want string
+	}{
+		{"current key", "new", "default"},
+		{"previous key in grace", "old", "default"},
+		{"expired previous key", "stale", ""},
+		{"tenant key", "alice", "alice"},
+		{"unknown key", "bob", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodConnect, "127.0.0.1:22", nil)
+			r.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(tt.key+":")))
+			target, _ := s.matchKey(func(key string) bool { return common.VerifyPreAuth(r, key) })
+			got := ""
+			if target == s {
+				got = "default"
+			} else if target != nil {
+				got = target.TenantName
+			}
+			if got != tt.want {
+				t.Fatalf("matchKey(%q) = %q, want %q", tt.key, got, tt.want)
+			}
+		})
+	}
+}